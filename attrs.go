@@ -0,0 +1,255 @@
+package misery
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yuin/stagparser"
+)
+
+// The Attr helpers read one attribute from tag definitions the way the
+// built-in builders do, so custom builders accept the same syntax. Each
+// returns whether the attribute is present and, when its value has the wrong
+// type, an error wrapping ErrAttributeMalformed. When an attribute is set
+// more than once the last value wins.
+
+// StringAttr returns the string value of the name attribute.
+func StringAttr(defs []stagparser.Definition, name string) (string, bool, error) {
+	value, ok := attrValue(defs, name)
+	if !ok {
+		return "", false, nil
+	}
+
+	s, ok := value.(string)
+	if !ok {
+		return "", true, fmt.Errorf("%w: %s is not a string", ErrAttributeMalformed, name)
+	}
+
+	return s, true, nil
+}
+
+// FloatAttr returns the numeric value of the name attribute.
+func FloatAttr(defs []stagparser.Definition, name string) (float64, bool, error) {
+	value, ok := attrValue(defs, name)
+	if !ok {
+		return 0, false, nil
+	}
+
+	f, ok := toFloat(value)
+	if !ok {
+		return 0, true, fmt.Errorf("%w: %s is not a number", ErrAttributeMalformed, name)
+	}
+
+	return f, true, nil
+}
+
+// FloatListAttr returns the value of the name attribute written as a list
+// of numbers, such as buckets=[0.1, 1, '1e3', 1_000]. BucketsAttr also
+// accepts durations and sizes.
+func FloatListAttr(defs []stagparser.Definition, name string) ([]float64, bool, error) {
+	value, ok := attrValue(defs, name)
+	if !ok {
+		return nil, false, nil
+	}
+
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, true, fmt.Errorf("%w: %s is not a list of floats", ErrAttributeMalformed, name)
+	}
+
+	floats := make([]float64, 0, len(list))
+	for _, item := range list {
+		if f, ok := toFloat(item); ok {
+			floats = append(floats, f)
+			continue
+		}
+		// quoted or unusual literals such as '1e-3' or 1_000
+		s, ok := item.(string)
+		if !ok {
+			return nil, true, fmt.Errorf("%w: %s value is not a float64 %T %v", ErrAttributeMalformed, name, item, item)
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, true, fmt.Errorf("%w: %s value %q is not a number", ErrAttributeMalformed, name, s)
+		}
+		floats = append(floats, f)
+	}
+
+	return floats, true, nil
+}
+
+// StringListAttr returns the value of the name attribute written as a list
+// of strings, such as names=[read, write].
+func StringListAttr(defs []stagparser.Definition, name string) ([]string, bool, error) {
+	value, ok := attrValue(defs, name)
+	if !ok {
+		return nil, false, nil
+	}
+
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, true, fmt.Errorf("%w: %s is not a list", ErrAttributeMalformed, name)
+	}
+
+	strs := make([]string, 0, len(list))
+	for _, item := range list {
+		s, ok := item.(string)
+		if !ok {
+			return nil, true, fmt.Errorf("%w: %s value %v is not a string", ErrAttributeMalformed, name, item)
+		}
+		strs = append(strs, s)
+	}
+
+	return strs, true, nil
+}
+
+// attrValue returns the raw value of the last name attribute in defs.
+func attrValue(defs []stagparser.Definition, name string) (interface{}, bool) {
+	var value interface{}
+	found := false
+	for _, def := range defs {
+		if def.Name() == name {
+			value, found = def.Attributes()[name], true
+		}
+	}
+
+	return value, found
+}
+
+// vecAttrs holds the attributes every vec builder accepts.
+type vecAttrs struct {
+	name        string
+	help        string
+	labels      []string
+	initLabels  prometheus.Labels
+	allowed     map[string][]string
+	constLabels prometheus.Labels
+	unit        string
+}
+
+// parseVecAttrs reads the naming, help, labels and const label attributes,
+// defaulting the name from structFieldName.
+func parseVecAttrs(structFieldName string, defs []stagparser.Definition, cfg *config) (vecAttrs, error) {
+	attrs := vecAttrs{name: defaultMetricName(structFieldName, cfg), labels: []string{}}
+
+	name, err := qualifiedName(attrs.name, defs)
+	if err != nil {
+		return vecAttrs{}, err
+	}
+	attrs.name = name
+	if attrs.unit, err = unitAttr(defs); err != nil {
+		return vecAttrs{}, err
+	}
+	help, _, err := StringAttr(defs, "help")
+	if err != nil {
+		return vecAttrs{}, err
+	}
+	attrs.help = help
+	if value, ok := attrValue(defs, "labels"); ok {
+		if attrs.labels, attrs.initLabels, attrs.allowed, err = parseLabels(value, cfg); err != nil {
+			return vecAttrs{}, err
+		}
+	}
+	if attrs.constLabels, err = constLabelsAttr(defs, attrs.labels, cfg); err != nil {
+		return vecAttrs{}, err
+	}
+
+	return attrs, nil
+}
+
+// qualifiedName returns the metric name the name attribute, or fallback
+// without one, makes once joined with the namespace and subsystem
+// attributes as prometheus.BuildFQName joins them and suffixed with the
+// unit attribute.
+func qualifiedName(fallback string, defs []stagparser.Definition) (string, error) {
+	name, ok, err := StringAttr(defs, "name")
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		name = fallback
+	}
+	namespace, _, err := StringAttr(defs, "namespace")
+	if err != nil {
+		return "", err
+	}
+	subsystem, _, err := StringAttr(defs, "subsystem")
+	if err != nil {
+		return "", err
+	}
+
+	unit, err := unitAttr(defs)
+	if err != nil {
+		return "", err
+	}
+
+	return withUnitSuffix(prometheus.BuildFQName(namespace, subsystem, name), unit), nil
+}
+
+// metricUnits are the units the unit attribute accepts: the base units
+// Prometheus names metrics in.
+var metricUnits = map[string]bool{
+	"seconds": true,
+	"bytes":   true,
+	"ratio":   true,
+	"meters":  true,
+	"volts":   true,
+	"amperes": true,
+	"joules":  true,
+	"grams":   true,
+	"celsius": true,
+}
+
+// unitAttr returns the unit attribute, empty when unset.
+func unitAttr(defs []stagparser.Definition) (string, error) {
+	unit, ok, err := StringAttr(defs, "unit")
+	if err != nil || !ok {
+		return "", err
+	}
+	if !metricUnits[unit] {
+		units := make([]string, 0, len(metricUnits))
+		for u := range metricUnits {
+			units = append(units, u)
+		}
+		sort.Strings(units)
+		return "", fmt.Errorf("%w: unit %s is not a base unit, use one of %s",
+			ErrAttributeMalformed, unit, strings.Join(units, ", "))
+	}
+
+	return unit, nil
+}
+
+// withUnitSuffix returns name ending with unit, placed before a _total
+// suffix as counters want it: bytes_read_total becomes
+// bytes_read_bytes_total, read_bytes_total stays as it is.
+func withUnitSuffix(name, unit string) string {
+	if unit == "" {
+		return name
+	}
+	base, total := strings.CutSuffix(name, "_total")
+	if !strings.HasSuffix(base, "_"+unit) && base != unit {
+		base += "_" + unit
+	}
+	if total {
+		return base + "_total"
+	}
+
+	return base
+}
+
+// info returns the metricInfo of a vec of kind built from attrs.
+func (attrs vecAttrs) info(kind string) metricInfo {
+	return metricInfo{
+		name:        attrs.name,
+		kind:        kind,
+		help:        attrs.help,
+		labels:      attrs.labels,
+		initLabels:  attrs.initLabels,
+		allowed:     attrs.allowed,
+		constLabels: attrs.constLabels,
+		unit:        attrs.unit,
+	}
+}
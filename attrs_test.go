@@ -0,0 +1,192 @@
+package misery
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// attrCase is a test case of an Attr helper reading the attribute x.
+type attrCase struct {
+	name      string
+	tag       string
+	want      interface{}
+	wantFound bool
+	wantErr   bool
+}
+
+func checkAttr(t *testing.T, tt attrCase, got interface{}, found bool, err error) {
+	t.Helper()
+
+	if tt.wantErr {
+		if !errors.Is(err, ErrAttributeMalformed) {
+			t.Fatalf("got error %v, want ErrAttributeMalformed", err)
+		}
+		if !found {
+			t.Error("malformed attribute reported missing")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if found != tt.wantFound {
+		t.Errorf("found %v, want %v", found, tt.wantFound)
+	}
+	if !reflect.DeepEqual(got, tt.want) {
+		t.Errorf("got %#v, want %#v", got, tt.want)
+	}
+}
+
+func TestStringAttr(t *testing.T) {
+	tests := []attrCase{
+		{name: "present", tag: "x=abc", want: "abc", wantFound: true},
+		{name: "quoted", tag: "x='a b.'", want: "a b.", wantFound: true},
+		{name: "last wins", tag: "x=a,x=b", want: "b", wantFound: true},
+		{name: "missing", tag: "y=abc", want: ""},
+		{name: "number", tag: "x=1", wantErr: true},
+		{name: "list", tag: "x=[a,b]", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, found, err := StringAttr(parseTestTag(t, tt.tag), "x")
+			checkAttr(t, tt, got, found, err)
+		})
+	}
+}
+
+func TestFloatAttr(t *testing.T) {
+	tests := []attrCase{
+		{name: "float", tag: "x=1.5", want: 1.5, wantFound: true},
+		{name: "integer", tag: "x=2", want: 2.0, wantFound: true},
+		{name: "negative", tag: "x=-0.25", want: -0.25, wantFound: true},
+		{name: "missing", tag: "y=1", want: 0.0},
+		{name: "string", tag: "x=fast", wantErr: true},
+		{name: "list", tag: "x=[1,2]", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, found, err := FloatAttr(parseTestTag(t, tt.tag), "x")
+			checkAttr(t, tt, got, found, err)
+		})
+	}
+}
+
+func TestFloatListAttr(t *testing.T) {
+	tests := []attrCase{
+		{name: "numbers", tag: "x=[0.1,1,10]", want: []float64{0.1, 1, 10}, wantFound: true},
+		{name: "quoted and underscored", tag: "x=['1e-3',1_000]", want: []float64{0.001, 1000}, wantFound: true},
+		{name: "missing", tag: "y=[1]", want: []float64(nil)},
+		{name: "not a list", tag: "x=1", wantErr: true},
+		{name: "not a number", tag: "x=[1,fast]", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, found, err := FloatListAttr(parseTestTag(t, tt.tag), "x")
+			checkAttr(t, tt, got, found, err)
+		})
+	}
+}
+
+func TestStringListAttr(t *testing.T) {
+	tests := []attrCase{
+		{name: "strings", tag: "x=[read,write]", want: []string{"read", "write"}, wantFound: true},
+		{name: "missing", tag: "y=[a]", want: []string(nil)},
+		{name: "not a list", tag: "x=read", wantErr: true},
+		{name: "not a string", tag: "x=[read,1]", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, found, err := StringListAttr(parseTestTag(t, tt.tag), "x")
+			checkAttr(t, tt, got, found, err)
+		})
+	}
+}
+
+func TestQualifiedName(t *testing.T) {
+	tests := []struct {
+		name    string
+		tag     string
+		want    string
+		wantErr bool
+	}{
+		{name: "name only", tag: "name=requests_total", want: "requests_total"},
+		{name: "namespace and subsystem", tag: "name=requests_total,namespace=myapp,subsystem=http", want: "myapp_http_requests_total"},
+		{name: "namespace only", tag: "name=requests_total,namespace=myapp", want: "myapp_requests_total"},
+		{name: "subsystem only", tag: "name=requests_total,subsystem=http", want: "http_requests_total"},
+		{name: "field name", tag: "namespace=myapp,subsystem=http", want: "myapp_http_requests"},
+		{name: "namespace not a string", tag: "name=requests_total,namespace=1", wantErr: true},
+		{name: "subsystem not a string", tag: "name=requests_total,subsystem=[a]", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := qualifiedName("requests", parseTestTag(t, tt.tag))
+			if tt.wantErr {
+				if !errors.Is(err, ErrAttributeMalformed) {
+					t.Fatalf("got error %v, want ErrAttributeMalformed", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("qualifiedName: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithUnitSuffix(t *testing.T) {
+	tests := []struct {
+		name string
+		unit string
+		want string
+	}{
+		{name: "random_duration", unit: "seconds", want: "random_duration_seconds"},
+		{name: "random_duration_seconds", unit: "seconds", want: "random_duration_seconds"},
+		{name: "bytes_read_total", unit: "bytes", want: "bytes_read_bytes_total"},
+		{name: "read_bytes_total", unit: "bytes", want: "read_bytes_total"},
+		{name: "bytes", unit: "bytes", want: "bytes"},
+		{name: "cache_hit", unit: "ratio", want: "cache_hit_ratio"},
+		{name: "requests_total", unit: "", want: "requests_total"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"/"+tt.unit, func(t *testing.T) {
+			if got := withUnitSuffix(tt.name, tt.unit); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnitAttr(t *testing.T) {
+	tests := []struct {
+		name    string
+		tag     string
+		want    string
+		wantErr bool
+	}{
+		{name: "seconds", tag: "unit=seconds", want: "seconds"},
+		{name: "unset", tag: "name=x"},
+		{name: "not a base unit", tag: "unit=milliseconds", wantErr: true},
+		{name: "not a string", tag: "unit=1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := unitAttr(parseTestTag(t, tt.tag))
+			if tt.wantErr {
+				if !errors.Is(err, ErrAttributeMalformed) {
+					t.Fatalf("got error %v, want ErrAttributeMalformed", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unitAttr: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
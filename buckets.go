@@ -0,0 +1,108 @@
+package misery
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yuin/stagparser"
+)
+
+// sizeUnits maps the suffixes of size literals to their number of bytes:
+// decimal for KB, MB, GB and TB, binary for KiB, MiB, GiB and TiB.
+var sizeUnits = map[string]float64{
+	"B":   1,
+	"KB":  1e3,
+	"MB":  1e6,
+	"GB":  1e9,
+	"TB":  1e12,
+	"KiB": 1 << 10,
+	"MiB": 1 << 20,
+	"GiB": 1 << 30,
+	"TiB": 1 << 40,
+}
+
+// BucketsAttr returns the value of the name attribute written as a list of
+// histogram bucket bounds. Besides numbers, as FloatListAttr accepts them,
+// elements may be Go durations like 250ms or 1s, converted to seconds, or
+// sizes like 64KB or 16MiB, converted to bytes; durations and sizes do not
+// mix.
+func BucketsAttr(defs []stagparser.Definition, name string) ([]float64, bool, error) {
+	value, ok := attrValue(defs, name)
+	if !ok {
+		return nil, false, nil
+	}
+
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, true, fmt.Errorf("%w: %s is not a list of floats", ErrAttributeMalformed, name)
+	}
+
+	buckets := make([]float64, 0, len(list))
+	var durations, sizes bool
+	for _, item := range list {
+		if f, ok := toFloat(item); ok {
+			buckets = append(buckets, f)
+			continue
+		}
+		s, ok := item.(string)
+		if !ok {
+			return nil, true, fmt.Errorf("%w: %s value is not a float64 %T %v", ErrAttributeMalformed, name, item, item)
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			buckets = append(buckets, f)
+			continue
+		}
+		if size, ok := parseSize(s); ok {
+			buckets = append(buckets, size)
+			sizes = true
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, true, fmt.Errorf("%w: %s value %q is not a number, a duration or a size", ErrAttributeMalformed, name, s)
+		}
+		buckets = append(buckets, d.Seconds())
+		durations = true
+	}
+	if durations && sizes {
+		return nil, true, fmt.Errorf("%w: %s mix durations and sizes", ErrAttributeMalformed, name)
+	}
+
+	return buckets, true, nil
+}
+
+// bucketsCarryUnit reports whether the name attribute, a list BucketsAttr
+// accepts, has durations or sizes, which already carry their unit.
+func bucketsCarryUnit(defs []stagparser.Definition, name string) bool {
+	value, _ := attrValue(defs, name)
+	list, _ := value.([]interface{})
+	for _, item := range list {
+		if s, ok := item.(string); ok {
+			if _, err := strconv.ParseFloat(s, 64); err != nil {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// parseSize parses a size literal, a number followed by one of sizeUnits,
+// into bytes.
+func parseSize(s string) (float64, bool) {
+	digits := strings.TrimRightFunc(s, func(r rune) bool {
+		return r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z'
+	})
+	unit, ok := sizeUnits[s[len(digits):]]
+	if !ok {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(digits), 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return f * unit, true
+}
@@ -0,0 +1,366 @@
+package misery
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestBucketNumbers(t *testing.T) {
+	tests := []struct {
+		name    string
+		tag     string
+		want    []float64
+		wantErr bool
+	}{
+		{name: "plain", tag: "buckets=[0.5,1,10]", want: []float64{0.5, 1, 10}},
+		{name: "scientific notation", tag: "buckets=[1e-3,5e-3,1e-2]", want: []float64{0.001, 0.005, 0.01}},
+		{name: "upper case exponent", tag: "buckets=[1E-3,1E+3]", want: []float64{0.001, 1000}},
+		{name: "large values", tag: "buckets=[1e6,1e9,1e12]", want: []float64{1e6, 1e9, 1e12}},
+		{name: "underscores", tag: "buckets=[1_000,10_000,1_000_000]", want: []float64{1000, 10000, 1000000}},
+		{name: "quoted", tag: "buckets=['1e-3','2.5e-3']", want: []float64{0.001, 0.0025}},
+		{name: "unparseable", tag: "buckets=[1e-3,1e]", wantErr: true},
+		{name: "not increasing", tag: "buckets=[1e-2,1e-3]", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, info, err := createPrometheusHistogram("Latency", parseTestTag(t, "name=latency_seconds,"+tt.tag), newConfig())
+			if tt.wantErr {
+				if !errors.Is(err, ErrAttributeMalformed) {
+					t.Fatalf("got error %v, want ErrAttributeMalformed", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("createPrometheusHistogram: %v", err)
+			}
+			if !reflect.DeepEqual(info.buckets, tt.want) {
+				t.Errorf("buckets %v, want %v", info.buckets, tt.want)
+			}
+		})
+	}
+}
+
+func TestBucketFunc(t *testing.T) {
+	bucketFunc := func(field string) []float64 {
+		switch field {
+		case "Latency":
+			return []float64{0.01, 0.1}
+		case "Broken":
+			return []float64{1, 0.5}
+		}
+		return nil
+	}
+
+	tests := []struct {
+		name    string
+		field   string
+		tag     string
+		want    []float64
+		wantErr bool
+	}{
+		{name: "computed", field: "Latency", want: []float64{0.01, 0.1}},
+		{name: "nil falls back to the default", field: "Other", want: defaultHistogramBuckets},
+		{name: "tag buckets win", field: "Latency", tag: ",buckets=[1,2]", want: []float64{1, 2}},
+		{name: "not increasing", field: "Broken", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defs := parseTestTag(t, "name=latency_seconds"+tt.tag)
+			_, info, err := createPrometheusHistogram(tt.field, defs, newConfig(WithBucketFunc(bucketFunc)))
+			if tt.wantErr {
+				if !errors.Is(err, ErrAttributeMalformed) {
+					t.Fatalf("got error %v, want ErrAttributeMalformed", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("createPrometheusHistogram: %v", err)
+			}
+			if !reflect.DeepEqual(info.buckets, tt.want) {
+				t.Errorf("buckets %v, want %v", info.buckets, tt.want)
+			}
+		})
+	}
+}
+
+func TestBucketUnit(t *testing.T) {
+	tests := []struct {
+		name    string
+		tag     string
+		want    []float64
+		wantErr bool
+	}{
+		{name: "milliseconds", tag: "buckets=[10,50,100],bucket_unit=ms", want: []float64{0.01, 0.05, 0.1}},
+		{name: "microseconds", tag: "buckets=[500,1000],bucket_unit=us", want: []float64{0.0005, 0.001}},
+		{name: "nanoseconds", tag: "buckets=[1e6,1e9],bucket_unit=ns", want: []float64{0.001, 1}},
+		{name: "seconds", tag: "buckets=[0.5,1],bucket_unit=s", want: []float64{0.5, 1}},
+		{name: "generated", tag: "buckets='linear(100,100,3)',bucket_unit=ms", want: []float64{0.1, 0.2, 0.3}},
+		{name: "unknown unit", tag: "buckets=[10,50],bucket_unit=min", wantErr: true},
+		{name: "buckets carrying their unit", tag: "buckets=[10ms,50ms],bucket_unit=ms", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, info, err := createPrometheusHistogram("Latency", parseTestTag(t, "name=latency_seconds,"+tt.tag), newConfig())
+			if tt.wantErr {
+				if !errors.Is(err, ErrAttributeMalformed) {
+					t.Fatalf("got error %v, want ErrAttributeMalformed", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("createPrometheusHistogram: %v", err)
+			}
+			if !reflect.DeepEqual(info.buckets, tt.want) {
+				t.Errorf("buckets %v, want %v", info.buckets, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvBuckets(t *testing.T) {
+	const variable = "MISERY_TEST_LATENCY_BUCKETS"
+
+	tests := []struct {
+		name    string
+		value   string
+		set     bool
+		extra   string
+		strict  bool
+		want    []float64
+		warning bool
+		wantErr bool
+	}{
+		{name: "set", value: "0.1, 0.5,1", set: true, want: []float64{0.1, 0.5, 1}},
+		{name: "set with a bucket unit", value: "100,500", set: true, extra: ",bucket_unit=ms", want: []float64{0.1, 0.5}},
+		{name: "unset", want: defaultHistogramBuckets, warning: true},
+		{name: "empty", value: " ", set: true, want: defaultHistogramBuckets, warning: true},
+		{name: "unset in strict mode", strict: true, wantErr: true},
+		{name: "not a number", value: "0.1,fast", set: true, wantErr: true},
+		{name: "not increasing", value: "1,0.5", set: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.set {
+				t.Setenv(variable, tt.value)
+			}
+			tag := "name=latency_seconds,buckets=env(" + variable + ")" + tt.extra
+			logger := &recordLogger{}
+			cfg := newConfig(WithLogger(logger), WithStrict(tt.strict))
+			_, info, err := createPrometheusHistogram("Latency", parseTestTag(t, tag), cfg)
+			if tt.wantErr {
+				if !errors.Is(err, ErrAttributeMalformed) {
+					t.Fatalf("got error %v, want ErrAttributeMalformed", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("createPrometheusHistogram: %v", err)
+			}
+			if !reflect.DeepEqual(info.buckets, tt.want) {
+				t.Errorf("buckets %v, want %v", info.buckets, tt.want)
+			}
+			if got := strings.Contains(logger.String(), "is not set"); got != tt.warning {
+				t.Errorf("warning logged: %q", logger.String())
+			}
+		})
+	}
+}
+
+func TestWithMaxBuckets(t *testing.T) {
+	type stat struct {
+		Latency *prometheus.HistogramVec `misery:"name=latency_seconds,buckets='exp(0.001,2,30)'"`
+	}
+
+	tests := []struct {
+		name    string
+		limit   int
+		wantErr bool
+	}{
+		{name: "unlimited", limit: 0},
+		{name: "at the limit", limit: 30},
+		{name: "above the limit", limit: 20, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &stat{}
+			err := RegisterMetricsWithOptions(s, prometheus.NewRegistry(), WithMaxBuckets(tt.limit))
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("RegisterMetricsWithOptions: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrAttributeMalformed) {
+				t.Fatalf("got error %v, want ErrAttributeMalformed", err)
+			}
+			for _, want := range []string{"Latency", "30 buckets", "limit of 20"} {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not mention %q", err, want)
+				}
+			}
+			if s.Latency != nil {
+				t.Error("field built despite the error")
+			}
+		})
+	}
+}
+
+func TestWithDefaultBuckets(t *testing.T) {
+	custom := []float64{0.25, 2.5, 25}
+
+	tests := []struct {
+		name    string
+		tag     string
+		opts    []Option
+		want    []float64
+		wantErr bool
+	}{
+		{name: "custom default", tag: "name=latency_seconds", opts: []Option{WithDefaultBuckets(custom)}, want: custom},
+		{name: "explicit buckets win", tag: "name=latency_seconds,buckets=[1,2]", opts: []Option{WithDefaultBuckets(custom)}, want: []float64{1, 2}},
+		{
+			name: "bucket func wins",
+			tag:  "name=latency_seconds",
+			opts: []Option{WithDefaultBuckets(custom), WithBucketFunc(func(string) []float64 { return []float64{5} })},
+			want: []float64{5},
+		},
+		{name: "nil restores the package default", tag: "name=latency_seconds", opts: []Option{WithDefaultBuckets(nil)}, want: defaultHistogramBuckets},
+		{name: "not increasing", tag: "name=latency_seconds", opts: []Option{WithDefaultBuckets([]float64{1, 1})}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, info, err := createPrometheusHistogram("Latency", parseTestTag(t, tt.tag), newConfig(tt.opts...))
+			if tt.wantErr {
+				if !errors.Is(err, ErrAttributeMalformed) {
+					t.Fatalf("got error %v, want ErrAttributeMalformed", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("createPrometheusHistogram: %v", err)
+			}
+			if !reflect.DeepEqual(info.buckets, tt.want) {
+				t.Errorf("buckets %v, want %v", info.buckets, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithDefaultBucketsRegistered(t *testing.T) {
+	type stat struct {
+		Latency prometheus.Histogram `misery:"name=latency_seconds"`
+		Size    prometheus.Histogram `misery:"name=size_bytes"`
+	}
+
+	buckets := []float64{0.5, 5}
+	opt := WithDefaultBuckets(buckets)
+	buckets[0] = 100 // the option keeps its own copy
+
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	if err := RegisterMetricsWithOptions(s, registry, opt); err != nil {
+		t.Fatalf("RegisterMetricsWithOptions: %v", err)
+	}
+	s.Latency.Observe(1)
+	s.Size.Observe(1)
+	for _, name := range []string{"latency_seconds", "size_bytes"} {
+		var got []float64
+		for _, bucket := range gatherFamily(t, registry, name).GetMetric()[0].GetHistogram().GetBucket() {
+			got = append(got, bucket.GetUpperBound())
+		}
+		if want := []float64{0.5, 5}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s buckets %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestBucketsAttrDurations(t *testing.T) {
+	tests := []attrCase{
+		{name: "durations", tag: "x=[1ms,10ms,100ms,1s]", want: []float64{0.001, 0.01, 0.1, 1}, wantFound: true},
+		{name: "compound duration", tag: "x=[500us,1m30s]", want: []float64{0.0005, 90}, wantFound: true},
+		{name: "mixed with numbers", tag: "x=[0.001,250ms,2]", want: []float64{0.001, 0.25, 2}, wantFound: true},
+		{name: "missing", tag: "y=[1s]", want: []float64(nil)},
+		{name: "unknown unit", tag: "x=[1ms,1fortnight]", wantErr: true},
+		{name: "not a list", tag: "x=1s", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, found, err := BucketsAttr(parseTestTag(t, tt.tag), "x")
+			checkAttr(t, tt, got, found, err)
+		})
+	}
+}
+
+func TestDurationBucketsTag(t *testing.T) {
+	type stat struct {
+		Latency *prometheus.HistogramVec `misery:"name=latency_seconds,buckets=[1ms,10ms,100ms,1s]"`
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	s.Latency.WithLabelValues().Observe(0.05)
+
+	var buckets []float64
+	var counts []uint64
+	for _, b := range gatherFamily(t, registry, "latency_seconds").GetMetric()[0].GetHistogram().GetBucket() {
+		buckets = append(buckets, b.GetUpperBound())
+		counts = append(counts, b.GetCumulativeCount())
+	}
+	if want := []float64{0.001, 0.01, 0.1, 1}; !reflect.DeepEqual(buckets, want) {
+		t.Errorf("buckets %v, want %v", buckets, want)
+	}
+	if want := []uint64{0, 0, 1, 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("cumulative counts %v, want %v", counts, want)
+	}
+}
+
+func TestBucketsAttrSizes(t *testing.T) {
+	tests := []attrCase{
+		{name: "decimal", tag: "x=[1KB,64KB,1MB,16MB]", want: []float64{1e3, 64e3, 1e6, 16e6}, wantFound: true},
+		{name: "binary", tag: "x=[1KiB,64KiB,1MiB,1GiB]", want: []float64{1024, 65536, 1 << 20, 1 << 30}, wantFound: true},
+		{name: "bytes and fractions", tag: "x=[512B,1.5KB,2TB]", want: []float64{512, 1500, 2e12}, wantFound: true},
+		{name: "mixed with numbers", tag: "x=[100,1KB]", want: []float64{100, 1000}, wantFound: true},
+		{name: "lower case unit", tag: "x=[1kb]", wantErr: true},
+		{name: "mixed with durations", tag: "x=[1KB,1s]", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, found, err := BucketsAttr(parseTestTag(t, tt.tag), "x")
+			checkAttr(t, tt, got, found, err)
+		})
+	}
+}
+
+func TestSizeBucketsTag(t *testing.T) {
+	type stat struct {
+		Payload prometheus.Histogram `misery:"name=payload,unit=bytes,buckets=[1KB,64KB,1MB,16MB]"`
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	s.Payload.Observe(2000)
+
+	var buckets []float64
+	for _, b := range gatherFamily(t, registry, "payload_bytes").GetMetric()[0].GetHistogram().GetBucket() {
+		buckets = append(buckets, b.GetUpperBound())
+	}
+	if want := []float64{1e3, 64e3, 1e6, 16e6}; !reflect.DeepEqual(buckets, want) {
+		t.Errorf("buckets %v, want %v", buckets, want)
+	}
+
+	scaled := &struct {
+		Payload prometheus.Histogram `misery:"name=payload_bytes,buckets=[1KB,1MB],bucket_unit=ms"`
+	}{}
+	if err := RegisterMetrics(scaled, prometheus.NewRegistry()); !errors.Is(err, ErrAttributeMalformed) {
+		t.Errorf("sizes with bucket_unit: got error %v, want ErrAttributeMalformed", err)
+	}
+}
@@ -0,0 +1,204 @@
+package misery
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yuin/stagparser"
+)
+
+// Builder declares metrics with chained calls instead of struct tags, for
+// code that creates metrics at run time:
+//
+//	requests, err := misery.NewBuilder(registry).
+//		Counter("http_requests_total").
+//		Help("HTTP requests served.").
+//		Labels("method", "code").
+//		Build()
+//
+// Build validates and registers the metric exactly as the tag of a struct
+// field with the same attributes would.
+type Builder struct {
+	registry prometheus.Registerer
+}
+
+// NewBuilder returns a Builder registering into registry.
+func NewBuilder(registry prometheus.Registerer) *Builder {
+	return &Builder{registry: registry}
+}
+
+// metricSpec collects the attributes of a metric being built as the
+// definitions a struct tag would produce.
+type metricSpec struct {
+	registry prometheus.Registerer
+	name     string
+	defs     []stagparser.Definition
+}
+
+func (b *Builder) spec(name string) metricSpec {
+	return metricSpec{
+		registry: b.registry,
+		name:     name,
+		defs:     []stagparser.Definition{newDefinition("name", name)},
+	}
+}
+
+func (s *metricSpec) set(name string, value interface{}) {
+	s.defs = append(s.defs, newDefinition(name, value))
+}
+
+// CounterBuilder builds a counter vec.
+type CounterBuilder struct {
+	spec metricSpec
+}
+
+// Counter starts a counter vec named name.
+func (b *Builder) Counter(name string) *CounterBuilder {
+	return &CounterBuilder{spec: b.spec(name)}
+}
+
+// Help sets the help string.
+func (c *CounterBuilder) Help(help string) *CounterBuilder {
+	c.spec.set("help", help)
+	return c
+}
+
+// Labels sets the variable labels.
+func (c *CounterBuilder) Labels(labels ...string) *CounterBuilder {
+	c.spec.set("labels", stringList(labels))
+	return c
+}
+
+// Build creates and registers the counter vec.
+func (c *CounterBuilder) Build() (*prometheus.CounterVec, error) {
+	cfg := newConfig()
+	vec, info, err := createPrometheusCounter(c.spec.name, c.spec.defs, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := registerSingle(vec, info, c.spec.registry, cfg); err != nil {
+		return nil, err
+	}
+
+	return vec, nil
+}
+
+// GaugeBuilder builds a gauge vec.
+type GaugeBuilder struct {
+	spec metricSpec
+}
+
+// Gauge starts a gauge vec named name.
+func (b *Builder) Gauge(name string) *GaugeBuilder {
+	return &GaugeBuilder{spec: b.spec(name)}
+}
+
+// Help sets the help string.
+func (g *GaugeBuilder) Help(help string) *GaugeBuilder {
+	g.spec.set("help", help)
+	return g
+}
+
+// Labels sets the variable labels.
+func (g *GaugeBuilder) Labels(labels ...string) *GaugeBuilder {
+	g.spec.set("labels", stringList(labels))
+	return g
+}
+
+// Build creates and registers the gauge vec.
+func (g *GaugeBuilder) Build() (*prometheus.GaugeVec, error) {
+	cfg := newConfig()
+	vec, info, err := createPrometheusGauge(g.spec.name, g.spec.defs, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := registerSingle(vec, info, g.spec.registry, cfg); err != nil {
+		return nil, err
+	}
+
+	return vec, nil
+}
+
+// HistogramBuilder builds a histogram vec.
+type HistogramBuilder struct {
+	spec metricSpec
+}
+
+// Histogram starts a histogram vec named name, with the default buckets
+// unless Buckets is called.
+func (b *Builder) Histogram(name string) *HistogramBuilder {
+	return &HistogramBuilder{spec: b.spec(name)}
+}
+
+// Help sets the help string.
+func (h *HistogramBuilder) Help(help string) *HistogramBuilder {
+	h.spec.set("help", help)
+	return h
+}
+
+// Labels sets the variable labels.
+func (h *HistogramBuilder) Labels(labels ...string) *HistogramBuilder {
+	h.spec.set("labels", stringList(labels))
+	return h
+}
+
+// Buckets sets the bucket upper bounds.
+func (h *HistogramBuilder) Buckets(buckets ...float64) *HistogramBuilder {
+	h.spec.set("buckets", floatList(buckets))
+	return h
+}
+
+// Build creates and registers the histogram vec.
+func (h *HistogramBuilder) Build() (*prometheus.HistogramVec, error) {
+	cfg := newConfig()
+	vec, info, err := createPrometheusHistogram(h.spec.name, h.spec.defs, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := registerSingle(vec, info, h.spec.registry, cfg); err != nil {
+		return nil, err
+	}
+
+	return vec, nil
+}
+
+// SummaryBuilder builds a summary vec.
+type SummaryBuilder struct {
+	spec metricSpec
+}
+
+// Summary starts a summary vec named name, without quantiles unless
+// Objectives is called.
+func (b *Builder) Summary(name string) *SummaryBuilder {
+	return &SummaryBuilder{spec: b.spec(name)}
+}
+
+// Help sets the help string.
+func (s *SummaryBuilder) Help(help string) *SummaryBuilder {
+	s.spec.set("help", help)
+	return s
+}
+
+// Labels sets the variable labels.
+func (s *SummaryBuilder) Labels(labels ...string) *SummaryBuilder {
+	s.spec.set("labels", stringList(labels))
+	return s
+}
+
+// Objectives sets the quantiles to expose with their allowed errors.
+func (s *SummaryBuilder) Objectives(objectives map[float64]float64) *SummaryBuilder {
+	s.spec.set("objectives", objectives)
+	return s
+}
+
+// Build creates and registers the summary vec.
+func (s *SummaryBuilder) Build() (*prometheus.SummaryVec, error) {
+	cfg := newConfig()
+	vec, info, err := createPrometheusSummary(s.spec.name, s.spec.defs, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := registerSingle(vec, info, s.spec.registry, cfg); err != nil {
+		return nil, err
+	}
+
+	return vec, nil
+}
@@ -0,0 +1,135 @@
+package misery
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBuilder(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	b := NewBuilder(registry)
+
+	requests, err := b.Counter("requests_total").Help("Requests.").Labels("method", "code").Build()
+	if err != nil {
+		t.Fatalf("Counter: %v", err)
+	}
+	queue, err := b.Gauge("queue_depth").Help("Queue depth.").Labels("pool").Build()
+	if err != nil {
+		t.Fatalf("Gauge: %v", err)
+	}
+	latency, err := b.Histogram("latency_seconds").Help("Latency.").Labels("code").Buckets(0.1, 1).Build()
+	if err != nil {
+		t.Fatalf("Histogram: %v", err)
+	}
+	sizes, err := b.Summary("sizes_bytes").Help("Sizes.").Objectives(map[float64]float64{0.5: 0.05}).Build()
+	if err != nil {
+		t.Fatalf("Summary: %v", err)
+	}
+
+	requests.WithLabelValues("GET", "200").Inc()
+	queue.WithLabelValues("db").Set(3)
+	latency.WithLabelValues("200").Observe(0.5)
+	sizes.WithLabelValues().Observe(10)
+
+	want := `
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{code="200",le="0.1"} 0
+latency_seconds_bucket{code="200",le="1"} 1
+latency_seconds_bucket{code="200",le="+Inf"} 1
+latency_seconds_sum{code="200"} 0.5
+latency_seconds_count{code="200"} 1
+# HELP queue_depth Queue depth.
+# TYPE queue_depth gauge
+queue_depth{pool="db"} 3
+# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{code="200",method="GET"} 1
+# HELP sizes_bytes Sizes.
+# TYPE sizes_bytes summary
+sizes_bytes{quantile="0.5"} 10
+sizes_bytes_sum 10
+sizes_bytes_count 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuilderErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		build   func(b *Builder) error
+		wantErr error
+	}{
+		{
+			name: "counter name",
+			build: func(b *Builder) error {
+				_, err := b.Counter("broken-name").Build()
+				return err
+			},
+			wantErr: ErrAttributeMalformed,
+		},
+		{
+			name: "gauge label",
+			build: func(b *Builder) error {
+				_, err := b.Gauge("queue_depth").Labels("pool-name").Build()
+				return err
+			},
+			wantErr: ErrAttributeMalformed,
+		},
+		{
+			name: "histogram buckets",
+			build: func(b *Builder) error {
+				_, err := b.Histogram("latency_seconds").Buckets(1, 0.1).Build()
+				return err
+			},
+			wantErr: ErrAttributeMalformed,
+		},
+		{
+			name: "histogram le label",
+			build: func(b *Builder) error {
+				_, err := b.Histogram("latency_seconds").Labels("le").Build()
+				return err
+			},
+			wantErr: ErrAttributeMalformed,
+		},
+		{
+			name: "summary objectives",
+			build: func(b *Builder) error {
+				_, err := b.Summary("sizes_bytes").Objectives(map[float64]float64{1.5: 0.01}).Build()
+				return err
+			},
+			wantErr: ErrAttributeMalformed,
+		},
+		{
+			name: "already registered",
+			build: func(b *Builder) error {
+				if _, err := b.Counter("requests_total").Build(); err != nil {
+					return err
+				}
+				_, err := b.Counter("requests_total").Build()
+				return err
+			},
+			wantErr: errAny,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.build(NewBuilder(prometheus.NewRegistry()))
+			if tt.wantErr == errAny {
+				if err == nil {
+					t.Fatal("got no error")
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package misery
+
+import (
+	"runtime"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// unknownBuildValue labels build information the binary does not carry.
+const unknownBuildValue = "unknown"
+
+// RegisterBuildInfo registers the build_info gauge, always 1, labelled with
+// the main module path and version, the Go version and the VCS revision and
+// commit time of the running binary. Binaries without build information,
+// or built outside version control, get unknown for the missing labels.
+func RegisterBuildInfo(registry prometheus.Registerer) error {
+	info, ok := debug.ReadBuildInfo()
+
+	return RegisterConstMetrics(map[string]ConstMetricSpec{
+		"build_info": {
+			Help:   "Build information of the running binary, always 1.",
+			Labels: buildInfoLabels(info, ok),
+			Value:  1,
+		},
+	}, registry)
+}
+
+func buildInfoLabels(info *debug.BuildInfo, ok bool) prometheus.Labels {
+	labels := prometheus.Labels{
+		"path":        unknownBuildValue,
+		"version":     unknownBuildValue,
+		"goversion":   runtime.Version(),
+		"revision":    unknownBuildValue,
+		"commit_time": unknownBuildValue,
+	}
+	if !ok || info == nil {
+		return labels
+	}
+
+	if info.Main.Path != "" {
+		labels["path"] = info.Main.Path
+	}
+	if info.Main.Version != "" {
+		labels["version"] = info.Main.Version
+	}
+	if info.GoVersion != "" {
+		labels["goversion"] = info.GoVersion
+	}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			labels["revision"] = setting.Value
+		case "vcs.time":
+			labels["commit_time"] = setting.Value
+		}
+	}
+
+	return labels
+}
@@ -0,0 +1,100 @@
+package misery
+
+import (
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestBuildInfoLabels(t *testing.T) {
+	tests := []struct {
+		name string
+		info *debug.BuildInfo
+		ok   bool
+		want prometheus.Labels
+	}{
+		{
+			name: "present",
+			info: &debug.BuildInfo{
+				GoVersion: "go1.23.4",
+				Main:      debug.Module{Path: "example.com/app", Version: "v1.2.3"},
+				Settings: []debug.BuildSetting{
+					{Key: "vcs", Value: "git"},
+					{Key: "vcs.revision", Value: "0123abcd"},
+					{Key: "vcs.time", Value: "2024-05-06T07:08:09Z"},
+				},
+			},
+			ok: true,
+			want: prometheus.Labels{
+				"path":        "example.com/app",
+				"version":     "v1.2.3",
+				"goversion":   "go1.23.4",
+				"revision":    "0123abcd",
+				"commit_time": "2024-05-06T07:08:09Z",
+			},
+		},
+		{
+			name: "outside version control",
+			info: &debug.BuildInfo{
+				GoVersion: "go1.23.4",
+				Main:      debug.Module{Path: "example.com/app", Version: "(devel)"},
+			},
+			ok: true,
+			want: prometheus.Labels{
+				"path":        "example.com/app",
+				"version":     "(devel)",
+				"goversion":   "go1.23.4",
+				"revision":    unknownBuildValue,
+				"commit_time": unknownBuildValue,
+			},
+		},
+		{
+			name: "unavailable",
+			want: prometheus.Labels{
+				"path":        unknownBuildValue,
+				"version":     unknownBuildValue,
+				"goversion":   runtime.Version(),
+				"revision":    unknownBuildValue,
+				"commit_time": unknownBuildValue,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := buildInfoLabels(tt.info, tt.ok)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got labels %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegisterBuildInfo(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	if err := RegisterBuildInfo(registry); err != nil {
+		t.Fatalf("RegisterBuildInfo: %v", err)
+	}
+
+	family := gatherFamily(t, registry, "build_info")
+	if got := len(family.GetMetric()); got != 1 {
+		t.Fatalf("got %d series, want 1", got)
+	}
+	metric := family.GetMetric()[0]
+	if got := metric.GetGauge().GetValue(); got != 1 {
+		t.Errorf("got value %v, want 1", got)
+	}
+	var names []string
+	for _, pair := range metric.GetLabel() {
+		names = append(names, pair.GetName())
+		if pair.GetValue() == "" {
+			t.Errorf("label %s is empty", pair.GetName())
+		}
+	}
+	if got, want := strings.Join(names, ","), "commit_time,goversion,path,revision,version"; got != want {
+		t.Errorf("got labels %s, want %s", got, want)
+	}
+}
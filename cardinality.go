@@ -0,0 +1,134 @@
+package misery
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// cardinalityGuard is registered in place of a vec metric when
+// WithMaxCardinality is in effect. The struct field still holds the plain
+// prometheus vec, whose .With path misery cannot hook into, so the limit is
+// enforced at collect time: on every scrape the series admitted earlier
+// stay, new series are admitted in label value order until n series are
+// admitted, and the rest are logged, left out of the exposition and deleted
+// from the vec.
+//
+// The trade-offs: the guard bounds what is exposed and prunes the vec on
+// every scrape, but between two scrapes the vec grows with every new label
+// combination, so it limits memory only as far as scrapes are frequent. A
+// dropped series keeps accepting observations until the next scrape, and
+// those observations are lost; a series that is dropped and recreated is
+// dropped again on every scrape while the vec is at the limit. Admitted
+// series that disappear from the vec (Delete, Reset) free their slot for
+// the next newcomer.
+type cardinalityGuard struct {
+	prometheus.Collector
+
+	vec      deleter
+	info     metricInfo
+	limit    int
+	logger   Logger
+	mu       sync.Mutex
+	admitted map[string]struct{}
+}
+
+type deleter interface {
+	Delete(labels prometheus.Labels) bool
+}
+
+func newCardinalityGuard(collector prometheus.Collector, info metricInfo, limit int, logger Logger) prometheus.Collector {
+	vec, ok := collector.(deleter)
+	if !ok || len(info.labels) == 0 {
+		return collector
+	}
+
+	return &cardinalityGuard{
+		Collector: collector,
+		vec:       vec,
+		info:      info,
+		limit:     limit,
+		logger:    logger,
+		admitted:  map[string]struct{}{},
+	}
+}
+
+func (g *cardinalityGuard) unwrap() prometheus.Collector {
+	return g.Collector
+}
+
+func (g *cardinalityGuard) Collect(ch chan<- prometheus.Metric) {
+	inner := make(chan prometheus.Metric)
+	go func() {
+		g.Collector.Collect(inner)
+		close(inner)
+	}()
+
+	type series struct {
+		metric prometheus.Metric
+		labels prometheus.Labels
+		key    string
+	}
+	var collected []series
+	present := map[string]struct{}{}
+	for m := range inner {
+		labels := g.seriesLabels(m)
+		key := seriesKey(g.info.labels, labels)
+		collected = append(collected, series{metric: m, labels: labels, key: key})
+		present[key] = struct{}{}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for key := range g.admitted {
+		if _, ok := present[key]; !ok {
+			delete(g.admitted, key)
+		}
+	}
+	// admit newcomers in a deterministic order rather than the order the
+	// vec happens to collect them in
+	sort.SliceStable(collected, func(i, j int) bool {
+		return collected[i].key < collected[j].key
+	})
+	for _, s := range collected {
+		if _, ok := g.admitted[s.key]; !ok {
+			if len(g.admitted) >= g.limit {
+				g.logger.Printf("misery: %s reached max cardinality %d, dropping series %v", g.info.name, g.limit, s.labels)
+				g.vec.Delete(s.labels)
+				continue
+			}
+			g.admitted[s.key] = struct{}{}
+		}
+		ch <- s.metric
+	}
+}
+
+func (g *cardinalityGuard) seriesLabels(m prometheus.Metric) prometheus.Labels {
+	var pb dto.Metric
+	labels := make(prometheus.Labels, len(g.info.labels))
+	if err := m.Write(&pb); err != nil {
+		return labels
+	}
+	for _, pair := range pb.GetLabel() {
+		for _, name := range g.info.labels {
+			if pair.GetName() == name {
+				labels[name] = pair.GetValue()
+			}
+		}
+	}
+
+	return labels
+}
+
+func seriesKey(names []string, labels prometheus.Labels) string {
+	values := make([]string, 0, len(names))
+	for _, name := range names {
+		values = append(values, labels[name])
+	}
+
+	return strings.Join(values, "\xff")
+}
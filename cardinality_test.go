@@ -0,0 +1,78 @@
+package misery
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMaxCardinality(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,help=Requests.,labels=[path]"`
+		Uptime   prometheus.Gauge       `misery:"name=uptime_seconds,help=Uptime."`
+	}
+
+	tests := []struct {
+		name    string
+		limit   int
+		paths   []string
+		want    []string
+		dropped []string
+	}{
+		{name: "under the limit", limit: 3, paths: []string{"/b", "/a"}, want: []string{"/a", "/b"}},
+		{name: "at the limit", limit: 2, paths: []string{"/b", "/a"}, want: []string{"/a", "/b"}},
+		{
+			name:    "over the limit",
+			limit:   2,
+			paths:   []string{"/d", "/c", "/b", "/a"},
+			want:    []string{"/a", "/b"},
+			dropped: []string{"/c", "/d"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := &recordLogger{}
+			registry := prometheus.NewRegistry()
+			s := &stat{}
+			err := RegisterMetricsWithOptions(s, registry, WithMaxCardinality(tt.limit), WithLogger(logger))
+			if err != nil {
+				t.Fatalf("RegisterMetricsWithOptions: %v", err)
+			}
+			for _, path := range tt.paths {
+				s.Requests.WithLabelValues(path).Inc()
+			}
+
+			var want strings.Builder
+			want.WriteString("# HELP requests_total Requests.\n# TYPE requests_total counter\n")
+			for _, path := range tt.want {
+				want.WriteString(`requests_total{path="` + path + `"} 1` + "\n")
+			}
+			if err := testutil.GatherAndCompare(registry, strings.NewReader(want.String()), "requests_total"); err != nil {
+				t.Fatal(err)
+			}
+			if n := testutil.CollectAndCount(s.Requests); n != len(tt.want) {
+				t.Errorf("vec holds %d series after the scrape, want %d", n, len(tt.want))
+			}
+			for _, path := range tt.dropped {
+				if !strings.Contains(logger.String(), path) {
+					t.Errorf("dropping %s was not logged: %q", path, logger.String())
+				}
+			}
+			if len(tt.dropped) == 0 && logger.String() != "" {
+				t.Errorf("unexpected log: %q", logger.String())
+			}
+
+			// series admitted before stay while newcomers are dropped
+			s.Requests.WithLabelValues("/0").Inc()
+			s.Requests.WithLabelValues("/a").Inc()
+			if n := testutil.CollectAndCount(registry, "requests_total"); n != min(tt.limit, len(tt.want)+1) {
+				t.Errorf("%d series exposed on the second scrape", n)
+			}
+			if got := testutil.ToFloat64(s.Requests.WithLabelValues("/a")); got != 2 {
+				t.Errorf("admitted series /a = %v, want 2", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package misery
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ConstMetricSpec describes a single snapshot value exposed by
+// RegisterConstMetrics.
+type ConstMetricSpec struct {
+	// Name of the metric. The map key is used when empty.
+	Name   string
+	Help   string
+	Labels prometheus.Labels
+	Value  float64
+	// Type defaults to prometheus.GaugeValue.
+	Type prometheus.ValueType
+}
+
+// RegisterConstMetrics exposes values taken from an external system as const
+// metrics. Specs are copied on registration, so the exposed values never
+// change. The collector stays registered in registry, so a later set using
+// any of the same names fails to register.
+func RegisterConstMetrics(desc map[string]ConstMetricSpec, registry prometheus.Registerer) error {
+	if err := checkRegistry(registry); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(desc))
+	for key := range desc {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	collector := &constCollector{specs: make([]constMetric, 0, len(keys))}
+	for _, key := range keys {
+		spec := desc[key]
+		name := spec.Name
+		if name == "" {
+			name = key
+		}
+		valueType := spec.Type
+		if valueType == 0 {
+			valueType = prometheus.GaugeValue
+		}
+
+		labelNames := make([]string, 0, len(spec.Labels))
+		for labelName := range spec.Labels {
+			labelNames = append(labelNames, labelName)
+		}
+		sort.Strings(labelNames)
+		labelValues := make([]string, 0, len(labelNames))
+		for _, labelName := range labelNames {
+			labelValues = append(labelValues, spec.Labels[labelName])
+		}
+
+		m := constMetric{
+			desc:        prometheus.NewDesc(name, spec.Help, labelNames, nil),
+			valueType:   valueType,
+			value:       spec.Value,
+			labelValues: labelValues,
+		}
+		if _, err := prometheus.NewConstMetric(m.desc, m.valueType, m.value, m.labelValues...); err != nil {
+			return fmt.Errorf("const metric %s is invalid: %w", key, err)
+		}
+		collector.specs = append(collector.specs, m)
+	}
+
+	if err := registry.Register(collector); err != nil {
+		return fmt.Errorf("const metrics register failed: %w", err)
+	}
+
+	return nil
+}
+
+type constMetric struct {
+	desc        *prometheus.Desc
+	valueType   prometheus.ValueType
+	value       float64
+	labelValues []string
+}
+
+type constCollector struct {
+	specs []constMetric
+}
+
+func (c *constCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, m := range c.specs {
+		ch <- m.desc
+	}
+}
+
+func (c *constCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range c.specs {
+		ch <- prometheus.MustNewConstMetric(m.desc, m.valueType, m.value, m.labelValues...)
+	}
+}
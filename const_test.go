@@ -0,0 +1,94 @@
+package misery
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRegisterConstMetrics(t *testing.T) {
+	tests := []struct {
+		name    string
+		specs   map[string]ConstMetricSpec
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "gauge by default",
+			specs: map[string]ConstMetricSpec{
+				"queue_depth": {Help: "Queue depth.", Labels: prometheus.Labels{"queue": "mail"}, Value: 7},
+			},
+			want: `
+# HELP queue_depth Queue depth.
+# TYPE queue_depth gauge
+queue_depth{queue="mail"} 7
+`,
+		},
+		{
+			name: "named counter",
+			specs: map[string]ConstMetricSpec{
+				"rows": {Name: "imported_rows_total", Help: "Imported rows.", Value: 42, Type: prometheus.CounterValue},
+			},
+			want: `
+# HELP imported_rows_total Imported rows.
+# TYPE imported_rows_total counter
+imported_rows_total 42
+`,
+		},
+		{
+			name: "labels sorted by name",
+			specs: map[string]ConstMetricSpec{
+				"up": {Help: "Up.", Labels: prometheus.Labels{"zone": "b", "host": "a"}, Value: 1},
+			},
+			want: `
+# HELP up Up.
+# TYPE up gauge
+up{host="a",zone="b"} 1
+`,
+		},
+		{
+			name: "invalid label value",
+			specs: map[string]ConstMetricSpec{
+				"bad": {Help: "Bad.", Labels: prometheus.Labels{"path": "\xff"}},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			err := RegisterConstMetrics(tt.specs, registry)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RegisterConstMetrics: %v", err)
+			}
+			if err := testutil.GatherAndCompare(registry, strings.NewReader(tt.want)); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestRegisterConstMetricsNilRegistry(t *testing.T) {
+	if err := RegisterConstMetrics(nil, nil); err == nil {
+		t.Fatal("expected an error for a nil registry")
+	}
+}
+
+func TestRegisterConstMetricsTwice(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	specs := map[string]ConstMetricSpec{"up": {Help: "Up.", Value: 1}}
+	if err := RegisterConstMetrics(specs, registry); err != nil {
+		t.Fatalf("RegisterConstMetrics: %v", err)
+	}
+	if err := RegisterConstMetrics(specs, registry); err == nil {
+		t.Fatal("expected an error registering the same names again")
+	}
+}
@@ -0,0 +1,116 @@
+package misery
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yuin/stagparser"
+)
+
+// resolveConstLabelFrom replaces const_label_from=[label:Field, ...] with
+// the const labels it names, each set to the value of the string field Field
+// of structValue at registration time.
+func resolveConstLabelFrom(structValue reflect.Value, defs []stagparser.Definition) ([]stagparser.Definition, error) {
+	pairs, ok, err := StringListAttr(defs, "const_label_from")
+	if err != nil || !ok {
+		return defs, err
+	}
+
+	labels := make(prometheus.Labels, len(pairs))
+	for _, pair := range pairs {
+		label, fieldName, ok := strings.Cut(pair, ":")
+		if !ok || label == "" || fieldName == "" {
+			return nil, fmt.Errorf("%w: const_label_from %q is not label:Field", ErrAttributeMalformed, pair)
+		}
+		if _, ok := labels[label]; ok {
+			return nil, fmt.Errorf("%w: const_label_from sets %s twice", ErrAttributeMalformed, label)
+		}
+		sibling := structValue.FieldByName(fieldName)
+		if !sibling.IsValid() {
+			return nil, fmt.Errorf("%w: const_label_from field %s not found", ErrAttributeMalformed, fieldName)
+		}
+		if sibling.Kind() != reflect.String {
+			return nil, fmt.Errorf("%w: const_label_from field %s is %v, not a string", ErrAttributeMalformed, fieldName, sibling.Type())
+		}
+		labels[label] = sibling.String()
+	}
+
+	resolved := make([]stagparser.Definition, 0, len(defs))
+	for _, def := range defs {
+		if def.Name() != "const_label_from" {
+			resolved = append(resolved, def)
+		}
+	}
+
+	return append(resolved, newDefinition("const_label_from", labels)), nil
+}
+
+// constLabelsAttr returns the const labels of the constlabels={label:value}
+// and constlabels_env={label:VAR} attributes together with those
+// resolveConstLabelFrom left in defs, failing for any set twice or that
+// would also be a variable label.
+//
+// constlabels_env reads the variables at registration time. An unset or
+// empty variable is an error in strict mode and an empty label otherwise.
+func constLabelsAttr(defs []stagparser.Definition, labels []string, cfg *config) (prometheus.Labels, error) {
+	constLabels := prometheus.Labels{}
+	if expr, ok, err := StringAttr(defs, "constlabels"); err != nil {
+		return nil, err
+	} else if ok {
+		entries, err := parseMap(expr)
+		if err != nil {
+			return nil, fmt.Errorf("constlabels: %w", err)
+		}
+		for _, entry := range entries {
+			if _, ok := constLabels[entry.key]; ok {
+				return nil, fmt.Errorf("%w: constlabels sets %s twice", ErrAttributeMalformed, entry.key)
+			}
+			constLabels[entry.key] = entry.value
+		}
+	}
+
+	if expr, ok, err := StringAttr(defs, "constlabels_env"); err != nil {
+		return nil, err
+	} else if ok {
+		entries, err := parseMap(expr)
+		if err != nil {
+			return nil, fmt.Errorf("constlabels_env: %w", err)
+		}
+		for _, entry := range entries {
+			if _, ok := constLabels[entry.key]; ok {
+				return nil, fmt.Errorf("%w: const label %s is set twice", ErrAttributeMalformed, entry.key)
+			}
+			value := os.Getenv(entry.value)
+			if value == "" && cfg.strict {
+				return nil, fmt.Errorf("%w: environment variable %s is not set", ErrAttributeMalformed, entry.value)
+			}
+			constLabels[entry.key] = value
+		}
+	}
+
+	if value, ok := attrValue(defs, "const_label_from"); ok {
+		fromFields, ok := value.(prometheus.Labels)
+		if !ok {
+			return nil, fmt.Errorf("%w: const_label_from needs the struct of the field", ErrAttributeMalformed)
+		}
+		for label, v := range fromFields {
+			if _, ok := constLabels[label]; ok {
+				return nil, fmt.Errorf("%w: const label %s is set twice", ErrAttributeMalformed, label)
+			}
+			constLabels[label] = v
+		}
+	}
+	for _, label := range labels {
+		if _, ok := constLabels[label]; ok {
+			return nil, fmt.Errorf("%w: %s is both a const and a variable label", ErrAttributeMalformed, label)
+		}
+	}
+	if len(constLabels) == 0 {
+		return nil, nil
+	}
+
+	return constLabels, nil
+}
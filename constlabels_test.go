@@ -0,0 +1,224 @@
+package misery
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestConstLabelFrom(t *testing.T) {
+	type stat struct {
+		ServiceName string
+		Region      string
+		Requests    *prometheus.CounterVec `misery:"name=requests_total,help=Requests.,labels=[code],const_label_from=[service:ServiceName,region:Region]"`
+		Up          prometheus.Gauge       `misery:"name=up,help=Up.,const_label_from=[service:ServiceName]"`
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{ServiceName: "billing", Region: "eu"}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	s.ServiceName = "changed after registration"
+	s.Requests.WithLabelValues("200").Inc()
+	s.Up.Set(1)
+
+	want := `
+# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{code="200",region="eu",service="billing"} 1
+# HELP up Up.
+# TYPE up gauge
+up{service="billing"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConstLabelFromErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		mtrcs interface{}
+	}{
+		{
+			name: "missing field",
+			mtrcs: &struct {
+				Requests *prometheus.CounterVec `misery:"name=requests_total,const_label_from=[service:ServiceName]"`
+			}{},
+		},
+		{
+			name: "not a string",
+			mtrcs: &struct {
+				Shard    int
+				Requests *prometheus.CounterVec `misery:"name=requests_total,const_label_from=[shard:Shard]"`
+			}{},
+		},
+		{
+			name: "no field name",
+			mtrcs: &struct {
+				Service  string
+				Requests *prometheus.CounterVec `misery:"name=requests_total,const_label_from=[service]"`
+			}{},
+		},
+		{
+			name: "label set twice",
+			mtrcs: &struct {
+				Service  string
+				Requests *prometheus.CounterVec `misery:"name=requests_total,const_label_from=[service:Service,service:Service]"`
+			}{},
+		},
+		{
+			name: "also a variable label",
+			mtrcs: &struct {
+				Service  string
+				Requests *prometheus.CounterVec `misery:"name=requests_total,labels=[service],const_label_from=[service:Service]"`
+			}{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := RegisterMetrics(tt.mtrcs, prometheus.NewRegistry())
+			if !errors.Is(err, ErrAttributeMalformed) {
+				t.Fatalf("got error %v, want ErrAttributeMalformed", err)
+			}
+		})
+	}
+}
+
+func TestConstLabels(t *testing.T) {
+	type stat struct {
+		Service  string
+		Requests *prometheus.CounterVec `misery:"name=requests_total,help=Requests.,labels=[code],constlabels='{region:eu,service:billing}'"`
+		Up       prometheus.Gauge       `misery:"name=up,help=Up.,constlabels='{region:eu}',const_label_from=[service:Service]"`
+		Depth    func() float64         `misery:"name=queue_depth,help=Depth.,constlabels='{queue:mail}'"`
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{Service: "billing", Depth: func() float64 { return 2 }}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	s.Requests.WithLabelValues("200").Inc()
+	s.Up.Set(1)
+
+	want := `
+# HELP queue_depth Depth.
+# TYPE queue_depth gauge
+queue_depth{queue="mail"} 2
+# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{code="200",region="eu",service="billing"} 1
+# HELP up Up.
+# TYPE up gauge
+up{region="eu",service="billing"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConstLabelsErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		mtrcs interface{}
+	}{
+		{
+			name: "not a map",
+			mtrcs: &struct {
+				Requests *prometheus.CounterVec `misery:"name=requests_total,constlabels=eu"`
+			}{},
+		},
+		{
+			name: "label set twice",
+			mtrcs: &struct {
+				Requests *prometheus.CounterVec `misery:"name=requests_total,constlabels='{region:eu,region:us}'"`
+			}{},
+		},
+		{
+			name: "also a variable label",
+			mtrcs: &struct {
+				Requests *prometheus.CounterVec `misery:"name=requests_total,labels=[region],constlabels='{region:eu}'"`
+			}{},
+		},
+		{
+			name: "also a const_label_from label",
+			mtrcs: &struct {
+				Service  string
+				Requests *prometheus.CounterVec `misery:"name=requests_total,constlabels='{service:x}',const_label_from=[service:Service]"`
+			}{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := RegisterMetrics(tt.mtrcs, prometheus.NewRegistry())
+			if !errors.Is(err, ErrAttributeMalformed) {
+				t.Fatalf("got error %v, want ErrAttributeMalformed", err)
+			}
+		})
+	}
+}
+
+func TestConstLabelsEnv(t *testing.T) {
+	t.Setenv("MISERY_TEST_POD", "api-0")
+	t.Setenv("MISERY_TEST_NODE", "node-1")
+	t.Setenv("MISERY_TEST_EMPTY", "")
+
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,help=Requests.,labels=[code],constlabels_env='{pod:MISERY_TEST_POD,node:MISERY_TEST_NODE}'"`
+		Up       prometheus.Gauge       `misery:"name=up,help=Up.,constlabels='{region:eu}',constlabels_env='{pod:MISERY_TEST_POD}'"`
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	// read once, at registration
+	t.Setenv("MISERY_TEST_POD", "api-1")
+	s.Requests.WithLabelValues("200").Inc()
+	s.Up.Set(1)
+
+	want := `
+# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{code="200",node="node-1",pod="api-0"} 1
+# HELP up Up.
+# TYPE up gauge
+up{pod="api-0",region="eu"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+
+	type unset struct {
+		Up prometheus.Gauge `misery:"name=up,help=Up.,constlabels_env='{pod:MISERY_TEST_EMPTY}'"`
+	}
+	if err := RegisterMetricsWithOptions(&unset{}, prometheus.NewRegistry(), WithStrict(true)); !errors.Is(err, ErrAttributeMalformed) {
+		t.Errorf("empty variable in strict mode: got error %v, want ErrAttributeMalformed", err)
+	}
+	lenient := &unset{}
+	registry = prometheus.NewRegistry()
+	if err := RegisterMetrics(lenient, registry); err != nil {
+		t.Fatalf("empty variable: %v", err)
+	}
+	lenient.Up.Set(1)
+	want = `
+# HELP up Up.
+# TYPE up gauge
+up{pod=""} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want)); err != nil {
+		t.Errorf("empty variable: %v", err)
+	}
+
+	twice := &struct {
+		Up prometheus.Gauge `misery:"name=up,constlabels='{pod:x}',constlabels_env='{pod:MISERY_TEST_POD}'"`
+	}{}
+	if err := RegisterMetrics(twice, prometheus.NewRegistry()); !errors.Is(err, ErrAttributeMalformed) {
+		t.Errorf("label in constlabels and constlabels_env: got error %v, want ErrAttributeMalformed", err)
+	}
+}
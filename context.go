@@ -0,0 +1,45 @@
+package misery
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type optionsCtxKey struct{}
+
+// ContextWithOptions returns a copy of ctx carrying opts in addition to any
+// options already stored in ctx. RegisterMetricsCtx applies them in order.
+func ContextWithOptions(ctx context.Context, opts ...Option) context.Context {
+	stored := optionsFromContext(ctx)
+	merged := make([]Option, 0, len(stored)+len(opts))
+	merged = append(merged, stored...)
+	merged = append(merged, opts...)
+
+	return context.WithValue(ctx, optionsCtxKey{}, merged)
+}
+
+// ContextWithLogger is a shorthand for ContextWithOptions(ctx, WithLogger(logger)).
+func ContextWithLogger(ctx context.Context, logger Logger) context.Context {
+	return ContextWithOptions(ctx, WithLogger(logger))
+}
+
+func optionsFromContext(ctx context.Context) []Option {
+	opts, _ := ctx.Value(optionsCtxKey{}).([]Option)
+	return opts
+}
+
+// RegisterMetricsCtx behaves like RegisterMetrics, using the options stored
+// in ctx by ContextWithOptions, and stops early once ctx is done.
+//
+// ctx is checked before each field. When it is canceled mid-way, the
+// collectors this call already registered are unregistered again and their
+// fields get back the values they held before the call, exactly as if
+// registering the next field had failed, so the registry and the struct are
+// left as they were before the call. That includes collectors replaced
+// under WithReplaceExisting, which are put back. The returned error wraps
+// ctx.Err().
+func RegisterMetricsCtx(ctx context.Context, mtrcs interface{}, registry prometheus.Registerer) error {
+	_, err := registerMetrics(ctx, mtrcs, registry, newConfig(optionsFromContext(ctx)...))
+	return err
+}
@@ -0,0 +1,86 @@
+package misery
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// contextLabeledVec is the report entry of an observer vec registered with
+// WithLabelFromContext. It carries the contextLabeler ObserveCtx uses, so
+// the extractors live as long as the report.
+type contextLabeledVec struct {
+	prometheus.ObserverVec
+	labeler contextLabeler
+}
+
+func (v contextLabeledVec) unwrap() prometheus.Collector {
+	return v.ObserverVec
+}
+
+// contextLabeler builds the label set of one observer vec from a context.
+type contextLabeler struct {
+	labels     []string
+	extractors map[string]func(context.Context) string
+}
+
+func (l contextLabeler) labelsFrom(ctx context.Context) (prometheus.Labels, error) {
+	labels := make(prometheus.Labels, len(l.labels))
+	for _, name := range l.labels {
+		extract, ok := l.extractors[name]
+		if !ok {
+			return nil, fmt.Errorf("no context extractor for label %s", name)
+		}
+		labels[name] = extract(ctx)
+	}
+
+	return labels, nil
+}
+
+// bindContextLabels makes the observer vecs among infos available to
+// ObserveCtx by wrapping their report entries with the extractors of
+// WithLabelFromContext.
+func (reg *registration) bindContextLabels() {
+	if reg.cfg.labelFromContext == nil {
+		return
+	}
+	for _, info := range reg.infos {
+		vec, ok := reg.report[info.name].(prometheus.ObserverVec)
+		if !ok {
+			continue
+		}
+		reg.report[info.name] = contextLabeledVec{
+			ObserverVec: vec,
+			labeler:     contextLabeler{labels: info.labels, extractors: reg.cfg.labelFromContext},
+		}
+	}
+}
+
+// ObserveCtx observes value on the named histogram or summary vec, taking
+// every label value from ctx through the extractors given to
+// WithLabelFromContext at registration. A label without an extractor is an
+// error.
+func (r Report) ObserveCtx(ctx context.Context, field string, value float64) error {
+	collector, err := r.lookup(field)
+	if err != nil {
+		return err
+	}
+
+	labeled, ok := collector.(contextLabeledVec)
+	if !ok {
+		return fmt.Errorf("%w: %s has no context labels, see WithLabelFromContext", ErrTypeNotSupported, field)
+	}
+	labels, err := labeled.labeler.labelsFrom(ctx)
+	if err != nil {
+		return fmt.Errorf("%s: %w", field, err)
+	}
+
+	observer, err := r.Observer(field, labels)
+	if err != nil {
+		return err
+	}
+	observer.Observe(value)
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package misery
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type tenantCtxKey struct{}
+
+func TestObserveCtx(t *testing.T) {
+	type stat struct {
+		Latency *prometheus.HistogramVec `misery:"name=latency_seconds,labels=[tenant]"`
+		Sizes   *prometheus.SummaryVec   `misery:"name=sizes_bytes,labels=[tenant,region]"`
+		Hits    *prometheus.CounterVec   `misery:"name=hits_total,labels=[tenant]"`
+	}
+
+	extractors := map[string]func(context.Context) string{
+		"tenant": func(ctx context.Context) string {
+			tenant, _ := ctx.Value(tenantCtxKey{}).(string)
+			return tenant
+		},
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	report, err := RegisterMetricsReport(s, registry, WithLabelFromContext(extractors))
+	if err != nil {
+		t.Fatalf("RegisterMetricsReport: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		field   string
+		tenant  string
+		wantErr error
+	}{
+		{name: "populated context", ctx: context.WithValue(context.Background(), tenantCtxKey{}, "acme"), field: "latency_seconds", tenant: "acme"},
+		{name: "empty context", ctx: context.Background(), field: "latency_seconds", tenant: ""},
+		{name: "label without extractor", ctx: context.Background(), field: "sizes_bytes", wantErr: errAny},
+		{name: "not an observer", ctx: context.Background(), field: "hits_total", wantErr: ErrTypeNotSupported},
+		{name: "unknown metric", ctx: context.Background(), field: "missing_seconds", wantErr: ErrMetricNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := report.ObserveCtx(tt.ctx, tt.field, 0.5)
+			switch {
+			case tt.wantErr == errAny:
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			case err != nil:
+				t.Fatalf("ObserveCtx: %v", err)
+			}
+
+			if count := gatherSampleCount(t, registry, "latency_seconds", tt.tenant); count != 1 {
+				t.Errorf("%d observations for tenant %q, want 1", count, tt.tenant)
+			}
+		})
+	}
+}
+
+func TestObserveCtxWithoutOption(t *testing.T) {
+	type stat struct {
+		Latency *prometheus.HistogramVec `misery:"name=latency_seconds,labels=[tenant]"`
+	}
+
+	report, err := RegisterMetricsReport(&stat{}, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("RegisterMetricsReport: %v", err)
+	}
+	if err := report.ObserveCtx(context.Background(), "latency_seconds", 1); !errors.Is(err, ErrTypeNotSupported) {
+		t.Fatalf("got error %v, want ErrTypeNotSupported", err)
+	}
+}
+
+// gatherSampleCount returns the sample count of the histogram series of the
+// metric name whose only label has value.
+func gatherSampleCount(t *testing.T, g prometheus.Gatherer, name, value string) uint64 {
+	t.Helper()
+
+	family := gatherFamily(t, g, name)
+	for _, m := range family.GetMetric() {
+		if m.GetLabel()[0].GetValue() == value {
+			return m.GetHistogram().GetSampleCount()
+		}
+	}
+
+	return 0
+}
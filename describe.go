@@ -0,0 +1,146 @@
+package misery
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/yuin/stagparser"
+)
+
+// MetricDoc documents one metric declared by a struct.
+type MetricDoc struct {
+	// Field is the name of the struct field holding the metric.
+	Field string
+	Name  string
+	// Type is one of counter, gauge, histogram and summary.
+	Type   string
+	Help   string
+	Labels []string
+	// Buckets is set for histograms only.
+	Buckets []float64
+	// NativeFactor is set for histograms with native buckets, which are
+	// exposed with both Buckets and native buckets.
+	NativeFactor float64
+	// Objectives is set for summaries only.
+	Objectives map[float64]float64
+	// Unit is the unit attribute, which Name already ends with, for
+	// OpenMetrics UNIT metadata.
+	Unit string
+}
+
+// DescribeMetrics returns documentation of the metrics mtrcs declares, as
+// RegisterMetricsWithOptions with the same opts would build them. Metrics
+// come in registration order: depth-first through nested structs, in field
+// declaration order. Nothing is registered and mtrcs is left untouched.
+func DescribeMetrics(mtrcs interface{}, opts ...Option) ([]MetricDoc, error) {
+	reg, err := dryRun(mtrcs, newConfig(opts...))
+	if err != nil {
+		return nil, err
+	}
+
+	docs := make([]MetricDoc, 0, len(reg.infos))
+	for _, info := range reg.infos {
+		docs = append(docs, MetricDoc{
+			Field:        info.field,
+			Name:         info.name,
+			Type:         info.kind,
+			Help:         info.help,
+			Labels:       info.labels,
+			Buckets:      info.buckets,
+			NativeFactor: info.nativeFactor,
+			Objectives:   info.objectives,
+			Unit:         info.unit,
+		})
+	}
+
+	return docs, nil
+}
+
+// RegisteredNames returns, in registration order, the metric names
+// registering mtrcs with opts would produce, without registering anything.
+func RegisteredNames(mtrcs interface{}, opts ...Option) ([]string, error) {
+	reg, err := dryRun(mtrcs, newConfig(opts...))
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(reg.infos))
+	for _, info := range reg.infos {
+		names = append(names, info.name)
+	}
+
+	return names, nil
+}
+
+// DumpTags returns the definitions stagparser produced for the tags of each
+// field of mtrcs, keyed by field name, before misery interprets any of them.
+// It is meant for debugging tags; DescribeMetrics shows what is built from
+// them. Among opts only WithTagKeys has an effect.
+func DumpTags(mtrcs interface{}, opts ...Option) (map[string][]stagparser.Definition, error) {
+	val, err := unpackStruct(mtrcs)
+	if err != nil {
+		return nil, fmt.Errorf("struct unpack error: %w", err)
+	}
+
+	tags, err := parseStructTags(val, newConfig(opts...).tagKeys...)
+	if err != nil {
+		return nil, fmt.Errorf("struct tag parse error: %w", err)
+	}
+
+	return tags, nil
+}
+
+// metricJSON is the JSON form of a MetricDoc. Field order fixes the key
+// order of the output.
+type metricJSON struct {
+	Name       string          `json:"name"`
+	Type       string          `json:"type"`
+	Help       string          `json:"help"`
+	Labels     []string        `json:"labels"`
+	Buckets    []float64       `json:"buckets,omitempty"`
+	Objectives []objectiveJSON `json:"objectives,omitempty"`
+	Unit       string          `json:"unit,omitempty"`
+}
+
+type objectiveJSON struct {
+	Quantile float64 `json:"quantile"`
+	Error    float64 `json:"error"`
+}
+
+// MarshalMetricsJSON returns the metrics DescribeMetrics finds in mtrcs as a
+// JSON array of descriptors with name, type, help and labels, plus buckets
+// for histograms, objectives, sorted by quantile, for summaries and the unit
+// of metrics declaring one. Metrics come in registration order and keys in a
+// fixed order, so the output is the same on every run. opts are those of
+// DescribeMetrics.
+func MarshalMetricsJSON(mtrcs interface{}, opts ...Option) ([]byte, error) {
+	docs, err := DescribeMetrics(mtrcs, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]metricJSON, 0, len(docs))
+	for _, doc := range docs {
+		m := metricJSON{
+			Name:    doc.Name,
+			Type:    doc.Type,
+			Help:    doc.Help,
+			Labels:  doc.Labels,
+			Buckets: doc.Buckets,
+			Unit:    doc.Unit,
+		}
+		if m.Labels == nil {
+			m.Labels = []string{}
+		}
+		for quantile, epsilon := range doc.Objectives {
+			m.Objectives = append(m.Objectives, objectiveJSON{Quantile: quantile, Error: epsilon})
+		}
+		sort.Slice(m.Objectives, func(i, j int) bool {
+			return m.Objectives[i].Quantile < m.Objectives[j].Quantile
+		})
+		out = append(out, m)
+	}
+
+	return json.Marshal(out)
+}
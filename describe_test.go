@@ -0,0 +1,242 @@
+package misery
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestDescribeMetrics(t *testing.T) {
+	type queue struct {
+		Depth prometheus.Gauge `misery:"name=queue_depth,help='Queue depth.'"`
+	}
+	type stat struct {
+		Requests *prometheus.CounterVec   `misery:"name=requests_total,help=Requests.,labels=[code,method]"`
+		Latency  *prometheus.HistogramVec `misery:"name=latency,unit=seconds,labels=[code],buckets=[0.1,1]"`
+		Sizes    *prometheus.SummaryVec   `misery:"name=sizes_bytes,objectives={0.5:0.05,0.9:0.01}"`
+		Queue    queue
+		Skipped  *prometheus.CounterVec `misery:"skip"`
+	}
+
+	s := &stat{}
+	docs, err := DescribeMetrics(s)
+	if err != nil {
+		t.Fatalf("DescribeMetrics: %v", err)
+	}
+	want := []MetricDoc{
+		{Field: "Requests", Name: "requests_total", Type: "counter", Help: "Requests.", Labels: []string{"code", "method"}},
+		{Field: "Latency", Name: "latency_seconds", Type: "histogram", Labels: []string{"code"}, Buckets: []float64{0.1, 1}, Unit: "seconds"},
+		{Field: "Sizes", Name: "sizes_bytes", Type: "summary", Labels: []string{}, Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01}},
+		{Field: "Queue.Depth", Name: "queue_depth", Type: "gauge", Help: "Queue depth.", Labels: []string{}},
+	}
+	if !reflect.DeepEqual(docs, want) {
+		t.Errorf("docs\n%+v\nwant\n%+v", docs, want)
+	}
+	if s.Requests != nil || s.Queue.Depth != nil {
+		t.Error("DescribeMetrics set fields of the struct")
+	}
+}
+
+func TestDescribeMetricsInvalid(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,buckets=[1]"`
+	}
+
+	if _, err := DescribeMetrics(&stat{}); err == nil {
+		t.Fatal("expected an error for buckets on a counter")
+	}
+}
+
+func TestRegisteredNames(t *testing.T) {
+	type inner struct {
+		Depth prometheus.Gauge `misery:"name=queue_depth"`
+	}
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total"`
+		Inner    *inner
+		Uptime   prometheus.Gauge         `misery:"namespace=app"`
+		Sizes    []*prometheus.CounterVec `misery:"names=[small_total,large_total]"`
+		Skipped  *prometheus.CounterVec   `misery:"skip"`
+	}
+
+	tests := []struct {
+		name string
+		opts []Option
+		want []string
+	}{
+		{
+			name: "every metric",
+			want: []string{"requests_total", "queue_depth", "app_uptime", "small_total", "large_total"},
+		},
+		{
+			name: "filtered",
+			opts: []Option{WithEnabled(func(field string) bool { return field != "Requests" })},
+			want: []string{"queue_depth", "app_uptime", "small_total", "large_total"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &stat{}
+			names, err := RegisteredNames(s, tt.opts...)
+			if err != nil {
+				t.Fatalf("RegisteredNames: %v", err)
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("names %v, want %v", names, tt.want)
+			}
+			if s.Inner != nil || s.Sizes != nil {
+				t.Error("RegisteredNames set fields of the struct")
+			}
+		})
+	}
+}
+
+func TestRegistrationOrder(t *testing.T) {
+	type leaf struct {
+		C *prometheus.CounterVec `misery:"name=c_total"`
+		D *prometheus.CounterVec `misery:"name=d_total"`
+	}
+	type ptrLeaf struct {
+		E *prometheus.CounterVec `misery:"name=e_total"`
+		F *prometheus.CounterVec `misery:"name=f_total"`
+	}
+	type stat struct {
+		Z     *prometheus.CounterVec `misery:"name=z_total"`
+		A     *prometheus.CounterVec `misery:"name=a_total"`
+		Leaf  leaf
+		B     *prometheus.CounterVec `misery:"name=b_total"`
+		Ptr   *ptrLeaf
+		Slice []*prometheus.CounterVec `misery:"names=[y_total,x_total]"`
+	}
+	type duplicate struct {
+		First  *prometheus.CounterVec `misery:"name=same_total"`
+		Second *prometheus.CounterVec `misery:"name=same_total"`
+		Third  *prometheus.CounterVec `misery:"name=same_total"`
+	}
+
+	want := []string{"Z", "A", "Leaf.C", "Leaf.D", "B", "Ptr.E", "Ptr.F", "Slice[0]", "Slice[1]"}
+	for i := 0; i < 20; i++ {
+		docs, err := DescribeMetrics(&stat{})
+		if err != nil {
+			t.Fatalf("DescribeMetrics: %v", err)
+		}
+		var fields []string
+		for _, doc := range docs {
+			fields = append(fields, doc.Field)
+		}
+		if !reflect.DeepEqual(fields, want) {
+			t.Fatalf("run %d: order %v, want %v", i, fields, want)
+		}
+
+		err = RegisterMetrics(&duplicate{}, prometheus.NewRegistry())
+		if err == nil || !strings.Contains(err.Error(), "duplicate.First and duplicate.Second") {
+			t.Fatalf("run %d: duplicate attributed as %v", i, err)
+		}
+	}
+}
+
+func TestDumpTags(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,help='Requests served.',labels=[code,method],init_value=1.5"`
+		Latency  prometheus.Histogram   `misery:"buckets=[0.1,1],native_factor=1.1" metrics:"help=Latency."`
+		Plain    int
+	}
+
+	tests := []struct {
+		name string
+		opts []Option
+		want map[string][]string
+	}{
+		{
+			name: "default tag key",
+			want: map[string][]string{
+				"Requests": {"name=requests_total", "help=Requests served.", "labels=[code method]", "init_value=1.5"},
+				"Latency":  {"buckets=[0.1 1]", "native_factor=1.1"},
+			},
+		},
+		{
+			name: "continuation tag key",
+			opts: []Option{WithTagKeys("misery", "metrics")},
+			want: map[string][]string{
+				"Requests": {"name=requests_total", "help=Requests served.", "labels=[code method]", "init_value=1.5"},
+				"Latency":  {"buckets=[0.1 1]", "native_factor=1.1", "help=Latency."},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tags, err := DumpTags(&stat{}, tt.opts...)
+			if err != nil {
+				t.Fatalf("DumpTags: %v", err)
+			}
+			got := make(map[string][]string, len(tags))
+			for field, defs := range tags {
+				for _, def := range defs {
+					value, _ := def.Attribute(def.Name())
+					got[field] = append(got[field], fmt.Sprintf("%s=%v", def.Name(), value))
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDumpTagsInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		mtrcs interface{}
+	}{
+		{name: "not a pointer", mtrcs: struct{}{}},
+		{name: "unparseable tag", mtrcs: &struct {
+			Requests prometheus.Counter `misery:"name=="`
+		}{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DumpTags(tt.mtrcs); err == nil {
+				t.Fatal("got no error")
+			}
+		})
+	}
+}
+
+func TestMarshalMetricsJSON(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec   `misery:"name=requests_total,help='Requests served.',labels=[method,code]"`
+		Latency  *prometheus.HistogramVec `misery:"name=latency,unit=seconds,help=Latency.,labels=[code],buckets=[0.1,1]"`
+		Sizes    *prometheus.SummaryVec   `misery:"name=sizes_bytes,objectives={0.9:0.01,0.5:0.05}"`
+		Queue    prometheus.Gauge         `misery:"name=queue_depth,help='Queue depth.'"`
+	}
+
+	fixture, err := os.ReadFile(filepath.Join("testdata", "metrics.json"))
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+	var want bytes.Buffer
+	if err := json.Compact(&want, fixture); err != nil {
+		t.Fatalf("compact fixture: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		got, err := MarshalMetricsJSON(&stat{})
+		if err != nil {
+			t.Fatalf("MarshalMetricsJSON: %v", err)
+		}
+		if !bytes.Equal(got, want.Bytes()) {
+			t.Fatalf("run %d: got\n%s\nwant\n%s", i, got, want.Bytes())
+		}
+	}
+
+	if _, err := MarshalMetricsJSON(struct{}{}); err == nil {
+		t.Error("MarshalMetricsJSON of a struct value: got no error")
+	}
+}
@@ -12,9 +12,10 @@ import (
 )
 
 type Stat struct {
-	SecondsFromStart     *prometheus.CounterVec   `misery:"name=seconds_from_start,labels=[thread],help='seconds since application start'" json:"seconds_from_start"`
-	UnusedDefaultCounter *prometheus.CounterVec   `json:"unused_default_counter"`
-	RandomDuration       *prometheus.HistogramVec `misery:"labels=[thread],buckets=[0.0001, 0.001, 0.01, 0.1, 0.2, 0.3, 0.5, 1.0, 2.0, 10, 20, 50, 100]" json:"random_duration"`
+	SecondsFromStart     *prometheus.CounterVec `misery:"name=seconds_from_start,labels=[thread],help='seconds since application start'" json:"seconds_from_start"`
+	UnusedDefaultCounter *prometheus.CounterVec `json:"unused_default_counter"`
+	RandomDuration       *misery.Timer          `misery:"labels=[thread],buckets=[0.0001, 0.001, 0.01, 0.1, 0.2, 0.3, 0.5, 1.0, 2.0, 10, 20, 50, 100]" json:"random_duration"`
+	InFlight             *prometheus.GaugeVec   `misery:"name=in_flight,labels=[thread],help='random sleeps in progress'" json:"in_flight"`
 }
 
 type Application struct {
@@ -41,7 +42,10 @@ func (a *Application) Run() {
 			case <-time.After(1 * time.Second):
 				a.Stat.SecondsFromStart.With(prometheus.Labels{"thread": "main"}).Inc()
 				go func() {
-					defer prometheus.NewTimer(a.Stat.RandomDuration.With(prometheus.Labels{"thread": "main"})).ObserveDuration()
+					inFlight := a.Stat.InFlight.With(prometheus.Labels{"thread": "main"})
+					inFlight.Inc()
+					defer inFlight.Dec()
+					defer a.Stat.RandomDuration.Start("main").ObserveDuration()
 					time.Sleep(time.Duration(rand.Intn(1000)) * time.Millisecond)
 				}()
 			}
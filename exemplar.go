@@ -0,0 +1,72 @@
+package misery
+
+import (
+	"context"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ExemplarTraceLabel is the exemplar label carrying the trace ID.
+const ExemplarTraceLabel = "trace_id"
+
+type traceIDCtxKey struct{}
+
+// ContextWithTraceID returns a copy of ctx carrying traceID, the trace ID
+// ObserveWithExemplar and AddWithExemplar attach to the values they record.
+func ContextWithTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, traceIDCtxKey{}, traceID)
+}
+
+// TraceIDFromContext returns the trace ID stored in ctx by
+// ContextWithTraceID, if any.
+func TraceIDFromContext(ctx context.Context) (string, bool) {
+	traceID, ok := ctx.Value(traceIDCtxKey{}).(string)
+	return traceID, ok && traceID != ""
+}
+
+// ObserveWithExemplar observes v on o with the trace ID of ctx as the
+// exemplar, so a latency spike leads to the trace that caused it:
+//
+//	misery.ObserveWithExemplar(ctx, m.RequestDuration.WithLabelValues("GET"), d.Seconds())
+//
+// Without a valid trace ID in ctx, or when o does not support exemplars, it
+// is a plain Observe.
+func ObserveWithExemplar(ctx context.Context, o prometheus.Observer, v float64) {
+	eo, ok := o.(prometheus.ExemplarObserver)
+	traceID, found := exemplarTraceID(ctx)
+	if !ok || !found {
+		o.Observe(v)
+		return
+	}
+
+	eo.ObserveWithExemplar(v, prometheus.Labels{ExemplarTraceLabel: traceID})
+}
+
+// AddWithExemplar adds v to c with the trace ID of ctx as the exemplar.
+// Without a valid trace ID in ctx, or when c does not support exemplars, it
+// is a plain Add.
+func AddWithExemplar(ctx context.Context, c prometheus.Counter, v float64) {
+	ea, ok := c.(prometheus.ExemplarAdder)
+	traceID, found := exemplarTraceID(ctx)
+	if !ok || !found {
+		c.Add(v)
+		return
+	}
+
+	ea.AddWithExemplar(v, prometheus.Labels{ExemplarTraceLabel: traceID})
+}
+
+// exemplarTraceID returns the trace ID of ctx if client_golang accepts it
+// as an exemplar label value. It panics on an invalid exemplar only after
+// recording the value, so invalid ones are caught up front: the value must
+// be valid UTF-8 and, together with the label name, at most
+// prometheus.ExemplarMaxRunes long.
+func exemplarTraceID(ctx context.Context) (string, bool) {
+	traceID, ok := TraceIDFromContext(ctx)
+	if !ok || !utf8.ValidString(traceID) {
+		return "", false
+	}
+
+	return traceID, utf8.RuneCountInString(ExemplarTraceLabel)+utf8.RuneCountInString(traceID) <= prometheus.ExemplarMaxRunes
+}
@@ -0,0 +1,155 @@
+package misery
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// exemplarLabel returns the trace ID of exemplar, or "" without one.
+func exemplarLabel(exemplar *dto.Exemplar) string {
+	for _, pair := range exemplar.GetLabel() {
+		if pair.GetName() == ExemplarTraceLabel {
+			return pair.GetValue()
+		}
+	}
+
+	return ""
+}
+
+func TestTraceIDFromContext(t *testing.T) {
+	if _, ok := TraceIDFromContext(context.Background()); ok {
+		t.Error("trace ID found in an empty context")
+	}
+	if _, ok := TraceIDFromContext(ContextWithTraceID(context.Background(), "")); ok {
+		t.Error("empty trace ID found")
+	}
+	if got, ok := TraceIDFromContext(ContextWithTraceID(context.Background(), "abc")); !ok || got != "abc" {
+		t.Errorf("trace ID %q, %v, want abc", got, ok)
+	}
+}
+
+func TestObserveWithExemplar(t *testing.T) {
+	type stat struct {
+		Latency *prometheus.HistogramVec `misery:"name=latency_seconds,labels=[code],buckets=[1]"`
+		Sizes   *prometheus.SummaryVec   `misery:"name=sizes_bytes,labels=[code]"`
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	ctx := ContextWithTraceID(context.Background(), "abc")
+	ObserveWithExemplar(ctx, s.Latency.WithLabelValues("200"), 0.5)
+	ObserveWithExemplar(context.Background(), s.Latency.WithLabelValues("500"), 0.5)
+	// summaries keep no exemplars, the value is observed all the same
+	ObserveWithExemplar(ctx, s.Sizes.WithLabelValues("200"), 10)
+	// sampled series pass the exemplar on
+	ObserveWithExemplar(ctx, sampledObserver{Observer: s.Latency.WithLabelValues("503"), rate: 1}, 0.5)
+
+	want := map[string]string{"200": "abc", "500": "", "503": "abc"}
+	for _, metric := range gatherFamily(t, registry, "latency_seconds").GetMetric() {
+		code := metric.GetLabel()[0].GetValue()
+		histogram := metric.GetHistogram()
+		if histogram.GetSampleCount() != 1 {
+			t.Errorf("code %s: %d observations, want 1", code, histogram.GetSampleCount())
+		}
+		if got := exemplarLabel(histogram.GetBucket()[0].GetExemplar()); got != want[code] {
+			t.Errorf("code %s: exemplar trace ID %q, want %q", code, got, want[code])
+		}
+	}
+	if got := gatherFamily(t, registry, "sizes_bytes").GetMetric()[0].GetSummary().GetSampleCount(); got != 1 {
+		t.Errorf("summary: %d observations, want 1", got)
+	}
+}
+
+func TestAddWithExemplar(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,labels=[code]"`
+	}
+
+	registry := prometheus.NewRegistry()
+	logger := &recordLogger{}
+	s := &stat{}
+	report, err := RegisterMetricsReport(s, registry, WithCounterGuard(true), WithLogger(logger))
+	if err != nil {
+		t.Fatalf("RegisterMetricsReport: %v", err)
+	}
+	ctx := ContextWithTraceID(context.Background(), "abc")
+	AddWithExemplar(ctx, s.Requests.WithLabelValues("200"), 2)
+	AddWithExemplar(context.Background(), s.Requests.WithLabelValues("500"), 3)
+
+	// guarded counters drop negative increments, exemplar or not
+	guarded, err := report.Counter("requests_total", prometheus.Labels{"code": "503"})
+	if err != nil {
+		t.Fatalf("Counter: %v", err)
+	}
+	AddWithExemplar(ctx, guarded, -1)
+	AddWithExemplar(ctx, guarded, 1)
+	if !strings.Contains(logger.String(), "ignored negative counter increment") {
+		t.Errorf("no warning logged: %q", logger.String())
+	}
+
+	want := map[string]struct {
+		value   float64
+		traceID string
+	}{
+		"200": {2, "abc"},
+		"500": {3, ""},
+		"503": {1, "abc"},
+	}
+	for _, metric := range gatherFamily(t, registry, "requests_total").GetMetric() {
+		code := metric.GetLabel()[0].GetValue()
+		counter := metric.GetCounter()
+		if counter.GetValue() != want[code].value {
+			t.Errorf("code %s: value %v, want %v", code, counter.GetValue(), want[code].value)
+		}
+		if got := exemplarLabel(counter.GetExemplar()); got != want[code].traceID {
+			t.Errorf("code %s: exemplar trace ID %q, want %q", code, got, want[code].traceID)
+		}
+	}
+}
+
+func TestExemplarInvalidTraceID(t *testing.T) {
+	type stat struct {
+		Latency  *prometheus.HistogramVec `misery:"name=latency_seconds,labels=[trace],buckets=[1]"`
+		Requests *prometheus.CounterVec   `misery:"name=requests_total,labels=[trace]"`
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	for name, traceID := range map[string]string{
+		"too long":     strings.Repeat("a", 200),
+		"invalid utf8": "\xff",
+	} {
+		ctx := ContextWithTraceID(context.Background(), traceID)
+		ObserveWithExemplar(ctx, s.Latency.WithLabelValues(name), 0.5)
+		AddWithExemplar(ctx, s.Requests.WithLabelValues(name), 1)
+	}
+
+	for _, metric := range gatherFamily(t, registry, "latency_seconds").GetMetric() {
+		histogram := metric.GetHistogram()
+		if histogram.GetSampleCount() != 1 {
+			t.Errorf("%s: %d observations, want 1", metric.GetLabel()[0].GetValue(), histogram.GetSampleCount())
+		}
+		if histogram.GetBucket()[0].GetExemplar() != nil {
+			t.Errorf("%s: exemplar attached", metric.GetLabel()[0].GetValue())
+		}
+	}
+	for _, metric := range gatherFamily(t, registry, "requests_total").GetMetric() {
+		counter := metric.GetCounter()
+		if counter.GetValue() != 1 {
+			t.Errorf("%s: value %v, want 1", metric.GetLabel()[0].GetValue(), counter.GetValue())
+		}
+		if counter.GetExemplar() != nil {
+			t.Errorf("%s: exemplar attached", metric.GetLabel()[0].GetValue())
+		}
+	}
+}
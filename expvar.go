@@ -0,0 +1,104 @@
+package misery
+
+import (
+	"expvar"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// ExportExpvar publishes the counters and gauges held by the fields of mtrcs
+// as expvar variables named after the metrics, so they show up at
+// /debug/vars. Values are collected anew on every read. A metric without
+// labels is published as a number, a vec with labels as an object keyed by
+// label sets like method="get",code="200".
+//
+// Only fields that are already built are published, and expvar names are
+// global: publishing a metric name twice fails, and then nothing of mtrcs
+// is published.
+func ExportExpvar(mtrcs interface{}) error {
+	val, err := unpackStruct(mtrcs)
+	if err != nil {
+		return fmt.Errorf("struct unpack error: %w", err)
+	}
+
+	published := map[string]prometheus.Collector{}
+	var names []string
+	for _, collector := range builtCollectors(val, newConfig()) {
+		switch collector.(type) {
+		case *prometheus.CounterVec, *prometheus.GaugeVec, prometheus.Counter, prometheus.Gauge:
+		default:
+			continue
+		}
+		for _, name := range describeNames(collector) {
+			if _, ok := published[name]; ok {
+				return fmt.Errorf("%w: expvar %s is declared twice", ErrDuplicateMetricName, name)
+			}
+			published[name] = collector
+			names = append(names, name)
+		}
+	}
+
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+	for _, name := range names {
+		if expvar.Get(name) != nil {
+			return fmt.Errorf("%w: expvar %s is already published", ErrDuplicateMetricName, name)
+		}
+	}
+	for _, name := range names {
+		collector := published[name]
+		expvar.Publish(name, expvar.Func(func() interface{} {
+			return expvarValue(collector)
+		}))
+	}
+
+	return nil
+}
+
+// expvarMu keeps concurrent ExportExpvar calls from publishing a name
+// between the check and the publication of another.
+var expvarMu sync.Mutex
+
+// expvarValue collects the current series of a counter or gauge vec.
+func expvarValue(collector prometheus.Collector) interface{} {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		collector.Collect(ch)
+		close(ch)
+	}()
+
+	values := map[string]float64{}
+	unlabelled := false
+	for metric := range ch {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			continue
+		}
+		value := m.GetCounter().GetValue() + m.GetGauge().GetValue()
+		if len(m.GetLabel()) == 0 {
+			unlabelled = true
+		}
+		values[labelSetKey(m.GetLabel())] = value
+	}
+
+	if unlabelled && len(values) == 1 {
+		return values[""]
+	}
+
+	return values
+}
+
+func labelSetKey(pairs []*dto.LabelPair) string {
+	parts := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		parts = append(parts, fmt.Sprintf("%s=%q", pair.GetName(), pair.GetValue()))
+	}
+	sort.Strings(parts)
+
+	return strings.Join(parts, ",")
+}
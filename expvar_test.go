@@ -0,0 +1,88 @@
+package misery
+
+import (
+	"errors"
+	"expvar"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestExportExpvar(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=expvar_requests_total,labels=[method,code]"`
+		Queue    prometheus.Gauge       `misery:"name=expvar_queue_depth"`
+		Latency  prometheus.Histogram   `misery:"name=expvar_latency_seconds"`
+	}
+
+	s := &stat{}
+	if err := RegisterMetrics(s, prometheus.NewRegistry()); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	if err := ExportExpvar(s); err != nil {
+		t.Fatalf("ExportExpvar: %v", err)
+	}
+
+	s.Requests.WithLabelValues("get", "200").Add(3)
+	s.Requests.WithLabelValues("post", "500").Inc()
+	s.Queue.Set(7)
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "expvar_requests_total", want: `{"code=\"200\",method=\"get\"":3,"code=\"500\",method=\"post\"":1}`},
+		{name: "expvar_queue_depth", want: "7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := expvar.Get(tt.name)
+			if v == nil {
+				t.Fatal("not published")
+			}
+			if got := v.String(); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if expvar.Get("expvar_latency_seconds") != nil {
+		t.Error("histogram published")
+	}
+
+	s.Queue.Set(9)
+	if got := expvar.Get("expvar_queue_depth").String(); got != "9" {
+		t.Errorf("got %s after the change, want 9", got)
+	}
+
+	if err := ExportExpvar(s); !errors.Is(err, ErrDuplicateMetricName) {
+		t.Errorf("second ExportExpvar: got error %v, want ErrDuplicateMetricName", err)
+	}
+}
+
+func TestExportExpvarConflict(t *testing.T) {
+	type first struct {
+		Taken prometheus.Gauge `misery:"name=expvar_conflict_taken"`
+	}
+	type second struct {
+		Fresh prometheus.Gauge `misery:"name=expvar_conflict_fresh"`
+		Taken prometheus.Gauge `misery:"name=expvar_conflict_taken"`
+	}
+
+	a, b := &first{}, &second{}
+	if err := BuildMetrics(a); err != nil {
+		t.Fatalf("BuildMetrics: %v", err)
+	}
+	if err := BuildMetrics(b); err != nil {
+		t.Fatalf("BuildMetrics: %v", err)
+	}
+	if err := ExportExpvar(a); err != nil {
+		t.Fatalf("ExportExpvar: %v", err)
+	}
+	if err := ExportExpvar(b); !errors.Is(err, ErrDuplicateMetricName) {
+		t.Fatalf("got error %v, want ErrDuplicateMetricName", err)
+	}
+	if expvar.Get("expvar_conflict_fresh") != nil {
+		t.Error("expvar_conflict_fresh published despite the conflict")
+	}
+}
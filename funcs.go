@@ -0,0 +1,95 @@
+package misery
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yuin/stagparser"
+)
+
+var (
+	// callbackType is the type of tagged fields exposed as a func metric
+	// calling the field on every scrape.
+	callbackType = reflect.TypeOf((func() float64)(nil))
+
+	prometheusGaugeFuncType   = reflect.TypeOf((*prometheus.GaugeFunc)(nil)).Elem()
+	prometheusCounterFuncType = reflect.TypeOf((*prometheus.CounterFunc)(nil)).Elem()
+	prometheusUntypedFuncType = reflect.TypeOf((*prometheus.UntypedFunc)(nil)).Elem()
+)
+
+// isFuncMetricType reports whether t is one of the func metric interfaces,
+// prometheus.GaugeFunc, prometheus.CounterFunc and prometheus.UntypedFunc,
+// whose fields are built by the user and registered as they are.
+func isFuncMetricType(t reflect.Type) bool {
+	switch t {
+	case prometheusGaugeFuncType, prometheusCounterFuncType, prometheusUntypedFuncType:
+		return true
+	}
+
+	return false
+}
+
+// addFunc registers a func() float64 field as a func metric calling it, or a
+// func metric field as it is. Both must be set before registration; the
+// field itself is never modified.
+func (reg *registration) addFunc(
+	structValue reflect.Value,
+	typeField reflect.StructField,
+	field reflect.Value,
+	defs []stagparser.Definition,
+	path string,
+) error {
+	if field.IsNil() {
+		return fmt.Errorf("%w: %v field is nil", ErrAttributeMalformed, field.Type())
+	}
+	if field.Type() != callbackType {
+		return reg.addPassthrough(structValue, typeField, field, path)
+	}
+
+	collector, info, err := createFuncMetric(typeField.Name, field.Interface().(func() float64), defs, reg.cfg)
+	if err != nil {
+		return err
+	}
+
+	return reg.addCallback(structValue, typeField, collector, info, path)
+}
+
+// createFuncMetric builds the func metric of a func() float64 field: a
+// gauge func, or the counter func or untyped func the type attribute names.
+// A counter callback must return a value that never decreases.
+func createFuncMetric(
+	structFieldName string,
+	callback func() float64,
+	defs []stagparser.Definition,
+	cfg *config,
+) (prometheus.Collector, metricInfo, error) {
+	kind, defs, err := takeType(defs, "gauge")
+	if err != nil {
+		return nil, metricInfo{}, err
+	}
+	switch kind {
+	case "gauge", "counter", "untyped":
+	default:
+		return nil, metricInfo{}, fmt.Errorf("%w: type of a func field must be gauge, counter or untyped, not %s",
+			ErrAttributeMalformed, kind)
+	}
+	if err := checkAttributes(kind+" func", defs); err != nil {
+		return nil, metricInfo{}, err
+	}
+	attrs, err := parseVecAttrs(structFieldName, defs, cfg)
+	if err != nil {
+		return nil, metricInfo{}, err
+	}
+
+	switch kind {
+	case "counter":
+		opt := prometheus.CounterOpts{Name: attrs.name, Help: attrs.help, ConstLabels: attrs.constLabels}
+		return prometheus.NewCounterFunc(opt, callback), attrs.info(kind), nil
+	case "untyped":
+		opt := prometheus.UntypedOpts{Name: attrs.name, Help: attrs.help, ConstLabels: attrs.constLabels}
+		return prometheus.NewUntypedFunc(opt, callback), attrs.info(kind), nil
+	}
+	opt := prometheus.GaugeOpts{Name: attrs.name, Help: attrs.help, ConstLabels: attrs.constLabels}
+	return prometheus.NewGaugeFunc(opt, callback), attrs.info(kind), nil
+}
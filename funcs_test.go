@@ -0,0 +1,168 @@
+package misery
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestGaugeFuncFields(t *testing.T) {
+	type stat struct {
+		Depth   func() float64       `misery:"name=queue_depth,help='Jobs waiting.'"`
+		Version prometheus.GaugeFunc `misery:"skip"`
+		Config  prometheus.GaugeFunc
+	}
+
+	depth := 3.0
+	s := &stat{
+		Depth: func() float64 { return depth },
+		Config: prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "config_version", Help: "Config version."},
+			func() float64 { return 7 }),
+	}
+	registry := prometheus.NewRegistry()
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+
+	want := `
+# HELP config_version Config version.
+# TYPE config_version gauge
+config_version 7
+# HELP queue_depth Jobs waiting.
+# TYPE queue_depth gauge
+queue_depth 3
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+	// the callback runs on every scrape
+	depth = 5
+	if got := gatherFamily(t, registry, "queue_depth").GetMetric()[0].GetGauge().GetValue(); got != 5 {
+		t.Errorf("queue_depth %v after the callback changed, want 5", got)
+	}
+
+	if err := UnregisterMetrics(s, registry); err != nil {
+		t.Fatalf("UnregisterMetrics: %v", err)
+	}
+	if n, err := testutil.GatherAndCount(registry); err != nil || n != 0 {
+		t.Errorf("after UnregisterMetrics: %d series gathered, error %v", n, err)
+	}
+}
+
+func TestGaugeFuncFieldErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		mtrcs   interface{}
+		wantErr error
+	}{
+		{
+			name: "nil callback",
+			mtrcs: &struct {
+				Depth func() float64 `misery:"name=queue_depth"`
+			}{},
+			wantErr: ErrAttributeMalformed,
+		},
+		{
+			name: "nil gauge func",
+			mtrcs: &struct {
+				Depth prometheus.GaugeFunc
+			}{},
+			wantErr: ErrAttributeMalformed,
+		},
+		{
+			name: "labels",
+			mtrcs: &struct {
+				Depth func() float64 `misery:"name=queue_depth,labels=[queue]"`
+			}{Depth: func() float64 { return 1 }},
+			wantErr: ErrAttributeMalformed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := RegisterMetrics(tt.mtrcs, prometheus.NewRegistry())
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCounterUntypedFuncFields(t *testing.T) {
+	type stat struct {
+		Read     func() float64 `misery:"name=read_bytes_total,help='Bytes read.',type=counter"`
+		Temp     func() float64 `misery:"name=temperature,help=Temperature.,type=untyped"`
+		Written  prometheus.CounterFunc
+		Restarts prometheus.UntypedFunc
+	}
+
+	read := 10.0
+	s := &stat{
+		Read: func() float64 { return read },
+		Temp: func() float64 { return -4 },
+		Written: prometheus.NewCounterFunc(prometheus.CounterOpts{Name: "written_bytes_total", Help: "Bytes written."},
+			func() float64 { return 20 }),
+		Restarts: prometheus.NewUntypedFunc(prometheus.UntypedOpts{Name: "restarts", Help: "Restarts."},
+			func() float64 { return 2 }),
+	}
+	registry := prometheus.NewRegistry()
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	read = 15
+
+	want := `
+# HELP read_bytes_total Bytes read.
+# TYPE read_bytes_total counter
+read_bytes_total 15
+# HELP restarts Restarts.
+# TYPE restarts untyped
+restarts 2
+# HELP temperature Temperature.
+# TYPE temperature untyped
+temperature -4
+# HELP written_bytes_total Bytes written.
+# TYPE written_bytes_total counter
+written_bytes_total 20
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UnregisterMetrics(s, registry); err != nil {
+		t.Fatalf("UnregisterMetrics: %v", err)
+	}
+	if n, err := testutil.GatherAndCount(registry); err != nil || n != 0 {
+		t.Errorf("after UnregisterMetrics: %d series gathered, error %v", n, err)
+	}
+
+	tests := []struct {
+		name  string
+		mtrcs interface{}
+	}{
+		{
+			name: "histogram type",
+			mtrcs: &struct {
+				Depth func() float64 `misery:"name=queue_depth,type=histogram"`
+			}{Depth: func() float64 { return 1 }},
+		},
+		{
+			name:  "nil counter func",
+			mtrcs: &struct{ Written prometheus.CounterFunc }{},
+		},
+		{
+			name:  "nil untyped func",
+			mtrcs: &struct{ Restarts prometheus.UntypedFunc }{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := RegisterMetrics(tt.mtrcs, prometheus.NewRegistry())
+			if !errors.Is(err, ErrAttributeMalformed) {
+				t.Fatalf("got error %v, want ErrAttributeMalformed", err)
+			}
+		})
+	}
+}
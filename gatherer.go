@@ -0,0 +1,54 @@
+package misery
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// NewGatherer returns a gatherer exposing the metrics of structs without a
+// registry, for use in prometheus.Gatherers next to other sources. Structs
+// whose metrics are not built yet are built as BuildMetrics does.
+//
+// The struct fields are read on every Gather, so collectors assigned later
+// are picked up. Each struct is gathered on its own and the results are
+// merged as prometheus.Gatherers merges them: a metric name exposed by
+// several structs with consistent help and labels is exposed once, anything
+// else is reported in the Gather error.
+func NewGatherer(structs ...interface{}) (prometheus.Gatherer, error) {
+	values := make(structGatherer, 0, len(structs))
+	for i, mtrcs := range structs {
+		val, err := unpackStruct(mtrcs)
+		if err != nil {
+			return nil, fmt.Errorf("struct %d (%T): struct unpack error: %w", i, mtrcs, err)
+		}
+		if !metricsBuilt(val) {
+			if err := BuildMetrics(mtrcs); err != nil {
+				return nil, fmt.Errorf("struct %d (%T): %w", i, mtrcs, err)
+			}
+		}
+		values = append(values, val)
+	}
+
+	return values, nil
+}
+
+// structGatherer gathers the collectors found in the struct values.
+type structGatherer []reflect.Value
+
+func (g structGatherer) Gather() ([]*dto.MetricFamily, error) {
+	gatherers := make(prometheus.Gatherers, 0, len(g))
+	for _, val := range g {
+		registry := prometheus.NewRegistry()
+		for _, collector := range builtCollectors(val, newConfig()) {
+			if err := registry.Register(collector); err != nil {
+				return nil, fmt.Errorf("collector register failed for %s: %w", val.Type(), err)
+			}
+		}
+		gatherers = append(gatherers, registry)
+	}
+
+	return gatherers.Gather()
+}
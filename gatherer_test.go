@@ -0,0 +1,111 @@
+package misery
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNewGatherer(t *testing.T) {
+	type api struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,help=Requests.,labels=[code]"`
+	}
+	type worker struct {
+		Queue    prometheus.Gauge       `misery:"name=queue_depth,help='Queue depth.'"`
+		Requests *prometheus.CounterVec `misery:"name=requests_total,help=Requests.,labels=[code]"`
+	}
+
+	a, w := &api{}, &worker{}
+	gatherer, err := NewGatherer(a, w)
+	if err != nil {
+		t.Fatalf("NewGatherer: %v", err)
+	}
+	a.Requests.WithLabelValues("200").Add(2)
+	w.Requests.WithLabelValues("500").Inc()
+	w.Queue.Set(4)
+
+	want := `
+# HELP queue_depth Queue depth.
+# TYPE queue_depth gauge
+queue_depth 4
+# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{code="200"} 2
+requests_total{code="500"} 1
+`
+	if err := testutil.GatherAndCompare(gatherer, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+
+	merged := prometheus.Gatherers{gatherer, prometheus.NewRegistry()}
+	if err := testutil.GatherAndCompare(merged, strings.NewReader(want)); err != nil {
+		t.Fatalf("merged: %v", err)
+	}
+}
+
+func TestNewGathererCollisions(t *testing.T) {
+	type counter struct {
+		Shared *prometheus.CounterVec `misery:"name=shared,help=Shared.,labels=[code]"`
+	}
+	type gauge struct {
+		Shared *prometheus.GaugeVec `misery:"name=shared,help=Shared.,labels=[code]"`
+	}
+
+	tests := []struct {
+		name    string
+		structs []interface{}
+		prepare func(structs []interface{})
+	}{
+		{
+			name:    "other type",
+			structs: []interface{}{&counter{}, &gauge{}},
+			prepare: func(structs []interface{}) {
+				structs[0].(*counter).Shared.WithLabelValues("200").Inc()
+				structs[1].(*gauge).Shared.WithLabelValues("200").Inc()
+			},
+		},
+		{
+			name:    "same series",
+			structs: []interface{}{&counter{}, &counter{}},
+			prepare: func(structs []interface{}) {
+				structs[0].(*counter).Shared.WithLabelValues("200").Inc()
+				structs[1].(*counter).Shared.WithLabelValues("200").Inc()
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gatherer, err := NewGatherer(tt.structs...)
+			if err != nil {
+				t.Fatalf("NewGatherer: %v", err)
+			}
+			tt.prepare(tt.structs)
+			if _, err := gatherer.Gather(); err == nil {
+				t.Fatal("Gather: got no error")
+			}
+		})
+	}
+}
+
+func TestNewGathererInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		structs []interface{}
+		wantErr error
+	}{
+		{name: "not a pointer", structs: []interface{}{struct{}{}}, wantErr: ErrStructPointerRequired},
+		{name: "malformed tag", structs: []interface{}{&struct {
+			Requests *prometheus.CounterVec `misery:"name=broken-name"`
+		}{}}, wantErr: ErrAttributeMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewGatherer(tt.structs...); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
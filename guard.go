@@ -0,0 +1,59 @@
+package misery
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// guardedCounterVec is the report entry of a counter vec registered with
+// WithCounterGuard. It carries the logger the counters Report.Counter
+// returns report ignored calls to.
+type guardedCounterVec struct {
+	*prometheus.CounterVec
+	logger Logger
+}
+
+func (v guardedCounterVec) unwrap() prometheus.Collector {
+	return v.CounterVec
+}
+
+// guardedCounter ignores and logs negative increments instead of letting
+// the counter panic.
+type guardedCounter struct {
+	prometheus.Counter
+	name   string
+	logger Logger
+}
+
+func (c guardedCounter) Add(v float64) {
+	if v < 0 {
+		c.logger.Printf("misery: %s: ignored negative counter increment %v", c.name, v)
+		return
+	}
+	c.Counter.Add(v)
+}
+
+func (c guardedCounter) AddWithExemplar(v float64, exemplar prometheus.Labels) {
+	if v < 0 {
+		c.logger.Printf("misery: %s: ignored negative counter increment %v", c.name, v)
+		return
+	}
+	if ea, ok := c.Counter.(prometheus.ExemplarAdder); ok {
+		ea.AddWithExemplar(v, exemplar)
+		return
+	}
+	c.Counter.Add(v)
+}
+
+// bindCounterGuards makes Report.Counter guard the counters of the counter
+// vecs among infos, by wrapping their report entries, when WithCounterGuard
+// is set.
+func (reg *registration) bindCounterGuards() {
+	if !reg.cfg.counterGuard {
+		return
+	}
+	for _, info := range reg.infos {
+		if vec, ok := reg.report[info.name].(*prometheus.CounterVec); ok {
+			reg.report[info.name] = guardedCounterVec{CounterVec: vec, logger: reg.cfg.logger}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package misery
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCounterGuard(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,labels=[code]"`
+	}
+
+	logger := &recordLogger{}
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	report, err := RegisterMetricsReport(s, registry, WithCounterGuard(true), WithLogger(logger))
+	if err != nil {
+		t.Fatalf("RegisterMetricsReport: %v", err)
+	}
+	counter, err := report.Counter("requests_total", prometheus.Labels{"code": "200"})
+	if err != nil {
+		t.Fatalf("Counter: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		add    func()
+		want   float64
+		logged bool
+	}{
+		{name: "positive add", add: func() { counter.Add(2) }, want: 2},
+		{name: "negative add", add: func() { counter.Add(-1) }, want: 2, logged: true},
+		{name: "inc", add: func() { counter.Inc() }, want: 3},
+		{
+			name: "negative add with exemplar",
+			add: func() {
+				counter.(prometheus.ExemplarAdder).AddWithExemplar(-5, prometheus.Labels{"trace_id": "abc"})
+			},
+			want:   3,
+			logged: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger.lines = nil
+			tt.add()
+			if got := testutil.ToFloat64(s.Requests.WithLabelValues("200")); got != tt.want {
+				t.Errorf("requests_total = %v, want %v", got, tt.want)
+			}
+			logged := strings.Contains(logger.String(), "ignored negative counter increment")
+			if logged != tt.logged {
+				t.Errorf("logged %q", logger.String())
+			}
+		})
+	}
+
+	logger.lines = nil
+	bound, err := report.BindLabels("requests_total", prometheus.Labels{"code": "500"})
+	if err != nil {
+		t.Fatalf("BindLabels: %v", err)
+	}
+	bound.(prometheus.Counter).Add(-1)
+	if !strings.Contains(logger.String(), "ignored negative counter increment") {
+		t.Errorf("bound counter not guarded: %q", logger.String())
+	}
+}
+
+func TestCounterGuardOff(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total"`
+	}
+
+	report, err := RegisterMetricsReport(&stat{}, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("RegisterMetricsReport: %v", err)
+	}
+	counter, err := report.Counter("requests_total", nil)
+	if err != nil {
+		t.Fatalf("Counter: %v", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("an unguarded counter accepted a negative increment")
+		}
+	}()
+	counter.Add(-1)
+}
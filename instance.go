@@ -0,0 +1,313 @@
+package misery
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// instances holds a mutex per struct pointer registration calls are working
+// on, so calls on one instance serialize, together with what registration
+// calls left registered for the instance. An entry lives as long as a call
+// holds it or a registration of the instance is recorded in it.
+var (
+	instancesMu sync.Mutex
+	instances   = map[interface{}]*instance{}
+)
+
+type instance struct {
+	mu   sync.Mutex
+	refs int
+	// registrations holds, per registry passed to the registration calls,
+	// what they registered there, until UnregisterMetrics takes it. The map
+	// is guarded by instancesMu, the registrations in it by mu.
+	registrations map[prometheus.Registerer]*instanceRegistration
+}
+
+// instanceRegistration is what registration calls on one instance left in
+// one registry: the report of the metrics built and the collectors
+// registered, each with the registerer it went through.
+type instanceRegistration struct {
+	report     Report
+	registered []instanceCollector
+}
+
+type instanceCollector struct {
+	registeredField
+	registry prometheus.Registerer
+}
+
+// lockInstance locks the struct mtrcs points to and returns the function
+// releasing it. Values other than non-nil pointers, which registration
+// rejects anyway, are not locked.
+func lockInstance(mtrcs interface{}) func() {
+	return lockInstances([]interface{}{mtrcs})
+}
+
+// lockInstances locks the structs pointed to by structs, in address order
+// so that calls locking overlapping sets do not deadlock, and returns the
+// function releasing them.
+func lockInstances(structs []interface{}) func() {
+	type key struct {
+		addr uintptr
+		ptr  interface{}
+	}
+
+	var keys []key
+	seen := map[interface{}]bool{}
+	for _, mtrcs := range structs {
+		v := reflect.ValueOf(mtrcs)
+		if v.Kind() != reflect.Ptr || v.IsNil() || seen[mtrcs] {
+			continue
+		}
+		seen[mtrcs] = true
+		keys = append(keys, key{addr: v.Pointer(), ptr: mtrcs})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].addr != keys[j].addr {
+			return keys[i].addr < keys[j].addr
+		}
+		return fmt.Sprintf("%T", keys[i].ptr) < fmt.Sprintf("%T", keys[j].ptr)
+	})
+
+	locked := make([]*instance, len(keys))
+	for i, k := range keys {
+		instancesMu.Lock()
+		inst, ok := instances[k.ptr]
+		if !ok {
+			inst = &instance{}
+			instances[k.ptr] = inst
+		}
+		inst.refs++
+		instancesMu.Unlock()
+
+		inst.mu.Lock()
+		locked[i] = inst
+	}
+
+	return func() {
+		for i := len(keys) - 1; i >= 0; i-- {
+			inst := locked[i]
+			inst.mu.Unlock()
+
+			instancesMu.Lock()
+			inst.refs--
+			if inst.refs == 0 && len(inst.registrations) == 0 {
+				delete(instances, keys[i].ptr)
+			}
+			instancesMu.Unlock()
+		}
+	}
+}
+
+// lockedInstance returns the instance entry of mtrcs, which the caller
+// holds locked, or nil when mtrcs is not a pointer lockInstance locks.
+func lockedInstance(mtrcs interface{}) *instance {
+	v := reflect.ValueOf(mtrcs)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return nil
+	}
+
+	instancesMu.Lock()
+	defer instancesMu.Unlock()
+
+	return instances[mtrcs]
+}
+
+// registrationKey returns registry as the key of the registrations of an
+// instance. Registerers that cannot be map keys, like the one
+// RegisterMetricsMulti fans out through, are not recorded.
+func registrationKey(registry prometheus.Registerer) (prometheus.Registerer, bool) {
+	if registry == nil || !reflect.ValueOf(registry).Comparable() {
+		return nil, false
+	}
+
+	return registry, true
+}
+
+// record adds what reg registered for each of its structs to the
+// registrations of the instances into registry, which the caller holds
+// locked. Only the fields of the structs are recorded; the collectors
+// finish registers for the whole call are left out.
+func (reg *registration) record(registry prometheus.Registerer) {
+	key, ok := registrationKey(registry)
+	if !ok || !reg.cfg.register || reg.cfg.unrecorded {
+		return
+	}
+
+	for _, s := range reg.structs {
+		inst := lockedInstance(s.mtrcs)
+		if inst == nil {
+			continue
+		}
+		instancesMu.Lock()
+		if inst.registrations == nil {
+			inst.registrations = map[prometheus.Registerer]*instanceRegistration{}
+		}
+		recorded, ok := inst.registrations[key]
+		if !ok {
+			recorded = &instanceRegistration{report: Report{}}
+			inst.registrations[key] = recorded
+		}
+		instancesMu.Unlock()
+
+		for _, name := range s.names {
+			recorded.report[name] = reg.report[name]
+		}
+		for _, r := range reg.registered[s.from:s.to] {
+			recorded.registered = append(recorded.registered, instanceCollector{registeredField: r, registry: reg.registry})
+		}
+	}
+}
+
+// takeRegistration removes the registration of mtrcs into registry, which
+// the caller holds locked, from its instance and returns it, nil if none
+// is recorded.
+func takeRegistration(mtrcs interface{}, registry prometheus.Registerer) *instanceRegistration {
+	key, ok := registrationKey(registry)
+	inst := lockedInstance(mtrcs)
+	if !ok || inst == nil {
+		return nil
+	}
+
+	instancesMu.Lock()
+	defer instancesMu.Unlock()
+	recorded := inst.registrations[key]
+	delete(inst.registrations, key)
+
+	return recorded
+}
+
+// recordedRegistration returns the registration of mtrcs into registry,
+// which the caller holds locked, nil if none is recorded.
+func recordedRegistration(mtrcs interface{}, registry prometheus.Registerer) *instanceRegistration {
+	key, ok := registrationKey(registry)
+	inst := lockedInstance(mtrcs)
+	if !ok || inst == nil {
+		return nil
+	}
+
+	instancesMu.Lock()
+	defer instancesMu.Unlock()
+
+	return inst.registrations[key]
+}
+
+// registeredReport returns a copy of the report of the registration of
+// mtrcs into registry recorded before, and true. When a registration with
+// cfg would build other metrics than the fields of mtrcs hold, it fails
+// with ErrAlreadyRegistered instead. The struct needs registering when ok
+// is false.
+func registeredReport(mtrcs interface{}, registry prometheus.Registerer, cfg *config) (Report, bool, error) {
+	recorded := recordedRegistration(mtrcs, registry)
+	if recorded == nil {
+		return nil, false, nil
+	}
+	val, err := unpackStruct(mtrcs)
+	if err != nil {
+		return nil, false, nil
+	}
+	dryCfg := *cfg
+	_, scratch, err := dryRunCopy(mtrcs, &dryCfg)
+	if err != nil {
+		// reported by the registration itself
+		return nil, false, nil
+	}
+
+	var keys, wantKeys []string
+	for _, collector := range builtCollectors(val, &dryCfg) {
+		keys = append(keys, descKey(collector))
+	}
+	for _, collector := range builtCollectors(scratch, &dryCfg) {
+		wantKeys = append(wantKeys, descKey(collector))
+	}
+	if !sortedEqual(keys, wantKeys) {
+		return nil, false, fmt.Errorf("%w: %T is registered with other options", ErrAlreadyRegistered, mtrcs)
+	}
+
+	report := make(Report, len(recorded.report))
+	for name, collector := range recorded.report {
+		report[name] = collector
+	}
+
+	return report, true, nil
+}
+
+// unregister removes the collectors of r from the registries they were
+// registered into, together with the series counts of
+// WithCardinalityMetrics, and clears the metric fields under
+// WithClearFields. A metric field collector the registry no longer holds
+// is an error; any other is only logged.
+func (r *instanceRegistration) unregister(cfg *config) error {
+	var errs []error
+	for _, c := range r.registered {
+		managed := c.field.IsValid() && isMetricType(c.field.Type())
+		collector := c.collector
+		if c.replaced != nil {
+			collector = c.replaced
+		}
+		if collector != nil {
+			if !c.registry.Unregister(collector) {
+				if managed {
+					errs = append(errs, fmt.Errorf("%w: %s was not registered", ErrMetricNotFound, c.name))
+				} else {
+					cfg.logger.Printf("misery: %s was not registered", c.name)
+				}
+			}
+			if managed {
+				for _, name := range describeNames(collector) {
+					c.registry.Unregister(newSeriesCounter(name, nil))
+				}
+			}
+		}
+		if managed && cfg.clearFields {
+			c.field.Set(reflect.Zero(c.field.Type()))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// sortedEqual reports whether a and b hold the same strings, in any order.
+func sortedEqual(a, b []string) bool {
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+
+	return strings.Join(a, "\n") == strings.Join(b, "\n")
+}
+
+// describe returns the descriptors collector sends.
+func describe(collector prometheus.Collector) []*prometheus.Desc {
+	ch := make(chan *prometheus.Desc)
+	go func() {
+		collector.Describe(ch)
+		close(ch)
+	}()
+
+	var descs []*prometheus.Desc
+	for desc := range ch {
+		descs = append(descs, desc)
+	}
+
+	return descs
+}
+
+// descKey identifies the metrics collector describes, help and label names
+// included.
+func descKey(collector prometheus.Collector) string {
+	descs := describe(collector)
+	keys := make([]string, len(descs))
+	for i, desc := range descs {
+		keys[i] = desc.String()
+	}
+	sort.Strings(keys)
+
+	return strings.Join(keys, ";")
+}
@@ -0,0 +1,166 @@
+package misery
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRegisterOverUnregisteredCollector(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,help=Requests."`
+	}
+
+	// a vec of the same name with other help, never registered, must not
+	// get in the way of the one the tag describes
+	registry := prometheus.NewRegistry()
+	s := &stat{Requests: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests_total", Help: "Other."}, nil)}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	s.Requests.WithLabelValues().Inc()
+	if got := gatherFamily(t, registry, "requests_total").GetHelp(); got != "Requests." {
+		t.Errorf("help %q, want Requests.", got)
+	}
+	if n := testutil.CollectAndCount(registry); n != 1 {
+		t.Errorf("%d metrics registered, want 1", n)
+	}
+}
+
+func TestConcurrentRegistration(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,help=Requests.,labels=[code]"`
+		Queue    prometheus.Gauge       `misery:"name=queue_depth,help='Queue depth.'"`
+	}
+
+	const goroutines = 8
+	for round := 0; round < 20; round++ {
+		registry := prometheus.NewRegistry()
+		s := &stat{}
+		start := make(chan struct{})
+		errs := make([]error, goroutines)
+		var wg sync.WaitGroup
+		for i := 0; i < goroutines; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				<-start
+				errs[i] = RegisterMetrics(s, registry)
+			}(i)
+		}
+		close(start)
+		wg.Wait()
+
+		for i, err := range errs {
+			if err != nil {
+				t.Fatalf("round %d, goroutine %d: RegisterMetrics: %v", round, i, err)
+			}
+		}
+		s.Requests.WithLabelValues("200").Inc()
+		s.Queue.Set(1)
+		if n := testutil.CollectAndCount(registry); n != 2 {
+			t.Fatalf("round %d: %d series registered, want 2", round, n)
+		}
+		if got := testutil.ToFloat64(s.Requests.WithLabelValues("200")); got != 1 {
+			t.Fatalf("round %d: counter = %v, want 1", round, got)
+		}
+	}
+}
+
+func TestConcurrentRegistrationWithOtherOptions(t *testing.T) {
+	type stat struct {
+		LegacyRequests *prometheus.CounterVec `misery:"labels=[code]"`
+	}
+
+	for round := 0; round < 20; round++ {
+		registry := prometheus.NewRegistry()
+		s := &stat{}
+		start := make(chan struct{})
+		errs := make([]error, 2)
+		var wg sync.WaitGroup
+		for i, opts := range [][]Option{nil, {WithNameTrimPrefix("Legacy")}} {
+			wg.Add(1)
+			go func(i int, opts []Option) {
+				defer wg.Done()
+				<-start
+				errs[i] = RegisterMetricsWithOptions(s, registry, opts...)
+			}(i, opts)
+		}
+		close(start)
+		wg.Wait()
+
+		failed := 0
+		for _, err := range errs {
+			if err == nil {
+				continue
+			}
+			failed++
+			if !errors.Is(err, ErrAlreadyRegistered) {
+				t.Errorf("round %d: got error %v, want ErrAlreadyRegistered", round, err)
+			}
+		}
+		if failed != 1 {
+			t.Fatalf("round %d: %d of 2 registrations with other names failed, want 1", round, failed)
+		}
+		s.LegacyRequests.WithLabelValues("200").Inc()
+		if n := testutil.CollectAndCount(registry); n != 1 {
+			t.Fatalf("round %d: %d series registered, want 1", round, n)
+		}
+	}
+}
+
+func TestRegisterWithOtherHelp(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total"`
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	requests := s.Requests
+	if err := RegisterMetricsWithOptions(s, registry, WithAutoHelp(true)); !errors.Is(err, ErrAlreadyRegistered) {
+		t.Fatalf("got error %v, want ErrAlreadyRegistered", err)
+	}
+	if s.Requests != requests {
+		t.Error("a failed registration replaced the field")
+	}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("registering again with the same options: %v", err)
+	}
+}
+
+func TestUnregisterRecorded(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,help=Requests."`
+		Queue    prometheus.Gauge       `misery:"name=queue_depth,help='Queue depth.'"`
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	s.Requests.WithLabelValues().Inc()
+	s.Queue.Set(1)
+
+	// the registration is unregistered as recorded, whatever the fields
+	// hold by now
+	s.Requests = nil
+	s.Queue = prometheus.NewGauge(prometheus.GaugeOpts{Name: "queue_depth", Help: "Other."})
+	if err := UnregisterMetrics(s, registry); err != nil {
+		t.Fatalf("UnregisterMetrics: %v", err)
+	}
+	if n := testutil.CollectAndCount(registry); n != 0 {
+		t.Fatalf("%d metrics left registered", n)
+	}
+
+	s = &stat{}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("registering after UnregisterMetrics: %v", err)
+	}
+}
@@ -1,9 +1,13 @@
 package misery
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math"
 	"reflect"
+	"strings"
+	"time"
 
 	"github.com/iancoleman/strcase"
 	"github.com/prometheus/client_golang/prometheus"
@@ -14,20 +18,400 @@ var (
 	ErrStructPointerRequired = errors.New("structure pointer required")
 	ErrAttributeMalformed    = errors.New("attribute malformed")
 	ErrTypeNotSupported      = errors.New("type not supported")
+	ErrMetricNotFound        = errors.New("metric not found")
+	ErrDuplicateMetricName   = errors.New("duplicate metric name")
+	ErrNilRegistry           = errors.New("nil registry")
+	ErrAlreadyRegistered     = errors.New("already registered")
 )
 
-func RegisterMetrics(mtrcs interface{}, registry *prometheus.Registry) error {
+// checkRegistry fails for a nil registry, including a nil *prometheus.Registry
+// stored in the interface, which would otherwise panic on first use.
+func checkRegistry(registry prometheus.Registerer) error {
+	if registry == nil {
+		return ErrNilRegistry
+	}
+	if v := reflect.ValueOf(registry); v.Kind() == reflect.Ptr && v.IsNil() {
+		return fmt.Errorf("%w: %T", ErrNilRegistry, registry)
+	}
+
+	return nil
+}
+
+// BuildMetrics creates collectors for the struct fields like RegisterMetrics
+// but does not register them anywhere.
+func BuildMetrics(mtrcs interface{}, opts ...Option) error {
+	cfg := newConfig(opts...)
+	cfg.register = false
+
+	_, err := registerMetrics(context.Background(), mtrcs, nil, cfg)
+	return err
+}
+
+// RegisterMetrics builds the metrics declared by the struct mtrcs points to,
+// stores them in its fields and registers them into registry.
+//
+// Registration calls on one struct instance are serialized, and misery
+// remembers what they registered per instance and registry. Registering an
+// instance into a registry it is registered into already is a no-op that
+// leaves the fields alone, so goroutines racing to initialize a shared
+// struct lazily register it once. The call fails with ErrAlreadyRegistered
+// instead when its options would build other metrics than the fields hold.
+// UnregisterMetrics ends the registration; registering afterwards builds
+// fresh collectors.
+func RegisterMetrics(mtrcs interface{}, registry prometheus.Registerer) error {
+	_, err := registerMetrics(context.Background(), mtrcs, registry, newConfig())
+	return err
+}
+
+// RegisterMetricsFields is RegisterMetrics building and registering only
+// the named fields of mtrcs; the other fields are left untouched. Naming a
+// field mtrcs does not have is an error.
+func RegisterMetricsFields(mtrcs interface{}, registry prometheus.Registerer, fields ...string) error {
 	val, err := unpackStruct(mtrcs)
 	if err != nil {
 		return fmt.Errorf("struct unpack error: %w", err)
 	}
 
-	tags, err := parseStructTags(val)
+	wanted := make(map[string]bool, len(fields))
+	for _, name := range fields {
+		if _, ok := val.Type().FieldByName(name); !ok {
+			return fmt.Errorf("%w: no field %s", ErrMetricNotFound, name)
+		}
+		wanted[name] = true
+	}
+
+	cfg := newConfig(WithEnabled(func(field string) bool { return wanted[field] }))
+	_, err = registerMetrics(context.Background(), mtrcs, registry, cfg)
+
+	return err
+}
+
+// RegisterMetricsPrefixed is RegisterMetrics with prefix and an underscore
+// prepended to every metric name, the explicitly named ones included. Each
+// call builds fresh collectors, so instances of one struct type can be
+// registered side by side under different prefixes, one per tenant say.
+// The prefixed metrics are unregistered through
+// prometheus.WrapRegistererWithPrefix(prefix+"_", registry).
+func RegisterMetricsPrefixed(mtrcs interface{}, registry prometheus.Registerer, prefix string) error {
+	if prefix == "" {
+		return fmt.Errorf("%w: empty prefix", ErrAttributeMalformed)
+	}
+	if err := checkRegistry(registry); err != nil {
+		return err
+	}
+	registry = prometheus.WrapRegistererWithPrefix(prefix+"_", registry)
+
+	cfg := newConfig()
+	cfg.unrecorded = true
+	_, err := registerMetrics(context.Background(), mtrcs, registry, cfg)
+	return err
+}
+
+func registerMetrics(
+	ctx context.Context,
+	mtrcs interface{},
+	registry prometheus.Registerer,
+	cfg *config,
+) (Report, error) {
+	if cfg.register {
+		if err := checkRegistry(registry); err != nil {
+			return nil, err
+		}
+	}
+
+	defer lockInstance(mtrcs)()
+	if cfg.register && cfg.enabled == nil && cfg.metricFilter == nil {
+		report, ok, err := registeredReport(mtrcs, registry, cfg)
+		if err != nil || ok {
+			return report, err
+		}
+	}
+
+	reg := newRegistration(registry, cfg)
+	if err := reg.add(ctx, mtrcs); err != nil {
+		reg.rollback()
+		return nil, err
+	}
+	if err := reg.finish(); err != nil {
+		reg.rollback()
+		return nil, err
+	}
+	reg.record(registry)
+
+	return reg.report, nil
+}
+
+// registration tracks what one registration call has built and registered,
+// possibly across several structs, so that the whole call can be rolled back
+// and metric names can be checked for duplicates.
+type registration struct {
+	registry   prometheus.Registerer
+	cfg        *config
+	report     Report
+	owners     map[string]string
+	shared     map[string]sharedMetric
+	registered []registeredField
+	// visiting holds the struct types behind the pointers being recursed
+	// into, to stop at self-referencing types.
+	visiting map[reflect.Type]bool
+	// copyPointers makes recursion into a pointer-to-struct field work on
+	// a copy of the struct, and slice fields on a copy of their elements,
+	// so dry runs leave the caller's structs and slices alone.
+	copyPointers bool
+	infos        []metricInfo
+	counts       []structCount
+	structs      []registeredStruct
+	errs         []error
+	// selfGauge is the misery_registered_metrics vec set by
+	// registerSelfMetrics, selfGaugeCreated whether it registered it.
+	selfGauge        *prometheus.GaugeVec
+	selfGaugeCreated bool
+}
+
+type structCount struct {
+	name  string
+	count int
+}
+
+// registeredStruct is a struct added to a registration: its fields are
+// registered[from:to] and names are the metric names it added to the
+// report.
+type registeredStruct struct {
+	mtrcs    interface{}
+	from, to int
+	names    []string
+}
+
+func newRegistration(registry prometheus.Registerer, cfg *config) *registration {
+	return &registration{
+		registry: wrapRegisterer(registry, cfg),
+		cfg:      cfg,
+		report:   Report{},
+		owners:   map[string]string{},
+		shared:   map[string]sharedMetric{},
+		visiting: map[reflect.Type]bool{},
+	}
+}
+
+// wrapRegisterer returns registry adding the WithRegistererLabels labels to
+// everything registered through it.
+func wrapRegisterer(registry prometheus.Registerer, cfg *config) prometheus.Registerer {
+	if registry != nil && len(cfg.registererLabels) > 0 {
+		return prometheus.WrapRegistererWith(cfg.registererLabels, registry)
+	}
+
+	return registry
+}
+
+func (reg *registration) add(ctx context.Context, mtrcs interface{}) error {
+	val, err := unpackStruct(mtrcs)
+	if err != nil {
+		return fmt.Errorf("struct unpack error: %w", err)
+	}
+
+	// a pointer back to the struct type itself is not recursed into
+	reg.visiting[val.Type()] = true
+	defer delete(reg.visiting, val.Type())
+
+	before := len(reg.registered)
+	reported := make(map[string]bool, len(reg.report))
+	for name := range reg.report {
+		reported[name] = true
+	}
+	if err := reg.addStruct(ctx, val, ""); err != nil {
+		return err
+	}
+	if err := errors.Join(reg.errs...); err != nil {
+		return err
+	}
+	reg.counts = append(reg.counts, structCount{name: val.Type().Name(), count: reg.metricCount(before)})
+	added := registeredStruct{mtrcs: mtrcs, from: before, to: len(reg.registered)}
+	for name := range reg.report {
+		if !reported[name] {
+			added.names = append(added.names, name)
+		}
+	}
+	reg.structs = append(reg.structs, added)
+
+	return nil
+}
+
+// metricCount returns the number of metrics among the fields registered
+// since the first from, leaving out the structs and slices allocated to
+// hold them.
+func (reg *registration) metricCount(from int) int {
+	count := 0
+	for _, r := range reg.registered[from:] {
+		if r.current() != nil || (r.field.IsValid() && isMetricType(r.field.Type())) {
+			count++
+		}
+	}
+
+	return count
+}
+
+// addStruct registers the fields of structValue, recursing into nested
+// struct fields. path prefixes the field names recorded for structValue,
+// like Inner. for the fields of a nested Inner struct.
+//
+// Fields are visited depth-first in declaration order, a nested struct
+// being registered completely before the field that follows it, so the
+// registration order, and with it which field a duplicate name is reported
+// for, is the same on every run.
+func (reg *registration) addStruct(ctx context.Context, structValue reflect.Value, path string) error {
+	tags, err := parseStructTags(structValue, reg.cfg.tagKeys...)
 	if err != nil {
 		return fmt.Errorf("struct tag parse error: %w", err)
 	}
 
-	return registerMetricsByTags(val, tags, registry)
+	if err := resolveBucketReferences(structValue, tags, reg.cfg); err != nil {
+		return err
+	}
+
+	return registerMetricsByTags(ctx, structValue, tags, reg, path)
+}
+
+// finish runs the steps that follow a successful registration of all
+// structs.
+func (reg *registration) finish() error {
+	if reg.cfg.register && reg.cfg.selfMetrics {
+		if err := reg.registerSelfMetrics(); err != nil {
+			return err
+		}
+	}
+	if reg.cfg.register && reg.cfg.cardinalityMetrics {
+		if err := reg.registerSeriesCounters(); err != nil {
+			return err
+		}
+	}
+	reg.bindContextLabels()
+	reg.bindCounterGuards()
+	// last, so the hook never sees collectors of a failed registration
+	if reg.cfg.afterRegister != nil {
+		for _, r := range reg.registered {
+			if collector := r.current(); collector != nil {
+				reg.cfg.afterRegister(r.name, unwrapCollector(collector))
+			}
+		}
+	}
+
+	return nil
+}
+
+// fail records err when collecting all errors, or only logs it in lenient
+// mode, and returns nil so the caller moves on to the next field; otherwise
+// it returns err to stop right away.
+func (reg *registration) fail(err error) error {
+	if reg.cfg.lenient {
+		reg.cfg.logger.Printf("misery: skipping field: %v", err)
+		return nil
+	}
+	if !reg.cfg.collectErrors {
+		return err
+	}
+	reg.errs = append(reg.errs, err)
+
+	return nil
+}
+
+// claim records owner as the declarer of every metric name collector
+// describes. Names come from the collector's Describe output, so custom
+// collectors registered as they are get checked like built metrics.
+func (reg *registration) claim(owner string, collector prometheus.Collector) error {
+	names := describeNames(collector)
+	var taken []string
+	var prev string
+	for _, name := range names {
+		if p, ok := reg.owners[name]; ok {
+			taken = append(taken, name)
+			prev = p
+		}
+	}
+	if len(taken) > 0 {
+		return fmt.Errorf("%w: %s declared by %s and %s",
+			ErrDuplicateMetricName, strings.Join(taken, ", "), prev, owner)
+	}
+
+	for _, name := range names {
+		reg.owners[name] = owner
+	}
+
+	return nil
+}
+
+// addPassthrough registers a field tagged with register that already holds
+// a prometheus.Collector as it is, a vec built by the user included. The
+// field itself is never modified.
+func (reg *registration) addPassthrough(
+	structValue reflect.Value,
+	typeField reflect.StructField,
+	field reflect.Value,
+	path string,
+) error {
+	if !field.Type().Implements(collectorType) {
+		return fmt.Errorf("%w: %v is not a prometheus.Collector", ErrTypeNotSupported, field.Type())
+	}
+	if (field.Kind() == reflect.Ptr || field.Kind() == reflect.Interface) && field.IsNil() {
+		return fmt.Errorf("%w: register requires a non-nil collector", ErrAttributeMalformed)
+	}
+
+	collector := field.Interface().(prometheus.Collector)
+	if err := reg.claim(structValue.Type().Name()+"."+typeField.Name, collector); err != nil {
+		return err
+	}
+	for _, name := range describeNames(collector) {
+		reg.report[name] = collector
+	}
+	if !reg.cfg.register {
+		return nil
+	}
+	registered, err := reg.register(typeField.Name, collector)
+	if err != nil {
+		return fmt.Errorf("collector register failed for %s: %w", typeField.Name, err)
+	}
+	registered.name = path + typeField.Name
+	reg.registered = append(reg.registered, registered)
+
+	return nil
+}
+
+// reusable returns the collector already registered in place of the one
+// that failed with err, when WithIgnoreAlreadyRegistered allows reusing it
+// and it fits a field of fieldType.
+func (reg *registration) reusable(err error, fieldType reflect.Type) (prometheus.Collector, bool) {
+	var already prometheus.AlreadyRegisteredError
+	if !reg.cfg.ignoreAlreadyRegistered || !errors.As(err, &already) {
+		return nil, false
+	}
+
+	existing := unwrapCollector(already.ExistingCollector)
+	if _, ok := fieldValue(fieldType, existing); existing == nil || !ok {
+		return nil, false
+	}
+
+	return existing, true
+}
+
+// rollback unregisters every collector registered so far and restores the
+// fields that were populated to what they held before.
+func (reg *registration) rollback() {
+	reg.rollbackSelfMetrics()
+	for i := len(reg.registered) - 1; i >= 0; i-- {
+		r := reg.registered[i]
+		if r.collector != nil {
+			reg.registry.Unregister(r.collector)
+		}
+		if r.replaced != nil {
+			r.replaced.swap(r.replacedCollector)
+		}
+		if r.field.IsValid() {
+			r.field.Set(r.previous)
+		}
+	}
+	if len(reg.registered) > 0 {
+		reg.cfg.logger.Printf("misery: rolled back %d built collectors", len(reg.registered))
+	}
+	reg.registered = nil
 }
 
 func unpackStruct(in interface{}) (val reflect.Value, err error) {
@@ -44,15 +428,45 @@ func unpackStruct(in interface{}) (val reflect.Value, err error) {
 	return val, nil
 }
 
-func parseStructTags(structValue reflect.Value) (map[string][]stagparser.Definition, error) {
-	defs, err := stagparser.ParseStruct(structValue.Interface(), "misery")
-	if err != nil {
-		return nil, fmt.Errorf("tag parse error: %w", err)
+// hasTag reports whether typeField has a tag under any of tagKeys, "misery"
+// when none are given, even an empty one.
+func hasTag(typeField reflect.StructField, tagKeys []string) bool {
+	if len(tagKeys) == 0 {
+		tagKeys = []string{"misery"}
 	}
+	for _, key := range tagKeys {
+		if _, ok := typeField.Tag.Lookup(key); ok {
+			return true
+		}
+	}
+
+	return false
+}
 
-	tagMap := make(map[string][]stagparser.Definition, len(defs))
-	for fieldName, fieldDefs := range defs {
-		tagMap[fieldName] = fieldDefs
+// parseStructTags parses the tags under each of tagKeys, "misery" when none
+// are given, and merges the definitions per field in key order.
+func parseStructTags(structValue reflect.Value, tagKeys ...string) (map[string][]stagparser.Definition, error) {
+	if len(tagKeys) == 0 {
+		tagKeys = []string{"misery"}
+	}
+
+	structType := structValue.Type()
+	tagMap := make(map[string][]stagparser.Definition, structType.NumField())
+	for i := 0; i < structType.NumField(); i++ {
+		typeField := structType.Field(i)
+		for _, key := range tagKeys {
+			tag := typeField.Tag.Get(key)
+			if tag == "" {
+				continue
+			}
+
+			source := structType.Name() + "." + typeField.Name + ":" + key
+			defs, err := stagparser.ParseTag(quoteExpressions(tag), source)
+			if err != nil {
+				return nil, fmt.Errorf("tag parse error in %s: %w", source, err)
+			}
+			tagMap[typeField.Name] = append(tagMap[typeField.Name], defs...)
+		}
 	}
 
 	return tagMap, nil
@@ -61,142 +475,1046 @@ func parseStructTags(structValue reflect.Value) (map[string][]stagparser.Definit
 var (
 	prometheusCounterType   = reflect.TypeOf((*prometheus.CounterVec)(nil))
 	prometheusHistogramType = reflect.TypeOf((*prometheus.HistogramVec)(nil))
+	prometheusSummaryType   = reflect.TypeOf((*prometheus.SummaryVec)(nil))
+	prometheusGaugeType     = reflect.TypeOf((*prometheus.GaugeVec)(nil))
+
+	prometheusObserverVecType = reflect.TypeOf((*prometheus.ObserverVec)(nil)).Elem()
+	timerType                 = reflect.TypeOf((*Timer)(nil))
+
+	// single series fields hold the only series of a vec without labels
+	prometheusCounterSeriesType   = reflect.TypeOf((*prometheus.Counter)(nil)).Elem()
+	prometheusGaugeSeriesType     = reflect.TypeOf((*prometheus.Gauge)(nil)).Elem()
+	prometheusObserverSeriesType  = reflect.TypeOf((*prometheus.Observer)(nil)).Elem()
+	prometheusHistogramSeriesType = reflect.TypeOf((*prometheus.Histogram)(nil)).Elem()
+	prometheusSummarySeriesType   = reflect.TypeOf((*prometheus.Summary)(nil)).Elem()
+
+	collectorType = reflect.TypeOf((*prometheus.Collector)(nil)).Elem()
 )
 
+// isMetricType reports whether fields of type t are managed by misery.
+func isMetricType(t reflect.Type) bool {
+	switch t {
+	case prometheusCounterType, prometheusHistogramType, prometheusSummaryType, prometheusGaugeType,
+		prometheusObserverVecType, timerType,
+		prometheusCounterSeriesType, prometheusGaugeSeriesType, prometheusObserverSeriesType,
+		prometheusHistogramSeriesType, prometheusSummarySeriesType:
+		return true
+	}
+
+	return false
+}
+
+// registerMetricsByTags builds and registers a collector for every supported
+// field. Registration is all or nothing: when a field fails, or ctx is
+// canceled between fields, the caller rolls back every collector registered
+// so far and the affected fields get back the values they held before.
 func registerMetricsByTags(
+	ctx context.Context,
 	structValue reflect.Value,
 	tags map[string][]stagparser.Definition,
-	registry *prometheus.Registry,
+	reg *registration,
+	path string,
 ) (err error) {
 	for i := 0; i < structValue.NumField(); i++ {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("registration aborted: %w", err)
+		}
+
 		field := structValue.Field(i)
 		typeField := structValue.Type().Field(i)
-		var collector prometheus.Collector
+		enabled, defs, err := fieldEnabled(typeField.Name, tags[typeField.Name], reg.cfg)
+		if err != nil {
+			if err := reg.fail(fmt.Errorf("%s: %w", typeField.Name, err)); err != nil {
+				return err
+			}
+			continue
+		}
+		if !enabled {
+			continue
+		}
 
-		switch {
-		case field.Type() == prometheusCounterType:
-			if collector, err = createPrometheusCounter(typeField.Name, tags[typeField.Name]); err != nil {
-				return fmt.Errorf("createPrometheusCounter failed: %w", err)
+		if reg.cfg.requireTag && (isMetricType(field.Type()) || isMetricSlice(field.Type())) &&
+			!hasTag(typeField, reg.cfg.tagKeys) {
+			err := fmt.Errorf("%s: %w: metric field has no tag", typeField.Name, ErrAttributeMalformed)
+			if !reg.cfg.strict {
+				reg.cfg.logger.Printf("misery: skipping %v", err)
+				continue
 			}
-		case field.Type() == prometheusHistogramType:
-			if collector, err = createPrometheusHistogram(typeField.Name, tags[typeField.Name]); err != nil {
-				return fmt.Errorf("createPrometheusHistogram failed: %w", err)
+			if err := reg.fail(err); err != nil {
+				return err
+			}
+			continue
+		}
+		if defs, err = resolveDefinitions(structValue, typeField.Name, defs, reg.cfg); err != nil {
+			if err := reg.fail(fmt.Errorf("%s: %w", typeField.Name, err)); err != nil {
+				return err
 			}
-		default:
-			// return fmt.Errorf("%w: %v", ErrTypeNotSupported, field.Type())
 			continue
 		}
+		switch {
+		case isMetricType(field.Type()) && hasDefinition(defs, "register"):
+			// a collector built by the user, registered as it is
+			if err := reg.addPassthrough(structValue, typeField, field, path); err != nil {
+				if err := reg.fail(fmt.Errorf("%s: %w", typeField.Name, err)); err != nil {
+					return err
+				}
+			}
+		case isSeriesType(field.Type()) && !field.IsNil():
+			// keep what the user put there, like a fake in tests
+		case isMetricType(field.Type()):
+			if err := reg.addMetric(structValue, typeField.Name, field, defs, path); err != nil {
+				return err
+			}
+		case isMetricSlice(field.Type()) && hasDefinition(defs, "names"):
+			if err := reg.addSlice(structValue, typeField.Name, field, defs, path); err != nil {
+				if err := reg.fail(fmt.Errorf("%s: %w", typeField.Name, err)); err != nil {
+					return err
+				}
+			}
+		case isFuncMetricType(field.Type()) || (field.Type() == callbackType && hasTag(typeField, reg.cfg.tagKeys)):
+			if err := reg.addFunc(structValue, typeField, field, defs, path); err != nil {
+				if err := reg.fail(fmt.Errorf("%s: %w", typeField.Name, err)); err != nil {
+					return err
+				}
+			}
+		case hasDefinition(defs, "as"):
+			if err := reg.addScalar(structValue, typeField, field, defs, path); err != nil {
+				if err := reg.fail(fmt.Errorf("%s: %w", typeField.Name, err)); err != nil {
+					return err
+				}
+			}
+		case isNestedStruct(field) && !hasDefinition(defs, "register"):
+			if err := reg.addStruct(ctx, field, path+typeField.Name+"."); err != nil {
+				return fmt.Errorf("%s: %w", typeField.Name, err)
+			}
+		case isNestedStructPtr(field, reg.cfg.tagKeys) && !hasDefinition(defs, "register"):
+			if err := reg.addStructPtr(ctx, field, path+typeField.Name+"."); err != nil {
+				return fmt.Errorf("%s: %w", typeField.Name, err)
+			}
+		case hasDefinition(defs, "register"):
+			if err := reg.addPassthrough(structValue, typeField, field, path); err != nil {
+				if err := reg.fail(fmt.Errorf("%s: %w", typeField.Name, err)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// resolveDefinitions turns the desc, help_key and const_label_from
+// attributes of the field structFieldName of structValue into the
+// attributes they stand for and fills in the help the field gets by default.
+func resolveDefinitions(
+	structValue reflect.Value,
+	structFieldName string,
+	defs []stagparser.Definition,
+	cfg *config,
+) ([]stagparser.Definition, error) {
+	defs, err := resolveDesc(defs)
+	if err != nil {
+		return nil, err
+	}
+	if defs, err = resolveHelpKey(defs, cfg); err != nil {
+		return nil, err
+	}
+	defs = withSiblingHelp(structValue, structFieldName, defs)
+	if defs, err = resolveConstLabelFrom(structValue, defs); err != nil {
+		return nil, err
+	}
+	if cfg.autoHelp && !hasDefinition(defs, "help") {
+		defs = append(defs[:len(defs):len(defs)], newDefinition("help", humanize(structFieldName)))
+	}
+
+	return defs, nil
+}
+
+// addMetric builds the metric of field, named structFieldName in
+// structValue, from defs, stores it in field and registers it. Errors go
+// through reg.fail, so a nil error does not mean the field was built.
+func (reg *registration) addMetric(
+	structValue reflect.Value,
+	structFieldName string,
+	field reflect.Value,
+	defs []stagparser.Definition,
+	path string,
+) error {
+	collector, info, err := buildMetric(field.Type(), structFieldName, defs, reg.cfg)
+	if err != nil {
+		return reg.fail(fmt.Errorf("%s: %w", structFieldName, err))
+	}
+	if !reg.included(structFieldName, info.name) {
+		return nil
+	}
+
+	if err := validateMetricInfo(info, !isSeriesType(field.Type()), reg.cfg); err != nil {
+		return reg.fail(fmt.Errorf("%s: %w", structFieldName, err))
+	}
+
+	if info.initLabels != nil {
+		if err := initSeries(collector, info.initLabels); err != nil {
+			return reg.fail(fmt.Errorf("%s: %w: %v", structFieldName, ErrAttributeMalformed, err))
+		}
+	}
+
+	if reg.share(field, info) {
+		return nil
+	}
 
-		field.Set(reflect.ValueOf(collector))
-		if err := registry.Register(collector); err != nil {
-			return fmt.Errorf("collector register failed for %s: %w", typeField.Name, err)
+	info.field = path + structFieldName
+	if err := reg.claim(structValue.Type().Name()+"."+structFieldName, collector); err != nil {
+		return reg.fail(err)
+	}
+	reg.infos = append(reg.infos, info)
+
+	previous := snapshot(field)
+	value, _ := fieldValue(field.Type(), collector)
+	field.Set(value)
+	reg.report[info.name] = collector
+	if !reg.cfg.register {
+		reg.registered = append(reg.registered, registeredField{name: structFieldName, field: field, previous: previous})
+		reg.keepShared(info, collector)
+		return nil
+	}
+	if reg.cfg.maxCardinality > 0 {
+		collector = newCardinalityGuard(collector, info, reg.cfg.maxCardinality, reg.cfg.logger)
+	}
+	if reg.cfg.omitZero && info.kind == "histogram" {
+		collector = omitZeroCollector{collector}
+	}
+	registered, err := reg.register(structFieldName, collector)
+	if err != nil {
+		if existing, ok := reg.reusable(err, field.Type()); ok {
+			value, _ := fieldValue(field.Type(), existing)
+			field.Set(value)
+			reg.report[info.name] = existing
+			reg.registered = append(reg.registered, registeredField{name: structFieldName, field: field, previous: previous})
+			reg.keepShared(info, existing)
+			return nil
 		}
+		field.Set(previous)
+		delete(reg.report, info.name)
+		reg.infos = reg.infos[:len(reg.infos)-1]
+		return reg.fail(fmt.Errorf("collector register failed for %s: %w", structFieldName, err))
 	}
+	registered.name, registered.field, registered.previous = info.field, field, previous
+	reg.registered = append(reg.registered, registered)
+	reg.keepShared(info, unwrapCollector(collector))
 
 	return nil
 }
 
-func createPrometheusCounter(
+// included reports whether the WithMetricFilter filter, if any, keeps the
+// metric name built for the field.
+func (reg *registration) included(structFieldName, name string) bool {
+	return reg.cfg.metricFilter == nil || reg.cfg.metricFilter(structFieldName, name)
+}
+
+// buildMetric builds the collector of a field of fieldType, which must
+// satisfy isMetricType.
+func buildMetric(
+	fieldType reflect.Type,
 	structFieldName string,
 	defs []stagparser.Definition,
-) (*prometheus.CounterVec, error) {
-	name := strcase.ToSnake(structFieldName)
-	labels := []string{}
-	help := ""
+	cfg *config,
+) (prometheus.Collector, metricInfo, error) {
+	switch fieldType {
+	case prometheusCounterType:
+		collector, info, err := createPrometheusCounter(structFieldName, defs, cfg)
+		if err != nil {
+			return nil, metricInfo{}, fmt.Errorf("createPrometheusCounter failed: %w", err)
+		}
+		return collector, info, nil
+	case prometheusGaugeType:
+		collector, info, err := createPrometheusGauge(structFieldName, defs, cfg)
+		if err != nil {
+			return nil, metricInfo{}, fmt.Errorf("createPrometheusGauge failed: %w", err)
+		}
+		return collector, info, nil
+	case prometheusHistogramType:
+		collector, info, err := createPrometheusHistogram(structFieldName, defs, cfg)
+		if err != nil {
+			return nil, metricInfo{}, fmt.Errorf("createPrometheusHistogram failed: %w", err)
+		}
+		if info.sample != 1 {
+			return nil, metricInfo{}, fmt.Errorf("%w: sample requires a prometheus.ObserverVec or prometheus.Observer field", ErrTypeNotSupported)
+		}
+		return collector, info, nil
+	case prometheusObserverVecType:
+		collector, info, err := createPrometheusObserverVec(structFieldName, defs, cfg)
+		if err != nil {
+			return nil, metricInfo{}, fmt.Errorf("createPrometheusObserverVec failed: %w", err)
+		}
+		return sampleObservers(collector, info.sample), info, nil
+	case timerType:
+		// a timer times on the observer vec its tag describes
+		return buildMetric(prometheusObserverVecType, structFieldName, defs, cfg)
+	case prometheusSummaryType:
+		collector, info, err := createPrometheusSummary(structFieldName, defs, cfg)
+		if err != nil {
+			return nil, metricInfo{}, fmt.Errorf("createPrometheusSummary failed: %w", err)
+		}
+		if info.sample != 1 {
+			return nil, metricInfo{}, fmt.Errorf("%w: sample requires a prometheus.ObserverVec or prometheus.Observer field", ErrTypeNotSupported)
+		}
+		return collector, info, nil
+	}
+
+	if isSeriesType(fieldType) {
+		return buildSeriesMetric(fieldType, structFieldName, defs, cfg)
+	}
+
+	return nil, metricInfo{}, fmt.Errorf("%w: %v", ErrTypeNotSupported, fieldType)
+}
+
+// isNestedStruct reports whether field is a settable struct, embedded or
+// not, whose own fields are registered in place.
+func isNestedStruct(field reflect.Value) bool {
+	return field.Kind() == reflect.Struct && field.CanSet()
+}
+
+// isNestedStructPtr reports whether field is a settable pointer to a struct
+// declaring metrics, whose fields are registered like those of a nested
+// struct. A *Timer is a metric, not a nested struct.
+func isNestedStructPtr(field reflect.Value, tagKeys []string) bool {
+	return field.Kind() == reflect.Ptr && field.Type().Elem().Kind() == reflect.Struct &&
+		field.CanSet() && !isMetricType(field.Type()) && declaresMetrics(field.Type().Elem(), tagKeys, map[reflect.Type]bool{})
+}
+
+// declaresMetrics reports whether structType, or a struct nested in it, has
+// metric fields or tagged fields.
+func declaresMetrics(structType reflect.Type, tagKeys []string, seen map[reflect.Type]bool) bool {
+	if seen[structType] {
+		return false
+	}
+	seen[structType] = true
+
+	for i := 0; i < structType.NumField(); i++ {
+		typeField := structType.Field(i)
+		fieldType := typeField.Type
+		if isMetricType(fieldType) || isMetricSlice(fieldType) || hasTag(typeField, tagKeys) {
+			return true
+		}
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if fieldType.Kind() == reflect.Struct && declaresMetrics(fieldType, tagKeys, seen) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addStructPtr registers the fields of the struct field points to. A nil
+// field is set to a new struct first, set back to nil on rollback. Types
+// that reference themselves are registered at the first level only.
+func (reg *registration) addStructPtr(ctx context.Context, field reflect.Value, path string) error {
+	structType := field.Type().Elem()
+	if reg.visiting[structType] {
+		return nil
+	}
+	reg.visiting[structType] = true
+	defer delete(reg.visiting, structType)
+
+	if field.IsNil() || reg.copyPointers {
+		previous := snapshot(field)
+		ptr := reflect.New(structType)
+		if !field.IsNil() {
+			ptr.Elem().Set(field.Elem())
+		}
+		field.Set(ptr)
+		reg.registered = append(reg.registered, registeredField{name: path, field: field, previous: previous})
+	}
+
+	return reg.addStruct(ctx, field.Elem(), path)
+}
+
+// fieldEnabled decides whether a field is built at all and returns its
+// definitions without the skip and enabled attributes. A field is built
+// only when its tag has neither skip nor enabled=false and the WithEnabled
+// callback, if any, agrees: the callback can disable a field enabled in the
+// tag but cannot enable one the tag disables.
+func fieldEnabled(
+	structFieldName string,
+	defs []stagparser.Definition,
+	cfg *config,
+) (bool, []stagparser.Definition, error) {
+	enabled := true
+	rest := make([]stagparser.Definition, 0, len(defs))
 	for _, def := range defs {
-		attrs := def.Attributes()
 		switch attrName := def.Name(); attrName {
-		case "name":
-			if nameString, ok := attrs[attrName].(string); ok {
-				name = nameString
-			} else {
-				return nil, fmt.Errorf("%w: name is not a string", ErrAttributeMalformed)
-			}
-		case "labels":
-			if labelSliceOfAny, ok := attrs[attrName].([]interface{}); ok {
-				for _, labelInterface := range labelSliceOfAny {
-					if labelString, ok := labelInterface.(string); ok {
-						labels = append(labels, labelString)
-					} else {
-						return nil, fmt.Errorf("%w: label is not a string", ErrAttributeMalformed)
-					}
-				}
-			} else {
-				return nil, fmt.Errorf("%w: labels is not a list", ErrAttributeMalformed)
-			}
-		case "help":
-			if helpString, ok := attrs[attrName].(string); ok {
-				help = helpString
-			} else {
-				return nil, fmt.Errorf("%w: help is not a string", ErrAttributeMalformed)
+		case "skip":
+			enabled = false
+		case "enabled":
+			value, err := toBool(def.Attributes()[attrName])
+			if err != nil {
+				return false, nil, fmt.Errorf("%w: enabled: %v", ErrAttributeMalformed, err)
 			}
+			enabled = enabled && value
 		default:
-			return nil, fmt.Errorf("%w: unsupported attribute %s", ErrAttributeMalformed, attrName)
+			rest = append(rest, def)
 		}
 	}
 
-	return prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels), nil
+	if enabled && cfg.enabled != nil {
+		enabled = cfg.enabled(structFieldName)
+	}
+
+	return enabled, rest, nil
 }
 
-func createPrometheusHistogram(
+// withSiblingHelp adds a help definition taken from the string field named
+// <structFieldName>Help when the tag itself does not set help.
+func withSiblingHelp(
+	structValue reflect.Value,
 	structFieldName string,
 	defs []stagparser.Definition,
-) (*prometheus.HistogramVec, error) {
-	opt := prometheus.HistogramOpts{
-		Name:    strcase.ToSnake(structFieldName),
-		Help:    "",
-		Buckets: []float64{0.001, 0.01, 0.05, 0.1, 0.2, 0.3, 0.5, 1.0, 2.0, 10, 20},
+) []stagparser.Definition {
+	if hasDefinition(defs, "help") {
+		return defs
+	}
+
+	sibling := structValue.FieldByName(structFieldName + "Help")
+	if !sibling.IsValid() || sibling.Kind() != reflect.String || sibling.String() == "" {
+		return defs
+	}
+
+	withHelp := make([]stagparser.Definition, 0, len(defs)+1)
+	withHelp = append(withHelp, defs...)
+	return append(withHelp, newDefinition("help", sibling.String()))
+}
+
+// resolveDesc replaces the desc attribute, an alias of help for field
+// descriptions, with help set to the description trimmed and ending with a
+// period. Setting both desc and help is an error.
+func resolveDesc(defs []stagparser.Definition) ([]stagparser.Definition, error) {
+	desc, ok, err := StringAttr(defs, "desc")
+	if err != nil || !ok {
+		return defs, err
 	}
-	labels := []string{}
+	if hasDefinition(defs, "help") {
+		return nil, fmt.Errorf("%w: desc and help cannot both be set", ErrAttributeMalformed)
+	}
+
+	desc = strings.TrimSpace(desc)
+	if desc != "" && !strings.HasSuffix(desc, ".") {
+		desc += "."
+	}
+
+	resolved := make([]stagparser.Definition, 0, len(defs))
 	for _, def := range defs {
-		attrs := def.Attributes()
-		switch attrName := def.Name(); attrName {
-		case "name":
-			if nameString, ok := attrs[attrName].(string); ok {
-				opt.Name = nameString
-			} else {
-				return nil, fmt.Errorf("%w: name is not a string", ErrAttributeMalformed)
-			}
-		case "labels":
-			if labelSliceOfAny, ok := attrs[attrName].([]interface{}); ok {
-				for _, labelInterface := range labelSliceOfAny {
-					if labelString, ok := labelInterface.(string); ok {
-						labels = append(labels, labelString)
-					} else {
-						return nil, fmt.Errorf("%w: label is not a string", ErrAttributeMalformed)
-					}
+		if def.Name() != "desc" {
+			resolved = append(resolved, def)
+		}
+	}
+
+	return append(resolved, newDefinition("help", desc)), nil
+}
+
+// resolveHelpKey replaces the help_key attribute with the help text the
+// WithHelpResolver resolver finds for the key. An unresolved key leaves any
+// help the field already has as the fallback.
+func resolveHelpKey(defs []stagparser.Definition, cfg *config) ([]stagparser.Definition, error) {
+	if !hasDefinition(defs, "help_key") {
+		return defs, nil
+	}
+
+	var key string
+	rest := make([]stagparser.Definition, 0, len(defs))
+	for _, def := range defs {
+		if def.Name() != "help_key" {
+			rest = append(rest, def)
+			continue
+		}
+		keyString, ok := def.Attributes()["help_key"].(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: help_key is not a string", ErrAttributeMalformed)
+		}
+		key = keyString
+	}
+
+	if cfg.helpResolver == nil {
+		return rest, nil
+	}
+	help, ok := cfg.helpResolver(key)
+	if !ok {
+		return rest, nil
+	}
+
+	resolved := make([]stagparser.Definition, 0, len(rest)+1)
+	for _, def := range rest {
+		if def.Name() != "help" {
+			resolved = append(resolved, def)
+		}
+	}
+
+	return append(resolved, newDefinition("help", help)), nil
+}
+
+func hasDefinition(defs []stagparser.Definition, name string) bool {
+	for _, def := range defs {
+		if def.Name() == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// humanize turns a field name like SecondsFromStart into "Seconds from start".
+func humanize(structFieldName string) string {
+	words := strcase.ToDelimited(structFieldName, ' ')
+	if words == "" {
+		return ""
+	}
+
+	return strings.ToUpper(words[:1]) + words[1:]
+}
+
+// definition is a stagparser.Definition synthesized from something other
+// than the struct tag.
+type definition struct {
+	name  string
+	value interface{}
+}
+
+func newDefinition(name string, value interface{}) stagparser.Definition {
+	return definition{name: name, value: value}
+}
+
+func (d definition) Name() string {
+	return d.name
+}
+
+func (d definition) Attributes() map[string]interface{} {
+	return map[string]interface{}{d.name: d.value}
+}
+
+func (d definition) Attribute(name string) (interface{}, bool) {
+	if name != d.name {
+		return nil, false
+	}
+	return d.value, true
+}
+
+// metricInfo describes the metric a builder produced.
+type metricInfo struct {
+	field      string
+	name       string
+	kind       string
+	help       string
+	labels     []string
+	initLabels prometheus.Labels
+	// allowed maps labels declared like status{2xx,5xx} to their values.
+	allowed map[string][]string
+	buckets []float64
+	// nativeFactor is the native bucket factor of histograms, zero for
+	// classic ones.
+	nativeFactor float64
+	objectives   map[float64]float64
+	constLabels  prometheus.Labels
+	// sample is the rate histogram and summary observations are sampled
+	// at, 1 unless set.
+	sample float64
+	// unit is the unit attribute, already a suffix of name.
+	unit string
+}
+
+// registeredField is a collector registered by misery under the field name
+// name, prefixed with the path of nested structs. field is the zero Value
+// for collectors misery did not put into their field; previous is a copy of
+// what field held before, restored on rollback. A collector swapped into a
+// replaceable registered before is recorded as replaced instead, together
+// with the collector it swapped out.
+type registeredField struct {
+	name              string
+	field             reflect.Value
+	previous          reflect.Value
+	collector         prometheus.Collector
+	replaced          *replaceable
+	replacedCollector prometheus.Collector
+}
+
+// current returns the collector r registered, nil if none.
+func (r registeredField) current() prometheus.Collector {
+	if r.replaced != nil {
+		return r.replaced.unwrap()
+	}
+
+	return r.collector
+}
+
+// snapshot returns a copy of the current value of field.
+func snapshot(field reflect.Value) reflect.Value {
+	previous := reflect.New(field.Type()).Elem()
+	previous.Set(field)
+
+	return previous
+}
+
+// defaultMetricName derives the metric name for fields whose tag has no name
+// attribute: the snake cased field name without the WithNameTrimPrefix
+// prefix. Namespace and subsystem, if any, are added on top of it.
+func defaultMetricName(structFieldName string, cfg *config) string {
+	name := strcase.ToSnake(structFieldName)
+	if cfg.nameTrimPrefix == "" {
+		return name
+	}
+
+	prefix := strings.TrimSuffix(strcase.ToSnake(cfg.nameTrimPrefix), "_") + "_"
+	if trimmed := strings.TrimPrefix(name, prefix); trimmed != "" {
+		return trimmed
+	}
+
+	return name
+}
+
+// parseLabels converts the labels attribute into label names. The names keep
+// the exact order of the labels=[...] list in the tag: stagparser returns
+// list elements in source order, and nothing here sorts them, so
+// WithLabelValues and curried vecs see the order the user wrote. A repeated
+// label is an error, or is dropped under WithDedupLabels, keeping the first
+// occurrence.
+//
+// The map form labels={thread=main, region=us} declares the label names in
+// the same way and also returns the values as the series to create up front.
+//
+// A list element like status{2xx,4xx,5xx} declares the label status and
+// restricts it to the listed values, returned per label name; other values
+// are recorded as otherLabelValue.
+func parseLabels(value interface{}, cfg *config) ([]string, prometheus.Labels, map[string][]string, error) {
+	if expr, ok := value.(string); ok && strings.HasPrefix(expr, "{") {
+		pairs, err := parseMap(expr)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		labels := make([]string, 0, len(pairs))
+		initLabels := make(prometheus.Labels, len(pairs))
+		for _, pair := range pairs {
+			if _, seen := initLabels[pair.key]; seen {
+				if cfg.dedupLabels {
+					continue
 				}
-			} else {
-				return nil, fmt.Errorf("%w: labels is not a list", ErrAttributeMalformed)
+				return nil, nil, nil, fmt.Errorf("%w: label %s is repeated", ErrAttributeMalformed, pair.key)
 			}
-		case "help":
-			if helpString, ok := attrs[attrName].(string); ok {
-				opt.Help = helpString
-			} else {
-				return nil, fmt.Errorf("%w: help is not a string", ErrAttributeMalformed)
-			}
-		case "buckets":
-			if bucketSliceOfFAny, ok := attrs[attrName].([]interface{}); ok {
-				opt.Buckets = make([]float64, 0, len(bucketSliceOfFAny))
-				for _, bucketInterface := range bucketSliceOfFAny {
-					switch b := bucketInterface.(type) {
-					case float64:
-						opt.Buckets = append(opt.Buckets, b)
-					case int32:
-						opt.Buckets = append(opt.Buckets, float64(b))
-					case int64:
-						opt.Buckets = append(opt.Buckets, float64(b))
-					default:
-						return nil, fmt.Errorf("%w: bucket is not a float64 %T %v", ErrAttributeMalformed, b, b)
-					}
+			labels = append(labels, pair.key)
+			initLabels[pair.key] = pair.value
+		}
+		return labels, initLabels, nil, nil
+	}
+
+	labelSliceOfAny, ok := value.([]interface{})
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("%w: labels is not a list", ErrAttributeMalformed)
+	}
+
+	labels := make([]string, 0, len(labelSliceOfAny))
+	seen := make(map[string]bool, len(labelSliceOfAny))
+	var allowed map[string][]string
+	for _, labelInterface := range labelSliceOfAny {
+		labelString, ok := labelInterface.(string)
+		if !ok {
+			return nil, nil, nil, fmt.Errorf("%w: label is not a string", ErrAttributeMalformed)
+		}
+		label, values, err := parseLabelEnum(labelString)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if seen[label] {
+			if cfg.dedupLabels {
+				continue
+			}
+			return nil, nil, nil, fmt.Errorf("%w: label %s is repeated", ErrAttributeMalformed, label)
+		}
+		seen[label] = true
+		if values != nil {
+			if allowed == nil {
+				allowed = map[string][]string{}
+			}
+			allowed[label] = values
+		}
+		labels = append(labels, label)
+	}
+
+	return labels, nil, allowed, nil
+}
+
+// parseLabelEnum splits a label declared as status{2xx,4xx,5xx} into its
+// name and allowed values. values is nil for a plain label name.
+func parseLabelEnum(label string) (name string, values []string, err error) {
+	open := strings.IndexByte(label, '{')
+	if open < 0 {
+		return label, nil, nil
+	}
+	if open == 0 || !strings.HasSuffix(label, "}") {
+		return "", nil, fmt.Errorf("%w: label %q is not name{value,...}", ErrAttributeMalformed, label)
+	}
+
+	body := strings.TrimSpace(label[open+1 : len(label)-1])
+	if body == "" {
+		return "", nil, fmt.Errorf("%w: label %q allows no values", ErrAttributeMalformed, label)
+	}
+	for _, part := range splitTopLevel(body, ',') {
+		value, err := unquote(part)
+		if err != nil {
+			return "", nil, err
+		}
+		values = append(values, value)
+	}
+
+	return label[:open], values, nil
+}
+
+// otherLabelValue replaces the values a label declared with allowed values
+// does not allow.
+const otherLabelValue = "other"
+
+// constrainLabels returns the variable labels of a vec, mapping values
+// outside the allowed set of a label to otherLabelValue.
+func constrainLabels(labels []string, allowed map[string][]string) prometheus.ConstrainableLabels {
+	if len(allowed) == 0 {
+		return prometheus.UnconstrainedLabels(labels)
+	}
+
+	constrained := make(prometheus.ConstrainedLabels, 0, len(labels))
+	for _, label := range labels {
+		values, ok := allowed[label]
+		if !ok {
+			constrained = append(constrained, prometheus.ConstrainedLabel{Name: label})
+			continue
+		}
+		set := make(map[string]bool, len(values))
+		for _, value := range values {
+			set[value] = true
+		}
+		constrained = append(constrained, prometheus.ConstrainedLabel{
+			Name: label,
+			Constraint: func(value string) string {
+				if set[value] {
+					return value
 				}
+				return otherLabelValue
+			},
+		})
+	}
+
+	return constrained
+}
+
+// initSeries creates the series selected by labels on a freshly built vec so
+// that it is exposed with zero values before the first use.
+func initSeries(collector prometheus.Collector, labels prometheus.Labels) error {
+	var err error
+	switch vec := collector.(type) {
+	case *prometheus.CounterVec:
+		_, err = vec.GetMetricWith(labels)
+	case *prometheus.GaugeVec:
+		_, err = vec.GetMetricWith(labels)
+	case prometheus.ObserverVec:
+		_, err = vec.GetMetricWith(labels)
+	}
+
+	return err
+}
+
+func createPrometheusCounter(
+	structFieldName string,
+	defs []stagparser.Definition,
+	cfg *config,
+) (*prometheus.CounterVec, metricInfo, error) {
+	if err := checkAttributes("counter", defs); err != nil {
+		return nil, metricInfo{}, err
+	}
+
+	attrs, err := parseVecAttrs(structFieldName, defs, cfg)
+	if err != nil {
+		return nil, metricInfo{}, err
+	}
+
+	vec := prometheus.V2.NewCounterVec(prometheus.CounterVecOpts{
+		CounterOpts:    prometheus.CounterOpts{Name: attrs.name, Help: attrs.help, ConstLabels: attrs.constLabels},
+		VariableLabels: constrainLabels(attrs.labels, attrs.allowed),
+	})
+	if err := addInitValue(vec, attrs, defs); err != nil {
+		return nil, metricInfo{}, err
+	}
+
+	return vec, attrs.info("counter"), nil
+}
+
+// addInitValue adds the init_value attribute, if any, to the series of a
+// counter vec without labels or to the one selected by labels given as a
+// map, so a restarted process can resume counting where it stopped.
+func addInitValue(vec *prometheus.CounterVec, attrs vecAttrs, defs []stagparser.Definition) error {
+	value, ok, err := FloatAttr(defs, "init_value")
+	if !ok {
+		return nil
+	}
+	if err != nil || value < 0 {
+		return fmt.Errorf("%w: init_value must be a number not less than 0", ErrAttributeMalformed)
+	}
+	if len(attrs.labels) > 0 && attrs.initLabels == nil {
+		return fmt.Errorf("%w: init_value requires labels given as a map like {a=b}", ErrAttributeMalformed)
+	}
+
+	counter, err := vec.GetMetricWith(attrs.initLabels)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrAttributeMalformed, err)
+	}
+	counter.Add(value)
+
+	return nil
+}
+
+func createPrometheusGauge(
+	structFieldName string,
+	defs []stagparser.Definition,
+	cfg *config,
+) (*prometheus.GaugeVec, metricInfo, error) {
+	if err := checkAttributes("gauge", defs); err != nil {
+		return nil, metricInfo{}, err
+	}
+
+	attrs, err := parseVecAttrs(structFieldName, defs, cfg)
+	if err != nil {
+		return nil, metricInfo{}, err
+	}
+
+	return prometheus.V2.NewGaugeVec(prometheus.GaugeVecOpts{
+		GaugeOpts:      prometheus.GaugeOpts{Name: attrs.name, Help: attrs.help, ConstLabels: attrs.constLabels},
+		VariableLabels: constrainLabels(attrs.labels, attrs.allowed),
+	}), attrs.info("gauge"), nil
+}
+
+// bucketUnits maps the units bucket_unit accepts to the number of them in a
+// second, the unit buckets are built in.
+var bucketUnits = map[string]float64{
+	"s":  1,
+	"ms": 1e3,
+	"us": 1e6,
+	"ns": 1e9,
+}
+
+// defaultHistogramBuckets are the buckets of histograms that set none.
+var defaultHistogramBuckets = []float64{0.001, 0.01, 0.05, 0.1, 0.2, 0.3, 0.5, 1.0, 2.0, 10, 20}
+
+// histogramBuckets returns a copy of the buckets of histograms that set
+// none: those of WithDefaultBuckets or defaultHistogramBuckets.
+func (cfg *config) histogramBuckets() []float64 {
+	if cfg.defaultBuckets != nil {
+		return append([]float64(nil), cfg.defaultBuckets...)
+	}
+
+	return append([]float64(nil), defaultHistogramBuckets...)
+}
+
+// createPrometheusHistogram builds a histogram vec from the tag attributes.
+// With native_factor the histogram also keeps native buckets; classic
+// buckets, the default ones included, stay in place, so the histogram is
+// exposed in both forms, which is how client_golang supports migrating
+// scrapers from classic to native histograms.
+func createPrometheusHistogram(
+	structFieldName string,
+	defs []stagparser.Definition,
+	cfg *config,
+) (*prometheus.HistogramVec, metricInfo, error) {
+	if err := checkAttributes("histogram", defs); err != nil {
+		return nil, metricInfo{}, err
+	}
+
+	attrs, err := parseVecAttrs(structFieldName, defs, cfg)
+	if err != nil {
+		return nil, metricInfo{}, err
+	}
+	opt := prometheus.HistogramOpts{
+		Name:        attrs.name,
+		Help:        attrs.help,
+		ConstLabels: attrs.constLabels,
+		Buckets:     cfg.histogramBuckets(),
+	}
+
+	bucketsSet, bucketLiterals := false, false
+	if value, ok := attrValue(defs, "buckets"); ok {
+		bucketsSet = true
+		if expr, ok := value.(string); ok {
+			buckets, found, err := resolveBucketExpr(expr, cfg)
+			if err != nil {
+				return nil, metricInfo{}, err
+			}
+			if found {
+				opt.Buckets = buckets
 			} else {
-				return nil, fmt.Errorf("%w: buckets is not a list of floats", ErrAttributeMalformed)
+				bucketsSet = false
+				cfg.logger.Printf("misery: %s: %s is not set, using default buckets", structFieldName, expr)
 			}
+		} else if opt.Buckets, _, err = BucketsAttr(defs, "buckets"); err != nil {
+			return nil, metricInfo{}, err
+		} else {
+			bucketLiterals = bucketsCarryUnit(defs, "buckets")
+		}
+	}
+	bucketUnit := 1.0
+	if unitString, ok, err := StringAttr(defs, "bucket_unit"); err != nil {
+		return nil, metricInfo{}, err
+	} else if ok {
+		if bucketUnit, ok = bucketUnits[unitString]; !ok {
+			return nil, metricInfo{}, fmt.Errorf("%w: unknown bucket_unit %s", ErrAttributeMalformed, unitString)
+		}
+		if bucketLiterals {
+			return nil, metricInfo{}, fmt.Errorf("%w: bucket_unit with buckets that carry their unit", ErrAttributeMalformed)
+		}
+	}
+	if factor, ok, err := FloatAttr(defs, "native_factor"); ok {
+		if err != nil || factor <= 1 {
+			return nil, metricInfo{}, fmt.Errorf("%w: native_factor must be a number greater than 1", ErrAttributeMalformed)
+		}
+		opt.NativeHistogramBucketFactor = factor
+	}
+	if value, ok := attrValue(defs, "native_max_buckets"); ok {
+		maxBuckets, ok := value.(int64)
+		if !ok || maxBuckets <= 0 || maxBuckets > math.MaxUint32 {
+			return nil, metricInfo{}, fmt.Errorf("%w: native_max_buckets must be a positive integer", ErrAttributeMalformed)
+		}
+		opt.NativeHistogramMaxBucketNumber = uint32(maxBuckets)
+	}
+	if durationString, ok, err := StringAttr(defs, "native_min_reset_duration"); ok {
+		if err != nil {
+			return nil, metricInfo{}, fmt.Errorf("%w: native_min_reset_duration is not a duration", ErrAttributeMalformed)
+		}
+		duration, err := time.ParseDuration(durationString)
+		if err != nil || duration < 0 {
+			return nil, metricInfo{}, fmt.Errorf("%w: native_min_reset_duration %q is not a duration", ErrAttributeMalformed, durationString)
+		}
+		opt.NativeHistogramMinResetDuration = duration
+	}
+
+	if bucketsSet {
+		for i := range opt.Buckets {
+			opt.Buckets[i] /= bucketUnit
+		}
+	}
+	if cfg.bucketFunc != nil && !bucketsSet {
+		if buckets := cfg.bucketFunc(structFieldName); buckets != nil {
+			opt.Buckets = buckets
+		}
+	}
+	if err := validateBuckets(opt.Buckets); err != nil {
+		return nil, metricInfo{}, err
+	}
+	if cfg.maxBuckets > 0 && len(opt.Buckets) > cfg.maxBuckets {
+		return nil, metricInfo{}, fmt.Errorf("%w: %d buckets, more than the limit of %d",
+			ErrAttributeMalformed, len(opt.Buckets), cfg.maxBuckets)
+	}
+	if opt.NativeHistogramBucketFactor == 0 &&
+		(opt.NativeHistogramMaxBucketNumber != 0 || opt.NativeHistogramMinResetDuration != 0) {
+		err := fmt.Errorf("%w: native_max_buckets and native_min_reset_duration require native_factor", ErrAttributeMalformed)
+		if cfg.strict {
+			return nil, metricInfo{}, err
+		}
+		cfg.logger.Printf("misery: %s: %v, they have no effect", structFieldName, err)
+	}
+	if err := rejectLabel(attrs.labels, "le"); err != nil {
+		return nil, metricInfo{}, err
+	}
+
+	info := attrs.info("histogram")
+	info.buckets = opt.Buckets
+	info.nativeFactor = opt.NativeHistogramBucketFactor
+	if info.sample, err = sampleAttr(defs); err != nil {
+		return nil, metricInfo{}, err
+	}
+	return prometheus.V2.NewHistogramVec(prometheus.HistogramVecOpts{
+		HistogramOpts:  opt,
+		VariableLabels: constrainLabels(attrs.labels, attrs.allowed),
+	}), info, nil
+}
+
+// createPrometheusObserverVec builds the prometheus.ObserverVec field
+// implementation named by the type attribute, histogram (the default) or
+// summary, from the remaining attributes.
+func createPrometheusObserverVec(
+	structFieldName string,
+	defs []stagparser.Definition,
+	cfg *config,
+) (prometheus.ObserverVec, metricInfo, error) {
+	kind, defs, err := takeType(defs, "histogram")
+	if err != nil {
+		return nil, metricInfo{}, err
+	}
+
+	switch kind {
+	case "histogram":
+		return createPrometheusHistogram(structFieldName, defs, cfg)
+	case "summary":
+		return createPrometheusSummary(structFieldName, defs, cfg)
+	default:
+		return nil, metricInfo{}, fmt.Errorf("%w: type %s is not histogram or summary", ErrAttributeMalformed, kind)
+	}
+}
+
+// takeType returns the value of the type attribute, or fallback when there
+// is none, and the definitions without it.
+func takeType(defs []stagparser.Definition, fallback string) (string, []stagparser.Definition, error) {
+	kind, ok, err := StringAttr(defs, "type")
+	if err != nil {
+		return "", nil, err
+	}
+	if !ok {
+		kind = fallback
+	}
+
+	rest := make([]stagparser.Definition, 0, len(defs))
+	for _, def := range defs {
+		if def.Name() != "type" {
+			rest = append(rest, def)
+		}
+	}
+
+	return kind, rest, nil
+}
+
+func createPrometheusSummary(
+	structFieldName string,
+	defs []stagparser.Definition,
+	cfg *config,
+) (*prometheus.SummaryVec, metricInfo, error) {
+	if err := checkAttributes("summary", defs); err != nil {
+		return nil, metricInfo{}, err
+	}
+
+	attrs, err := parseVecAttrs(structFieldName, defs, cfg)
+	if err != nil {
+		return nil, metricInfo{}, err
+	}
+	opt := prometheus.SummaryOpts{Name: attrs.name, Help: attrs.help, ConstLabels: attrs.constLabels}
+	if value, ok := attrValue(defs, "objectives"); ok {
+		switch value := value.(type) {
+		case string:
+			opt.Objectives, err = resolveObjectives(value, cfg)
+		case map[float64]float64:
+			// set by SummaryBuilder.Objectives
+			opt.Objectives, err = value, checkObjectives(value)
 		default:
-			return nil, fmt.Errorf("%w: unsupported attribute %s", ErrAttributeMalformed, attrName)
+			err = fmt.Errorf("%w: objectives is not a map or a preset", ErrAttributeMalformed)
+		}
+		if err != nil {
+			return nil, metricInfo{}, err
 		}
 	}
 
-	return prometheus.NewHistogramVec(opt, labels), nil
+	if err := rejectLabel(attrs.labels, "quantile"); err != nil {
+		return nil, metricInfo{}, err
+	}
+
+	info := attrs.info("summary")
+	info.objectives = opt.Objectives
+	if info.sample, err = sampleAttr(defs); err != nil {
+		return nil, metricInfo{}, err
+	}
+	return prometheus.V2.NewSummaryVec(prometheus.SummaryVecOpts{
+		SummaryOpts:    opt,
+		VariableLabels: constrainLabels(attrs.labels, attrs.allowed),
+	}), info, nil
 }
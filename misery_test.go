@@ -0,0 +1,1935 @@
+package misery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/yuin/stagparser"
+)
+
+func TestReplaceExisting(t *testing.T) {
+	type before struct {
+		Reloads *prometheus.CounterVec `misery:"name=reloads_total,help='Old help',labels=[source]"`
+	}
+	type after struct {
+		Reloads *prometheus.CounterVec `misery:"name=reloads_total,help='New help',labels=[source,status]"`
+	}
+
+	registry := prometheus.NewRegistry()
+	old := &before{}
+	if err := RegisterMetricsWithOptions(old, registry, WithReplaceExisting(true)); err != nil {
+		t.Fatalf("first registration: %v", err)
+	}
+	old.Reloads.WithLabelValues("file").Inc()
+
+	reloaded := &after{}
+	if err := RegisterMetricsWithOptions(reloaded, registry, WithReplaceExisting(true)); err != nil {
+		t.Fatalf("replacing registration: %v", err)
+	}
+	reloaded.Reloads.WithLabelValues("file", "ok").Add(2)
+
+	want := `
+# HELP reloads_total New help
+# TYPE reloads_total counter
+reloads_total{source="file",status="ok"} 2
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want), "reloads_total"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UnregisterMetrics(reloaded, registry); err != nil {
+		t.Fatalf("unregister: %v", err)
+	}
+	if n := testutil.CollectAndCount(registry); n != 0 {
+		t.Fatalf("%d metrics left after unregister", n)
+	}
+}
+
+func TestReplaceExistingWithoutOption(t *testing.T) {
+	type before struct {
+		Reloads *prometheus.CounterVec `misery:"name=reloads_total,help='Old help'"`
+	}
+	type after struct {
+		Reloads *prometheus.CounterVec `misery:"name=reloads_total,help='New help'"`
+	}
+
+	registry := prometheus.NewRegistry()
+	if err := RegisterMetrics(&before{}, registry); err != nil {
+		t.Fatalf("first registration: %v", err)
+	}
+	if err := RegisterMetricsWithOptions(&after{}, registry, WithReplaceExisting(true)); err == nil {
+		t.Fatal("replaced a metric registered without WithReplaceExisting")
+	}
+}
+
+func TestReplaceExistingRollback(t *testing.T) {
+	type before struct {
+		Reloads *prometheus.CounterVec `misery:"name=reloads_total,help='Old help'"`
+	}
+	type after struct {
+		Reloads *prometheus.CounterVec `misery:"name=reloads_total,help='New help'"`
+		Broken  *prometheus.CounterVec `misery:"name=broken-name"`
+	}
+
+	registry := prometheus.NewRegistry()
+	old := &before{}
+	if err := RegisterMetricsWithOptions(old, registry, WithReplaceExisting(true)); err != nil {
+		t.Fatalf("first registration: %v", err)
+	}
+	old.Reloads.WithLabelValues().Inc()
+	if err := RegisterMetricsWithOptions(&after{}, registry, WithReplaceExisting(true)); err == nil {
+		t.Fatal("registered a malformed metric name")
+	}
+
+	want := `
+# HELP reloads_total Old help
+# TYPE reloads_total counter
+reloads_total 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want), "reloads_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegisterMetricsCtx(t *testing.T) {
+	type nested struct {
+		Inner *prometheus.CounterVec `misery:"name=inner_total"`
+	}
+	type stat struct {
+		First  *prometheus.CounterVec `misery:"name=first_total"`
+		Second *prometheus.CounterVec `misery:"name=second_total"`
+		Nested *nested
+		Third  *prometheus.CounterVec `misery:"name=third_total"`
+	}
+
+	tests := []struct {
+		name     string
+		canceled bool
+		cancelAt string
+		wantErr  bool
+	}{
+		{name: "not canceled"},
+		{name: "canceled before the call", canceled: true, wantErr: true},
+		// the context is checked before each field, so Second is still
+		// registered and the call aborts at Nested
+		{name: "canceled mid-way", cancelAt: "Second", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.canceled {
+				cancel()
+			}
+			ctx = ContextWithOptions(ctx, WithEnabled(func(field string) bool {
+				if field == tt.cancelAt {
+					cancel()
+				}
+				return true
+			}))
+
+			registry := prometheus.NewRegistry()
+			previous := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "previous_total"}, nil)
+			s := &stat{First: previous}
+			err := RegisterMetricsCtx(ctx, s, registry)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("RegisterMetricsCtx: %v", err)
+				}
+				s.First.WithLabelValues().Inc()
+				s.Second.WithLabelValues().Inc()
+				s.Nested.Inner.WithLabelValues().Inc()
+				s.Third.WithLabelValues().Inc()
+				if n := testutil.CollectAndCount(registry); n != 4 {
+					t.Fatalf("%d metrics registered, want 4", n)
+				}
+				return
+			}
+
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("got error %v, want one wrapping context.Canceled", err)
+			}
+			if n := testutil.CollectAndCount(registry); n != 0 {
+				t.Fatalf("%d metrics left registered after cancellation", n)
+			}
+			if s.First != previous {
+				t.Error("First was not restored to the value it held before")
+			}
+			if s.Second != nil || s.Nested != nil || s.Third != nil {
+				t.Errorf("fields set after cancellation: %+v", s)
+			}
+		})
+	}
+}
+
+func TestRegisterMetricsCtxReplaceExisting(t *testing.T) {
+	type stat struct {
+		Reloads *prometheus.CounterVec `misery:"name=reloads_total,help='Reloads.'"`
+		Other   *prometheus.CounterVec `misery:"name=other_total"`
+	}
+
+	registry := prometheus.NewRegistry()
+	old := &stat{}
+	if err := RegisterMetricsWithOptions(old, registry, WithReplaceExisting(true)); err != nil {
+		t.Fatalf("first registration: %v", err)
+	}
+	old.Reloads.WithLabelValues().Inc()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = ContextWithOptions(ctx, WithReplaceExisting(true), WithEnabled(func(field string) bool {
+		if field == "Reloads" {
+			cancel()
+		}
+		return true
+	}))
+	if err := RegisterMetricsCtx(ctx, &stat{}, registry); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want one wrapping context.Canceled", err)
+	}
+
+	want := `
+# HELP reloads_total Reloads.
+# TYPE reloads_total counter
+reloads_total 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want), "reloads_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// errAny stands for any error in test tables.
+var errAny = errors.New("any error")
+
+// parseTestTag parses tag the way struct tags are parsed.
+func parseTestTag(t *testing.T, tag string) []stagparser.Definition {
+	t.Helper()
+
+	defs, err := stagparser.ParseTag(quoteExpressions(tag), t.Name())
+	if err != nil {
+		t.Fatalf("parse %q: %v", tag, err)
+	}
+
+	return defs
+}
+
+// recordLogger is a Logger keeping what it is given.
+type recordLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *recordLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func (l *recordLogger) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return strings.Join(l.lines, "\n")
+}
+
+// gatherFamily gathers g and returns the family named name, nil when there
+// is none.
+func gatherFamily(t *testing.T, g prometheus.Gatherer, name string) *dto.MetricFamily {
+	t.Helper()
+
+	families, err := g.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() == name {
+			return family
+		}
+	}
+
+	return nil
+}
+
+func TestSiblingHelp(t *testing.T) {
+	type stat struct {
+		Jobs       *prometheus.CounterVec `misery:"name=jobs_total"`
+		JobsHelp   string
+		Tagged     *prometheus.CounterVec `misery:"name=tagged_total,help=Tagged."`
+		TaggedHelp string
+		Empty      *prometheus.CounterVec `misery:"name=empty_total"`
+		EmptyHelp  string
+		Typed      *prometheus.CounterVec `misery:"name=typed_total"`
+		TypedHelp  int
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{JobsHelp: "Jobs run.", TaggedHelp: "Ignored.", TypedHelp: 1}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	s.Jobs.WithLabelValues().Inc()
+	s.Tagged.WithLabelValues().Inc()
+	s.Empty.WithLabelValues().Inc()
+	s.Typed.WithLabelValues().Inc()
+
+	tests := []struct {
+		name string
+		help string
+	}{
+		{name: "jobs_total", help: "Jobs run."},
+		{name: "tagged_total", help: "Tagged."},
+		{name: "empty_total", help: ""},
+		{name: "typed_total", help: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			family := gatherFamily(t, registry, tt.name)
+			if family == nil {
+				t.Fatalf("%s not scraped", tt.name)
+			}
+			if family.GetHelp() != tt.help {
+				t.Errorf("help %q, want %q", family.GetHelp(), tt.help)
+			}
+		})
+	}
+}
+
+func TestWithRegisterFalse(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,labels=[code]"`
+		Inflight prometheus.Gauge       `misery:"name=inflight"`
+		Latency  prometheus.ObserverVec `misery:"name=latency_seconds,type=summary"`
+	}
+
+	tests := []struct {
+		name     string
+		register func(s *stat, registry *prometheus.Registry) error
+	}{
+		{
+			name: "WithRegister(false)",
+			register: func(s *stat, registry *prometheus.Registry) error {
+				return RegisterMetricsWithOptions(s, registry, WithRegister(false))
+			},
+		},
+		{
+			name: "BuildMetrics",
+			register: func(s *stat, _ *prometheus.Registry) error {
+				return BuildMetrics(s)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			s := &stat{}
+			if err := tt.register(s, registry); err != nil {
+				t.Fatalf("register: %v", err)
+			}
+			if s.Requests == nil || s.Inflight == nil || s.Latency == nil {
+				t.Fatalf("fields left nil: %+v", s)
+			}
+			s.Requests.WithLabelValues("200").Inc()
+			if n := testutil.CollectAndCount(registry); n != 0 {
+				t.Fatalf("%d metrics registered", n)
+			}
+
+			// registering the struct later exposes its vecs, the non-nil
+			// single series being kept
+			inflight := s.Inflight
+			if err := RegisterMetrics(s, registry); err != nil {
+				t.Fatalf("RegisterMetrics: %v", err)
+			}
+			s.Requests.WithLabelValues("200").Inc()
+			if n := testutil.CollectAndCount(registry, "requests_total"); n != 1 {
+				t.Fatalf("%d requests_total series registered, want 1", n)
+			}
+			if s.Inflight != inflight {
+				t.Error("the single series field was replaced")
+			}
+		})
+	}
+}
+
+func TestLabelOrder(t *testing.T) {
+	type stat struct {
+		Counter   *prometheus.CounterVec   `misery:"name=c_total,labels=[zeta,alpha,mid]"`
+		Gauge     *prometheus.GaugeVec     `misery:"name=g,labels=[zeta,alpha,mid]"`
+		Histogram *prometheus.HistogramVec `misery:"labels=[zeta,alpha,mid],name=h_seconds"`
+		Summary   *prometheus.SummaryVec   `misery:"name=s_seconds,labels=[zeta, alpha, mid]"`
+	}
+
+	s := &stat{}
+	if err := BuildMetrics(s); err != nil {
+		t.Fatalf("BuildMetrics: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		collector prometheus.Collector
+	}{
+		{name: "counter", collector: s.Counter},
+		{name: "gauge", collector: s.Gauge},
+		{name: "histogram", collector: s.Histogram},
+		{name: "summary", collector: s.Summary},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			descs := describe(tt.collector)
+			if len(descs) != 1 {
+				t.Fatalf("%d descriptors", len(descs))
+			}
+			if !strings.Contains(descs[0].String(), "variableLabels: {zeta,alpha,mid}") {
+				t.Errorf("labels out of declaration order: %s", descs[0])
+			}
+		})
+	}
+
+	// label values are taken positionally in the declared order
+	s.Counter.WithLabelValues("z", "a", "m").Inc()
+	if got := testutil.ToFloat64(s.Counter.With(prometheus.Labels{"zeta": "z", "alpha": "a", "mid": "m"})); got != 1 {
+		t.Errorf("series by name = %v, want 1", got)
+	}
+}
+
+func TestAutoHelp(t *testing.T) {
+	type stat struct {
+		SecondsFromStart prometheus.Gauge       `misery:"name=seconds_from_start"`
+		HTTPRequests     *prometheus.CounterVec `misery:"name=http_requests_total"`
+		Tagged           prometheus.Gauge       `misery:"name=tagged,help=Tagged."`
+	}
+
+	tests := []struct {
+		name string
+		auto bool
+		want map[string]string
+	}{
+		{
+			name: "enabled",
+			auto: true,
+			want: map[string]string{
+				"seconds_from_start":  "Seconds from start",
+				"http_requests_total": "Http requests",
+				"tagged":              "Tagged.",
+			},
+		},
+		{
+			name: "disabled by default",
+			want: map[string]string{
+				"seconds_from_start":  "",
+				"http_requests_total": "",
+				"tagged":              "Tagged.",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			s := &stat{}
+			var opts []Option
+			if tt.auto {
+				opts = append(opts, WithAutoHelp(true))
+			}
+			if err := RegisterMetricsWithOptions(s, registry, opts...); err != nil {
+				t.Fatalf("RegisterMetricsWithOptions: %v", err)
+			}
+			s.HTTPRequests.WithLabelValues().Inc()
+			for name, help := range tt.want {
+				family := gatherFamily(t, registry, name)
+				if family == nil {
+					t.Fatalf("%s not scraped", name)
+				}
+				if family.GetHelp() != help {
+					t.Errorf("%s help %q, want %q", name, family.GetHelp(), help)
+				}
+			}
+		})
+	}
+}
+
+func TestEnabled(t *testing.T) {
+	type stat struct {
+		Always   *prometheus.CounterVec `misery:"name=always_total"`
+		On       *prometheus.CounterVec `misery:"name=on_total,enabled=true"`
+		Off      *prometheus.CounterVec `misery:"name=off_total,enabled=false"`
+		Skipped  *prometheus.CounterVec `misery:"name=skipped_total,skip"`
+		Callback *prometheus.CounterVec `misery:"name=callback_total"`
+	}
+
+	tests := []struct {
+		name    string
+		enabled func(field string) bool
+		want    []string
+	}{
+		{
+			name: "static",
+			want: []string{"Always", "On", "Callback"},
+		},
+		{
+			name:    "callback disables a field",
+			enabled: func(field string) bool { return field != "Callback" },
+			want:    []string{"Always", "On"},
+		},
+		{
+			name:    "callback cannot enable a field the tag disables",
+			enabled: func(string) bool { return true },
+			want:    []string{"Always", "On", "Callback"},
+		},
+		{
+			name:    "callback overrides enabled=true",
+			enabled: func(field string) bool { return field != "On" },
+			want:    []string{"Always", "Callback"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var asked []string
+			var opts []Option
+			if tt.enabled != nil {
+				opts = append(opts, WithEnabled(func(field string) bool {
+					asked = append(asked, field)
+					return tt.enabled(field)
+				}))
+			}
+			s := &stat{}
+			if err := RegisterMetricsWithOptions(s, prometheus.NewRegistry(), opts...); err != nil {
+				t.Fatalf("RegisterMetricsWithOptions: %v", err)
+			}
+
+			var built []string
+			v := reflect.ValueOf(s).Elem()
+			for i := 0; i < v.NumField(); i++ {
+				if !v.Field(i).IsNil() {
+					built = append(built, v.Type().Field(i).Name)
+				}
+			}
+			if !reflect.DeepEqual(built, tt.want) {
+				t.Errorf("built %v, want %v", built, tt.want)
+			}
+			for _, field := range asked {
+				if field == "Off" || field == "Skipped" {
+					t.Errorf("callback asked about %s, which its tag disables", field)
+				}
+			}
+		})
+	}
+}
+
+func TestEnabledMalformed(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,enabled=maybe"`
+	}
+
+	if err := RegisterMetrics(&stat{}, prometheus.NewRegistry()); !errors.Is(err, ErrAttributeMalformed) {
+		t.Fatalf("got error %v, want ErrAttributeMalformed", err)
+	}
+}
+
+func TestNameTrimPrefix(t *testing.T) {
+	type stat struct {
+		LegacyHTTPRequests *prometheus.CounterVec `misery:""`
+		LegacyErrors       *prometheus.CounterVec `misery:"namespace=app,subsystem=api"`
+		LegacyExplicit     *prometheus.CounterVec `misery:"name=legacy_explicit_total"`
+		Legacy             *prometheus.CounterVec `misery:""`
+		Current            *prometheus.CounterVec `misery:""`
+	}
+
+	tests := []struct {
+		name   string
+		prefix string
+		want   []string
+	}{
+		{
+			name: "no prefix",
+			want: []string{"legacy_http_requests", "app_api_legacy_errors", "legacy_explicit_total", "legacy", "current"},
+		},
+		{
+			name:   "field name prefix",
+			prefix: "Legacy",
+			want:   []string{"http_requests", "app_api_errors", "legacy_explicit_total", "legacy", "current"},
+		},
+		{
+			name:   "snake cased prefix",
+			prefix: "legacy_",
+			want:   []string{"http_requests", "app_api_errors", "legacy_explicit_total", "legacy", "current"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names, err := RegisteredNames(&stat{}, WithNameTrimPrefix(tt.prefix))
+			if err != nil {
+				t.Fatalf("RegisteredNames: %v", err)
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("names %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestTagKeys(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total" misery_labels:"labels=[code,method]" misery_help:"help=Requests."`
+		Errors   *prometheus.CounterVec `metrics:"name=errors_total" metrics_more:"labels=[code]"`
+	}
+
+	tests := []struct {
+		name string
+		opts []Option
+		want []string
+	}{
+		{
+			name: "continuation keys",
+			opts: []Option{WithTagKeys("misery", "misery_labels", "misery_help")},
+			want: []string{
+				"requests_total Requests. [code method]",
+				"errors []",
+			},
+		},
+		{
+			name: "other primary key",
+			opts: []Option{WithTagKeys("metrics", "metrics_more")},
+			want: []string{
+				"requests []",
+				"errors_total [code]",
+			},
+		},
+		{
+			name: "primary key only",
+			want: []string{
+				"requests_total []",
+				"errors []",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docs, err := DescribeMetrics(&stat{}, tt.opts...)
+			if err != nil {
+				t.Fatalf("DescribeMetrics: %v", err)
+			}
+			var got []string
+			for _, doc := range docs {
+				got = append(got, strings.TrimSpace(doc.Name+" "+doc.Help)+fmt.Sprintf(" %v", doc.Labels))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("metrics %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIgnoreAlreadyRegistered(t *testing.T) {
+	type plugin struct {
+		Calls    *prometheus.CounterVec `misery:"name=plugin_calls_total,labels=[plugin]"`
+		Inflight prometheus.Gauge       `misery:"name=plugin_inflight"`
+	}
+	type broken struct {
+		Calls  *prometheus.CounterVec `misery:"name=plugin_calls_total,labels=[plugin]"`
+		Broken *prometheus.CounterVec `misery:"name=broken-name"`
+	}
+
+	registry := prometheus.NewRegistry()
+	first := &plugin{}
+	if err := RegisterMetricsWithOptions(first, registry, WithIgnoreAlreadyRegistered(true)); err != nil {
+		t.Fatalf("first registration: %v", err)
+	}
+
+	if err := RegisterMetrics(&plugin{}, registry); err == nil {
+		t.Fatal("registered the same metrics twice without WithIgnoreAlreadyRegistered")
+	}
+
+	second := &plugin{}
+	if err := RegisterMetricsWithOptions(second, registry, WithIgnoreAlreadyRegistered(true)); err != nil {
+		t.Fatalf("second registration: %v", err)
+	}
+	if second.Calls != first.Calls {
+		t.Error("the second struct did not reuse the registered vec")
+	}
+	first.Calls.WithLabelValues("a").Inc()
+	second.Calls.WithLabelValues("a").Inc()
+	if got := testutil.ToFloat64(first.Calls.WithLabelValues("a")); got != 2 {
+		t.Errorf("plugin_calls_total = %v, want 2", got)
+	}
+
+	// rolling back a registration does not unregister the reused vec
+	if err := RegisterMetricsWithOptions(&broken{}, registry, WithIgnoreAlreadyRegistered(true)); err == nil {
+		t.Fatal("registered a malformed metric name")
+	}
+	if n := testutil.CollectAndCount(registry, "plugin_calls_total"); n != 1 {
+		t.Errorf("%d plugin_calls_total series after rollback, want 1", n)
+	}
+}
+
+func TestLabelsWithDefaults(t *testing.T) {
+	type stat struct {
+		Jobs *prometheus.CounterVec `misery:"name=jobs_total,help=Jobs.,labels={thread:main,region:'eu-west'}"`
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	want := `
+# HELP jobs_total Jobs.
+# TYPE jobs_total counter
+jobs_total{region="eu-west",thread="main"} 0
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+
+	// label values are positional in the order of the map
+	s.Jobs.WithLabelValues("main", "eu-west").Inc()
+	if got := testutil.ToFloat64(s.Jobs.With(prometheus.Labels{"thread": "main", "region": "eu-west"})); got != 1 {
+		t.Errorf("default series = %v, want 1", got)
+	}
+}
+
+func TestLabelsWithDefaultsMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		tag  string
+	}{
+		{name: "pair without a value", tag: "name=jobs_total,labels={thread}"},
+		{name: "repeated label", tag: "name=jobs_total,labels={thread:a,thread:b}"},
+		{name: "empty key", tag: "name=jobs_total,labels={:a}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := createPrometheusCounter("Jobs", parseTestTag(t, tt.tag), newConfig())
+			if !errors.Is(err, ErrAttributeMalformed) {
+				t.Fatalf("got error %v, want ErrAttributeMalformed", err)
+			}
+		})
+	}
+}
+
+// staticCollector is a custom collector exposing one gauge.
+type staticCollector struct {
+	desc  *prometheus.Desc
+	value float64
+}
+
+func newStaticCollector(name string, value float64) *staticCollector {
+	return &staticCollector{desc: prometheus.NewDesc(name, "Static.", nil, nil), value: value}
+}
+
+func (c *staticCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *staticCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, c.value)
+}
+
+func TestRegisterPassthrough(t *testing.T) {
+	type stat struct {
+		Custom   prometheus.Collector   `misery:"register"`
+		Requests *prometheus.CounterVec `misery:"register"`
+		Skipped  prometheus.Collector
+	}
+
+	registry := prometheus.NewRegistry()
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "user_requests_total", Help: "Requests."}, []string{"code"})
+	s := &stat{
+		Custom:   newStaticCollector("custom", 2),
+		Requests: requests,
+		Skipped:  newStaticCollector("skipped", 1),
+	}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	if s.Requests != requests {
+		t.Error("the register field was modified")
+	}
+	s.Requests.WithLabelValues("200").Inc()
+
+	want := `
+# HELP custom Static.
+# TYPE custom gauge
+custom 2
+# HELP user_requests_total Requests.
+# TYPE user_requests_total counter
+user_requests_total{code="200"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+
+	if err := UnregisterMetrics(s, registry, WithClearFields(true)); err != nil {
+		t.Fatalf("UnregisterMetrics: %v", err)
+	}
+	if s.Requests != requests {
+		t.Error("WithClearFields cleared a register field")
+	}
+	if n := testutil.CollectAndCount(registry); n != 0 {
+		t.Errorf("%d metrics left registered", n)
+	}
+
+	nilCollector := &struct {
+		Custom prometheus.Collector `misery:"register"`
+	}{}
+	if err := RegisterMetrics(nilCollector, prometheus.NewRegistry()); !errors.Is(err, ErrAttributeMalformed) {
+		t.Errorf("nil collector: got error %v, want ErrAttributeMalformed", err)
+	}
+	notCollector := &struct {
+		Custom string `misery:"register"`
+	}{Custom: "x"}
+	if err := RegisterMetrics(notCollector, prometheus.NewRegistry()); !errors.Is(err, ErrTypeNotSupported) {
+		t.Errorf("string field: got error %v, want ErrTypeNotSupported", err)
+	}
+}
+
+func TestDuplicateNamesAcrossPassthrough(t *testing.T) {
+	type tagFirst struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total"`
+		Custom   prometheus.Collector   `misery:"register"`
+	}
+	type passthroughFirst struct {
+		Custom   *staticCollector       `misery:"register"`
+		Requests *prometheus.CounterVec `misery:"name=requests_total"`
+	}
+	type distinct struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total"`
+		Custom   prometheus.Collector   `misery:"register"`
+	}
+
+	tests := []struct {
+		name    string
+		mtrcs   interface{}
+		wantErr bool
+	}{
+		{name: "tag-built first", mtrcs: &tagFirst{Custom: newStaticCollector("requests_total", 1)}, wantErr: true},
+		{name: "passthrough first", mtrcs: &passthroughFirst{Custom: newStaticCollector("requests_total", 1)}, wantErr: true},
+		{name: "distinct names", mtrcs: &distinct{Custom: newStaticCollector("custom", 1)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			err := RegisterMetrics(tt.mtrcs, registry)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("RegisterMetrics: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrDuplicateMetricName) {
+				t.Fatalf("got error %v, want ErrDuplicateMetricName", err)
+			}
+			for _, offender := range []string{"requests_total", "Requests", "Custom"} {
+				if !strings.Contains(err.Error(), offender) {
+					t.Errorf("error %q does not name %s", err, offender)
+				}
+			}
+			if n := testutil.CollectAndCount(registry); n != 0 {
+				t.Errorf("%d metrics left registered", n)
+			}
+		})
+	}
+}
+
+func TestObserverVecType(t *testing.T) {
+	type histogram struct {
+		Latency prometheus.ObserverVec `misery:"name=latency_seconds,type=histogram,buckets=[0.1,1]"`
+	}
+	type summary struct {
+		Latency prometheus.ObserverVec `misery:"name=latency_seconds,type=summary,objectives={0.5:0.05}"`
+	}
+	type byDefault struct {
+		Latency prometheus.ObserverVec `misery:"name=latency_seconds"`
+	}
+	type unknown struct {
+		Latency prometheus.ObserverVec `misery:"name=latency_seconds,type=gauge"`
+	}
+	type mismatched struct {
+		Latency prometheus.ObserverVec `misery:"name=latency_seconds,type=summary,buckets=[0.1,1]"`
+	}
+
+	tests := []struct {
+		name    string
+		mtrcs   interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{name: "histogram", mtrcs: &histogram{}, want: &prometheus.HistogramVec{}},
+		{name: "summary", mtrcs: &summary{}, want: &prometheus.SummaryVec{}},
+		{name: "histogram by default", mtrcs: &byDefault{}, want: &prometheus.HistogramVec{}},
+		{name: "unknown type", mtrcs: &unknown{}, wantErr: true},
+		{name: "histogram attribute on a summary", mtrcs: &mismatched{}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := RegisterMetrics(tt.mtrcs, prometheus.NewRegistry())
+			if tt.wantErr {
+				if !errors.Is(err, ErrAttributeMalformed) {
+					t.Fatalf("got error %v, want ErrAttributeMalformed", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RegisterMetrics: %v", err)
+			}
+			got := reflect.ValueOf(tt.mtrcs).Elem().Field(0).Interface()
+			if reflect.TypeOf(got) != reflect.TypeOf(tt.want) {
+				t.Errorf("built %T, want %T", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestObserverVecObserve(t *testing.T) {
+	type stat struct {
+		Read  prometheus.ObserverVec `misery:"name=read_seconds,help=Reads.,labels=[disk],buckets=[1]"`
+		Write prometheus.ObserverVec `misery:"name=write_seconds,help=Writes.,labels=[disk],type=summary"`
+	}
+	// library code sees the interface only
+	observe := func(vec prometheus.ObserverVec, disk string, v float64) {
+		vec.WithLabelValues(disk).Observe(v)
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	observe(s.Read, "sda", 0.5)
+	observe(s.Write, "sda", 2)
+
+	want := `
+# HELP read_seconds Reads.
+# TYPE read_seconds histogram
+read_seconds_bucket{disk="sda",le="1"} 1
+read_seconds_bucket{disk="sda",le="+Inf"} 1
+read_seconds_sum{disk="sda"} 0.5
+read_seconds_count{disk="sda"} 1
+# HELP write_seconds Writes.
+# TYPE write_seconds summary
+write_seconds_sum{disk="sda"} 2
+write_seconds_count{disk="sda"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLenient(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec   `misery:"name=requests_total"`
+		Broken   *prometheus.CounterVec   `misery:"name=broken-name"`
+		Latency  *prometheus.HistogramVec `misery:"name=latency_seconds,buckets=[2,1]"`
+		Uptime   prometheus.Gauge         `misery:"name=uptime_seconds"`
+	}
+
+	tests := []struct {
+		name    string
+		opts    []Option
+		wantErr bool
+	}{
+		{name: "lenient", opts: []Option{WithLenient(true)}},
+		{name: "lenient over collecting errors", opts: []Option{WithLenient(true), WithCollectAllErrors(true)}},
+		{name: "strict by default", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := &recordLogger{}
+			registry := prometheus.NewRegistry()
+			s := &stat{}
+			err := RegisterMetricsWithOptions(s, registry, append(tt.opts, WithLogger(logger))...)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if n := testutil.CollectAndCount(registry); n != 0 {
+					t.Errorf("%d metrics left registered", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RegisterMetricsWithOptions: %v", err)
+			}
+			if s.Requests == nil || s.Uptime == nil {
+				t.Fatal("valid fields were not registered")
+			}
+			if s.Broken != nil || s.Latency != nil {
+				t.Error("malformed fields were set")
+			}
+			s.Requests.WithLabelValues().Inc()
+			if n := testutil.CollectAndCount(registry); n != 2 {
+				t.Errorf("%d metrics registered, want 2", n)
+			}
+			for _, field := range []string{"Broken", "Latency"} {
+				if !strings.Contains(logger.String(), field) {
+					t.Errorf("skipping %s was not logged: %q", field, logger.String())
+				}
+			}
+		})
+	}
+}
+
+func TestRegisterMetricsFields(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec   `misery:"name=requests_total"`
+		Errors   *prometheus.CounterVec   `misery:"name=errors_total"`
+		Latency  *prometheus.HistogramVec `misery:"name=latency_seconds"`
+	}
+
+	tests := []struct {
+		name    string
+		fields  []string
+		built   []string
+		wantErr error
+	}{
+		{name: "subset", fields: []string{"Requests", "Latency"}, built: []string{"requests_total", "latency_seconds"}},
+		{name: "no fields", built: nil},
+		{name: "unknown field", fields: []string{"Requests", "Missing"}, wantErr: ErrMetricNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			s := &stat{}
+			err := RegisterMetricsFields(s, registry, tt.fields...)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				if s.Requests != nil {
+					t.Error("a field was set despite the error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RegisterMetricsFields: %v", err)
+			}
+
+			var built []string
+			for name, collector := range map[string]*prometheus.CounterVec{"requests_total": s.Requests, "errors_total": s.Errors} {
+				if collector != nil {
+					collector.WithLabelValues().Inc()
+					built = append(built, name)
+				}
+			}
+			if s.Latency != nil {
+				s.Latency.WithLabelValues().Observe(1)
+				built = append(built, "latency_seconds")
+			}
+			sort.Strings(built)
+			want := append([]string(nil), tt.built...)
+			sort.Strings(want)
+			if !reflect.DeepEqual(built, want) {
+				t.Errorf("built %v, want %v", built, want)
+			}
+			if n := testutil.CollectAndCount(registry); n != len(want) {
+				t.Errorf("%d metrics registered, want %d", n, len(want))
+			}
+		})
+	}
+}
+
+func TestHelpResolver(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,help_key=metrics.requests"`
+	}
+	type withFallback struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,help_key=metrics.missing,help=Fallback."`
+	}
+
+	catalog := map[string]string{"metrics.requests": "Anfragen."}
+	resolver := WithHelpResolver(func(key string) (string, bool) {
+		help, ok := catalog[key]
+		return help, ok
+	})
+
+	tests := []struct {
+		name        string
+		mtrcs       interface{}
+		requireHelp bool
+		help        string
+		wantErr     bool
+	}{
+		{name: "resolved key", mtrcs: &stat{}, help: "Anfragen."},
+		{name: "resolved key with help required", mtrcs: &stat{}, requireHelp: true, help: "Anfragen."},
+		{name: "missing key with fallback help", mtrcs: &withFallback{}, requireHelp: true, help: "Fallback."},
+		{name: "missing key without help", mtrcs: &struct {
+			Requests *prometheus.CounterVec `misery:"name=requests_total,help_key=metrics.missing"`
+		}{}, help: ""},
+		{name: "missing key with help required", mtrcs: &struct {
+			Requests *prometheus.CounterVec `misery:"name=requests_total,help_key=metrics.missing"`
+		}{}, requireHelp: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			err := RegisterMetricsWithOptions(tt.mtrcs, registry, resolver, WithRequireHelp(tt.requireHelp))
+			if tt.wantErr {
+				if !errors.Is(err, ErrAttributeMalformed) {
+					t.Fatalf("got error %v, want ErrAttributeMalformed", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RegisterMetricsWithOptions: %v", err)
+			}
+			reflect.ValueOf(tt.mtrcs).Elem().Field(0).Interface().(*prometheus.CounterVec).WithLabelValues().Inc()
+			if got := gatherFamily(t, registry, "requests_total").GetHelp(); got != tt.help {
+				t.Errorf("help %q, want %q", got, tt.help)
+			}
+		})
+	}
+}
+
+func TestLabelEnums(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,help=Requests.,labels=[status{2xx,4xx,5xx},path]"`
+	}
+
+	tests := []struct {
+		name   string
+		status string
+		want   string
+	}{
+		{name: "allowed", status: "2xx", want: "2xx"},
+		{name: "another allowed", status: "5xx", want: "5xx"},
+		{name: "disallowed", status: "teapot", want: "other"},
+		{name: "empty", status: "", want: "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			s := &stat{}
+			if err := RegisterMetrics(s, registry); err != nil {
+				t.Fatalf("RegisterMetrics: %v", err)
+			}
+			s.Requests.WithLabelValues(tt.status, "/").Inc()
+			s.Requests.With(prometheus.Labels{"status": tt.status, "path": "/"}).Inc()
+
+			want := fmt.Sprintf(`
+# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{path="/",status=%q} 2
+`, tt.want)
+			if err := testutil.GatherAndCompare(registry, strings.NewReader(want)); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestLabelEnumsMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		tag  string
+	}{
+		{name: "no values", tag: "name=requests_total,labels=[status{}]"},
+		{name: "no name", tag: "name=requests_total,labels=[{2xx}]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := createPrometheusCounter("Requests", parseTestTag(t, tt.tag), newConfig())
+			if !errors.Is(err, ErrAttributeMalformed) {
+				t.Fatalf("got error %v, want ErrAttributeMalformed", err)
+			}
+		})
+	}
+}
+
+func TestWithRegistererLabels(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,help=Requests.,labels=[code]"`
+		Queue    prometheus.Gauge       `misery:"name=queue_depth,help='Queue depth.'"`
+		Latency  prometheus.Histogram   `misery:"name=latency_seconds,help=Latency.,buckets=[1]"`
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	labels := prometheus.Labels{"instance": "a", "shard": "2"}
+	if err := RegisterMetricsWithOptions(s, registry, WithRegistererLabels(labels)); err != nil {
+		t.Fatalf("RegisterMetricsWithOptions: %v", err)
+	}
+	s.Requests.WithLabelValues("200").Inc()
+	s.Queue.Set(3)
+	s.Latency.Observe(0.5)
+
+	want := `
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{instance="a",shard="2",le="1"} 1
+latency_seconds_bucket{instance="a",shard="2",le="+Inf"} 1
+latency_seconds_sum{instance="a",shard="2"} 0.5
+latency_seconds_count{instance="a",shard="2"} 1
+# HELP queue_depth Queue depth.
+# TYPE queue_depth gauge
+queue_depth{instance="a",shard="2"} 3
+# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{code="200",instance="a",shard="2"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+	if err := UnregisterMetrics(s, registry, WithRegistererLabels(labels)); err != nil {
+		t.Errorf("UnregisterMetrics: %v", err)
+	}
+	if n, err := testutil.GatherAndCount(registry); err != nil || n != 0 {
+		t.Errorf("got %d series after UnregisterMetrics, err %v", n, err)
+	}
+}
+
+func TestDuplicateLabels(t *testing.T) {
+	tests := []struct {
+		name    string
+		tag     string
+		dedup   bool
+		want    []string
+		wantMsg string
+	}{
+		{name: "list", tag: "labels=[a,a,b]", wantMsg: "label a is repeated"},
+		{name: "map", tag: "labels={a=x,b=y,a=z}", wantMsg: "label a is repeated"},
+		{name: "enum", tag: "labels=[a{x,y},b,a]", wantMsg: "label a is repeated"},
+		{name: "list deduped", tag: "labels=[b,a,b,c,a]", dedup: true, want: []string{"b", "a", "c"}},
+		{name: "map deduped", tag: "labels={a=x,b=y,a=z}", dedup: true, want: []string{"a", "b"}},
+		{name: "no duplicates", tag: "labels=[a,b]", want: []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, _ := attrValue(parseTestTag(t, tt.tag), "labels")
+			labels, _, _, err := parseLabels(value, newConfig(WithDedupLabels(tt.dedup)))
+			if tt.wantMsg != "" {
+				if !errors.Is(err, ErrAttributeMalformed) || !strings.Contains(err.Error(), tt.wantMsg) {
+					t.Fatalf("got error %v, want ErrAttributeMalformed with %q", err, tt.wantMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseLabels: %v", err)
+			}
+			if !reflect.DeepEqual(labels, tt.want) {
+				t.Errorf("got labels %v, want %v", labels, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithDedupLabels(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,help=Requests.,labels=[method,code,method]"`
+	}
+
+	if err := RegisterMetrics(&stat{}, prometheus.NewRegistry()); !errors.Is(err, ErrAttributeMalformed) {
+		t.Fatalf("RegisterMetrics: got error %v, want ErrAttributeMalformed", err)
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	if err := RegisterMetricsWithOptions(s, registry, WithDedupLabels(true)); err != nil {
+		t.Fatalf("RegisterMetricsWithOptions: %v", err)
+	}
+	s.Requests.WithLabelValues("GET", "200").Inc()
+
+	want := `
+# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{code="200",method="GET"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWithAfterRegister(t *testing.T) {
+	type inner struct {
+		Queue *prometheus.GaugeVec `misery:"name=queue_depth,labels=[pool]"`
+	}
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,labels=[code]"`
+		Skipped  *prometheus.CounterVec `misery:"skip"`
+		Inner    inner
+		Latency  *prometheus.HistogramVec `misery:"name=latency_seconds,labels=[code]"`
+	}
+
+	type call struct {
+		field     string
+		collector prometheus.Collector
+	}
+	var calls []call
+	hook := WithAfterRegister(func(field string, c prometheus.Collector) {
+		calls = append(calls, call{field: field, collector: c})
+	})
+
+	s := &stat{}
+	if err := RegisterMetricsWithOptions(s, prometheus.NewRegistry(), hook); err != nil {
+		t.Fatalf("RegisterMetricsWithOptions: %v", err)
+	}
+	want := []call{
+		{field: "Requests", collector: s.Requests},
+		{field: "Inner.Queue", collector: s.Inner.Queue},
+		{field: "Latency", collector: s.Latency},
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("got calls %v, want %v", calls, want)
+	}
+
+	calls = nil
+	if err := BuildMetrics(&stat{}, hook); err != nil {
+		t.Fatalf("BuildMetrics: %v", err)
+	}
+	if len(calls) != 0 {
+		t.Errorf("hook called %d times without registration", len(calls))
+	}
+
+	type failing struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total"`
+		Broken   *prometheus.CounterVec `misery:"name=broken-name"`
+	}
+	calls = nil
+	if err := RegisterMetricsWithOptions(&failing{}, prometheus.NewRegistry(), hook); err == nil {
+		t.Fatal("RegisterMetricsWithOptions: got no error")
+	}
+	if len(calls) != 0 {
+		t.Errorf("hook called %d times for a failed registration", len(calls))
+	}
+}
+
+func TestWithRequireTag(t *testing.T) {
+	type stat struct {
+		Tagged   *prometheus.CounterVec `misery:"name=tagged_total"`
+		Defaults *prometheus.CounterVec `misery:""`
+		Skipped  *prometheus.CounterVec `misery:"skip"`
+		Untagged *prometheus.CounterVec
+	}
+
+	tests := []struct {
+		name    string
+		opts    []Option
+		want    []string
+		warning bool
+		wantErr bool
+	}{
+		{name: "off", want: []string{"defaults", "tagged_total", "untagged"}},
+		{name: "on", opts: []Option{WithRequireTag(true)}, want: []string{"defaults", "tagged_total"}, warning: true},
+		{name: "strict", opts: []Option{WithRequireTag(true), WithStrict(true)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := &recordLogger{}
+			registry := prometheus.NewRegistry()
+			s := &stat{}
+			err := RegisterMetricsWithOptions(s, registry, append(tt.opts, WithLogger(logger))...)
+			if tt.wantErr {
+				if !errors.Is(err, ErrAttributeMalformed) {
+					t.Fatalf("got error %v, want ErrAttributeMalformed", err)
+				}
+				if !strings.Contains(err.Error(), "Untagged") {
+					t.Errorf("error %q does not name the field", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RegisterMetricsWithOptions: %v", err)
+			}
+			if s.Skipped != nil {
+				t.Error("skipped field built")
+			}
+			if (s.Untagged == nil) != tt.warning {
+				t.Errorf("untagged field built: %v", s.Untagged != nil)
+			}
+			if got := strings.Contains(logger.String(), "Untagged"); got != tt.warning {
+				t.Errorf("warning logged: %q", logger.String())
+			}
+			s.Tagged.WithLabelValues().Inc()
+			s.Defaults.WithLabelValues().Inc()
+			if s.Untagged != nil {
+				s.Untagged.WithLabelValues().Inc()
+			}
+			families, err := registry.Gather()
+			if err != nil {
+				t.Fatalf("Gather: %v", err)
+			}
+			var names []string
+			for _, family := range families {
+				names = append(names, family.GetName())
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("got metrics %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithOmitZero(t *testing.T) {
+	type stat struct {
+		Latency  *prometheus.HistogramVec `misery:"name=latency_seconds,help=Latency.,labels={path=/},buckets=[1]"`
+		Requests *prometheus.CounterVec   `misery:"name=requests_total,help=Requests.,labels=[path]"`
+	}
+
+	tests := []struct {
+		name     string
+		omitZero bool
+		want     string
+	}{
+		{
+			name:     "off",
+			omitZero: false,
+			want: `
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{path="/",le="1"} 0
+latency_seconds_bucket{path="/",le="+Inf"} 0
+latency_seconds_sum{path="/"} 0
+latency_seconds_count{path="/"} 0
+latency_seconds_bucket{path="/api",le="1"} 1
+latency_seconds_bucket{path="/api",le="+Inf"} 1
+latency_seconds_sum{path="/api"} 0.5
+latency_seconds_count{path="/api"} 1
+# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{path="/"} 0
+`,
+		},
+		{
+			name:     "on",
+			omitZero: true,
+			want: `
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{path="/api",le="1"} 1
+latency_seconds_bucket{path="/api",le="+Inf"} 1
+latency_seconds_sum{path="/api"} 0.5
+latency_seconds_count{path="/api"} 1
+# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{path="/"} 0
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			s := &stat{}
+			if err := RegisterMetricsWithOptions(s, registry, WithOmitZero(tt.omitZero)); err != nil {
+				t.Fatalf("RegisterMetricsWithOptions: %v", err)
+			}
+			s.Latency.WithLabelValues("/api").Observe(0.5)
+			s.Requests.WithLabelValues("/")
+
+			if err := testutil.GatherAndCompare(registry, strings.NewReader(tt.want)); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestRegisterMetricsPrefixed(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,help=Requests.,labels=[code]"`
+		Queue    prometheus.Gauge       `misery:"help='Queue depth.'"`
+	}
+
+	registry := prometheus.NewRegistry()
+	acme, globex := &stat{}, &stat{}
+	if err := RegisterMetricsPrefixed(acme, registry, "acme"); err != nil {
+		t.Fatalf("RegisterMetricsPrefixed acme: %v", err)
+	}
+	if err := RegisterMetricsPrefixed(globex, registry, "globex"); err != nil {
+		t.Fatalf("RegisterMetricsPrefixed globex: %v", err)
+	}
+	if acme.Requests == globex.Requests {
+		t.Fatal("tenants share a collector")
+	}
+	acme.Requests.WithLabelValues("200").Inc()
+	globex.Requests.WithLabelValues("200").Add(2)
+	acme.Queue.Set(3)
+	globex.Queue.Set(4)
+
+	want := `
+# HELP acme_queue Queue depth.
+# TYPE acme_queue gauge
+acme_queue 3
+# HELP acme_requests_total Requests.
+# TYPE acme_requests_total counter
+acme_requests_total{code="200"} 1
+# HELP globex_queue Queue depth.
+# TYPE globex_queue gauge
+globex_queue 4
+# HELP globex_requests_total Requests.
+# TYPE globex_requests_total counter
+globex_requests_total{code="200"} 2
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RegisterMetricsPrefixed(&stat{}, registry, "acme"); err == nil {
+		t.Error("registering a prefix twice: got no error")
+	}
+	if err := RegisterMetricsPrefixed(&stat{}, registry, ""); !errors.Is(err, ErrAttributeMalformed) {
+		t.Errorf("empty prefix: got error %v, want ErrAttributeMalformed", err)
+	}
+}
+
+func TestNilRegistry(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total"`
+	}
+
+	entryPoints := map[string]func(registry prometheus.Registerer) error{
+		"RegisterMetrics": func(registry prometheus.Registerer) error {
+			return RegisterMetrics(&stat{}, registry)
+		},
+		"RegisterMetricsFields": func(registry prometheus.Registerer) error {
+			return RegisterMetricsFields(&stat{}, registry, "Requests")
+		},
+		"RegisterMetricsPrefixed": func(registry prometheus.Registerer) error {
+			return RegisterMetricsPrefixed(&stat{}, registry, "acme")
+		},
+		"RegisterMetricsCtx": func(registry prometheus.Registerer) error {
+			return RegisterMetricsCtx(context.Background(), &stat{}, registry)
+		},
+		"RegisterMetricsWithOptions": func(registry prometheus.Registerer) error {
+			return RegisterMetricsWithOptions(&stat{}, registry, WithStrict(true))
+		},
+		"RegisterMetricsReport": func(registry prometheus.Registerer) error {
+			_, err := RegisterMetricsReport(&stat{}, registry)
+			return err
+		},
+		"RegisterMetricsMulti": func(registry prometheus.Registerer) error {
+			return RegisterMetricsMulti(&stat{}, prometheus.NewRegistry(), registry)
+		},
+		"RegisterAll": func(registry prometheus.Registerer) error {
+			return RegisterAll(registry, &stat{})
+		},
+		"RegisterAllReport": func(registry prometheus.Registerer) error {
+			_, err := RegisterAllReport(registry, &stat{})
+			return err
+		},
+		"RegisterAllWithOptions": func(registry prometheus.Registerer) error {
+			return RegisterAllWithOptions(registry, []interface{}{&stat{}})
+		},
+		"UnregisterMetrics": func(registry prometheus.Registerer) error {
+			return UnregisterMetrics(&stat{}, registry)
+		},
+		"NewWith": func(registry prometheus.Registerer) error {
+			_, err := NewWith[stat](registry)
+			return err
+		},
+		"RegisterConstMetrics": func(registry prometheus.Registerer) error {
+			return RegisterConstMetrics(map[string]ConstMetricSpec{"version": {Value: 1}}, registry)
+		},
+		"RegisterBuildInfo": func(registry prometheus.Registerer) error {
+			return RegisterBuildInfo(registry)
+		},
+		"RegisterCounter": func(registry prometheus.Registerer) error {
+			_, err := RegisterCounter("requests_total", "", nil, registry)
+			return err
+		},
+		"RegisterGauge": func(registry prometheus.Registerer) error {
+			_, err := RegisterGauge("queue_depth", "", nil, registry)
+			return err
+		},
+		"RegisterHistogram": func(registry prometheus.Registerer) error {
+			_, err := RegisterHistogram("latency_seconds", "", nil, nil, registry)
+			return err
+		},
+		"Builder": func(registry prometheus.Registerer) error {
+			_, err := NewBuilder(registry).Counter("requests_total").Build()
+			return err
+		},
+	}
+
+	var nilRegistry *prometheus.Registry
+	registries := map[string]prometheus.Registerer{
+		"nil interface":      nil,
+		"nil registry value": nilRegistry,
+	}
+	for name, register := range entryPoints {
+		for kind, registry := range registries {
+			t.Run(name+"/"+kind, func(t *testing.T) {
+				if err := register(registry); !errors.Is(err, ErrNilRegistry) {
+					t.Fatalf("got error %v, want ErrNilRegistry", err)
+				}
+			})
+		}
+	}
+}
+
+func TestWithMetricFilter(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec   `misery:"name=requests_total,namespace=http"`
+		Queries  *prometheus.CounterVec   `misery:"name=queries_total,namespace=debug"`
+		Latency  *prometheus.HistogramVec `misery:"namespace=debug"`
+		Queue    prometheus.Gauge         `misery:"name=queue_depth"`
+	}
+
+	type seen struct{ field, metric string }
+	var calls []seen
+	filter := WithMetricFilter(func(fieldName, metricName string) bool {
+		calls = append(calls, seen{field: fieldName, metric: metricName})
+		return !strings.HasPrefix(metricName, "debug_")
+	})
+
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	if err := RegisterMetricsWithOptions(s, registry, filter); err != nil {
+		t.Fatalf("RegisterMetricsWithOptions: %v", err)
+	}
+
+	wantCalls := []seen{
+		{field: "Requests", metric: "http_requests_total"},
+		{field: "Queries", metric: "debug_queries_total"},
+		{field: "Latency", metric: "debug_latency"},
+		{field: "Queue", metric: "queue_depth"},
+	}
+	if !reflect.DeepEqual(calls, wantCalls) {
+		t.Errorf("filter called with %v, want %v", calls, wantCalls)
+	}
+	if s.Requests == nil || s.Queue == nil {
+		t.Fatal("kept fields not built")
+	}
+	if s.Queries != nil || s.Latency != nil {
+		t.Error("excluded fields built")
+	}
+	s.Requests.WithLabelValues().Inc()
+	s.Queue.Set(1)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	var names []string
+	for _, family := range families {
+		names = append(names, family.GetName())
+	}
+	if want := []string{"http_requests_total", "queue_depth"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got metrics %v, want %v", names, want)
+	}
+}
+
+func TestInitValue(t *testing.T) {
+	type stat struct {
+		Processed *prometheus.CounterVec `misery:"name=processed_total,help=Processed.,init_value=1500"`
+		Requests  *prometheus.CounterVec `misery:"name=requests_total,help=Requests.,labels={code=200},init_value=42.5"`
+		Events    prometheus.Counter     `misery:"name=events_total,help=Events.,init_value=7"`
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+
+	want := `
+# HELP events_total Events.
+# TYPE events_total counter
+events_total 7
+# HELP processed_total Processed.
+# TYPE processed_total counter
+processed_total 1500
+# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{code="200"} 42.5
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Processed.WithLabelValues().Inc()
+	s.Events.Add(3)
+	want = `
+# HELP events_total Events.
+# TYPE events_total counter
+events_total 10
+# HELP processed_total Processed.
+# TYPE processed_total counter
+processed_total 1501
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want), "events_total", "processed_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInitValueMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		tag  string
+	}{
+		{name: "negative", tag: "name=processed_total,init_value=-1"},
+		{name: "not a number", tag: "name=processed_total,init_value=many"},
+		{name: "label list", tag: "name=requests_total,labels=[code],init_value=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := createPrometheusCounter("Processed", parseTestTag(t, tt.tag), newConfig())
+			if !errors.Is(err, ErrAttributeMalformed) {
+				t.Fatalf("got error %v, want ErrAttributeMalformed", err)
+			}
+		})
+	}
+}
+
+type pointerSub struct {
+	Hits *prometheus.CounterVec `misery:"labels=[code]"`
+}
+
+type pointerPrealloc struct {
+	Misses *prometheus.CounterVec `misery:"name=prealloc_misses_total"`
+}
+
+type PointerEmbedded struct {
+	Misses prometheus.Counter `misery:"name=misses_total"`
+}
+
+type pointerSelf struct {
+	Loops prometheus.Counter `misery:"name=loops_total"`
+	Next  *pointerSelf
+}
+
+func TestStructPointers(t *testing.T) {
+	type stat struct {
+		*PointerEmbedded
+		Nil      *pointerSub
+		Prealloc *pointerPrealloc
+		hidden   *pointerSub
+	}
+
+	t.Run("nil and preallocated", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+		prealloc := &pointerPrealloc{}
+		s := &stat{Prealloc: prealloc}
+		if err := RegisterMetrics(s, registry); err != nil {
+			t.Fatalf("RegisterMetrics: %v", err)
+		}
+		if s.Nil == nil || s.Nil.Hits == nil {
+			t.Fatal("nil sub-struct pointer not allocated and built")
+		}
+		if s.Prealloc != prealloc {
+			t.Error("preallocated sub-struct pointer replaced")
+		}
+		if prealloc.Misses == nil {
+			t.Error("preallocated sub-struct not built")
+		}
+		if s.PointerEmbedded == nil || s.Misses == nil {
+			t.Error("embedded sub-struct pointer not built")
+		}
+		if s.hidden != nil {
+			t.Error("unexported sub-struct pointer allocated")
+		}
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		type broken struct {
+			Sub  *pointerSub
+			Fail prometheus.Counter `misery:"name=broken-name"`
+		}
+		s := &broken{}
+		if err := RegisterMetrics(s, prometheus.NewRegistry()); err == nil {
+			t.Fatal("RegisterMetrics: got no error")
+		}
+		if s.Sub != nil {
+			t.Error("allocated sub-struct pointer kept after a failed registration")
+		}
+	})
+
+	t.Run("self reference", func(t *testing.T) {
+		s := &pointerSelf{}
+		if err := RegisterMetrics(s, prometheus.NewRegistry()); err != nil {
+			t.Fatalf("RegisterMetrics: %v", err)
+		}
+		if s.Loops == nil {
+			t.Error("first level not built")
+		}
+		if s.Next != nil {
+			t.Error("self referencing pointer allocated")
+		}
+	})
+}
+
+func TestDescAttribute(t *testing.T) {
+	tests := []struct {
+		name     string
+		tag      string
+		wantHelp string
+		wantErr  bool
+	}{
+		{name: "adds a period", tag: "desc='Queue depth'", wantHelp: "Queue depth."},
+		{name: "keeps a period", tag: "desc='Queue depth.'", wantHelp: "Queue depth."},
+		{name: "trims", tag: "desc='  Queue depth  '", wantHelp: "Queue depth."},
+		{name: "blank", tag: "desc='  '", wantHelp: ""},
+		{name: "help alone", tag: "help='Queue depth'", wantHelp: "Queue depth"},
+		{name: "with help", tag: "desc=Depth,help=Depth", wantErr: true},
+		{name: "not a string", tag: "desc=[a,b]", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defs, err := resolveDesc(parseTestTag(t, "name=queue_depth,"+tt.tag))
+			if tt.wantErr {
+				if !errors.Is(err, ErrAttributeMalformed) {
+					t.Fatalf("got error %v, want ErrAttributeMalformed", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveDesc: %v", err)
+			}
+			if hasDefinition(defs, "desc") {
+				t.Error("desc left in the definitions")
+			}
+			if help, _, _ := StringAttr(defs, "help"); help != tt.wantHelp {
+				t.Errorf("got help %q, want %q", help, tt.wantHelp)
+			}
+		})
+	}
+}
+
+func TestDescRegistered(t *testing.T) {
+	type stat struct {
+		Queue prometheus.Gauge `misery:"name=queue_depth,desc='Jobs waiting'"`
+	}
+
+	registry := prometheus.NewRegistry()
+	if err := RegisterMetrics(&stat{}, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	if got := gatherFamily(t, registry, "queue_depth").GetHelp(); got != "Jobs waiting." {
+		t.Errorf("got help %q, want %q", got, "Jobs waiting.")
+	}
+
+	conflict := &struct {
+		Queue prometheus.Gauge `misery:"name=queue_depth,desc=Jobs,help=Jobs"`
+	}{}
+	if err := RegisterMetrics(conflict, prometheus.NewRegistry()); !errors.Is(err, ErrAttributeMalformed) {
+		t.Errorf("desc with help: got error %v, want ErrAttributeMalformed", err)
+	}
+}
+
+func TestGaugeVec(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,help=Requests.,labels=[code]"`
+		Queue    *prometheus.GaugeVec   `misery:"name=queue_depth,help='Jobs waiting.',labels=[queue]"`
+		Inflight *prometheus.GaugeVec   `misery:"name=inflight_requests,help=Inflight.,labels=[pool,method]"`
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	s.Queue.WithLabelValues("mail").Set(4)
+	s.Queue.WithLabelValues("mail").Dec()
+	s.Inflight.WithLabelValues("db", "GET").Inc()
+
+	want := `
+# HELP inflight_requests Inflight.
+# TYPE inflight_requests gauge
+inflight_requests{method="GET",pool="db"} 1
+# HELP queue_depth Jobs waiting.
+# TYPE queue_depth gauge
+queue_depth{queue="mail"} 3
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want), "queue_depth", "inflight_requests"); err != nil {
+		t.Error(err)
+	}
+
+	malformed := &struct {
+		Queue *prometheus.GaugeVec `misery:"name=queue_depth,buckets=[1,2]"`
+	}{}
+	if err := RegisterMetrics(malformed, prometheus.NewRegistry()); !errors.Is(err, ErrAttributeMalformed) {
+		t.Errorf("buckets on a gauge: got error %v, want ErrAttributeMalformed", err)
+	}
+}
+
+func TestNamespaceSubsystem(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,help=Requests.,namespace=myapp,subsystem=http,labels=[code]"`
+		Latency  prometheus.Histogram   `misery:"name=latency_seconds,help=Latency.,namespace=myapp,subsystem=http,buckets=[1]"`
+		Depth    func() float64         `misery:"name=queue_depth,help=Depth.,namespace=myapp"`
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{Depth: func() float64 { return 3 }}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	s.Requests.WithLabelValues("200").Inc()
+	s.Latency.Observe(0.5)
+
+	want := `
+# HELP myapp_http_latency_seconds Latency.
+# TYPE myapp_http_latency_seconds histogram
+myapp_http_latency_seconds_bucket{le="1"} 1
+myapp_http_latency_seconds_bucket{le="+Inf"} 1
+myapp_http_latency_seconds_sum 0.5
+myapp_http_latency_seconds_count 1
+# HELP myapp_http_requests_total Requests.
+# TYPE myapp_http_requests_total counter
+myapp_http_requests_total{code="200"} 1
+# HELP myapp_queue_depth Depth.
+# TYPE myapp_queue_depth gauge
+myapp_queue_depth 3
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UnregisterMetrics(s, registry); err != nil {
+		t.Fatalf("UnregisterMetrics: %v", err)
+	}
+	if n := testutil.CollectAndCount(registry); n != 0 {
+		t.Errorf("%d metrics left registered", n)
+	}
+}
+
+func TestUnit(t *testing.T) {
+	type stat struct {
+		Duration *prometheus.HistogramVec `misery:"name=random_duration,help=Duration.,unit=seconds,buckets=[1]"`
+		Read     *prometheus.CounterVec   `misery:"name=read_total,help=Read.,unit=bytes,namespace=disk"`
+		Hits     func() float64           `misery:"name=cache_hit,help=Hits.,unit=ratio"`
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{Hits: func() float64 { return 0.5 }}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	s.Duration.WithLabelValues().Observe(0.5)
+	s.Read.WithLabelValues().Add(10)
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	var names []string
+	for _, family := range families {
+		names = append(names, family.GetName())
+	}
+	if want := []string{"cache_hit_ratio", "disk_read_bytes_total", "random_duration_seconds"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("gathered %v, want %v", names, want)
+	}
+
+	docs, err := DescribeMetrics(&stat{Hits: s.Hits})
+	if err != nil {
+		t.Fatalf("DescribeMetrics: %v", err)
+	}
+	units := map[string]string{}
+	for _, doc := range docs {
+		units[doc.Name] = doc.Unit
+	}
+	want := map[string]string{"random_duration_seconds": "seconds", "disk_read_bytes_total": "bytes", "cache_hit_ratio": "ratio"}
+	if !reflect.DeepEqual(units, want) {
+		t.Errorf("units %v, want %v", units, want)
+	}
+
+	malformed := &struct {
+		Duration *prometheus.HistogramVec `misery:"name=random_duration,unit=ms"`
+	}{}
+	if err := RegisterMetrics(malformed, prometheus.NewRegistry()); !errors.Is(err, ErrAttributeMalformed) {
+		t.Errorf("unit=ms: got error %v, want ErrAttributeMalformed", err)
+	}
+}
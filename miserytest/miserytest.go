@@ -0,0 +1,102 @@
+// Package miserytest helps asserting on misery managed metrics in tests.
+package miserytest
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/mxpaul/misery"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// GetMetricValue returns the current value of the counter or gauge series
+// of c selected by labels. For collectors without labels, such as a single
+// prometheus.Counter, pass nil labels.
+func GetMetricValue(c prometheus.Collector, labels prometheus.Labels) (value float64, err error) {
+	var series prometheus.Collector
+	switch vec := c.(type) {
+	case *prometheus.CounterVec:
+		series, err = vec.GetMetricWith(labels)
+	case *prometheus.GaugeVec:
+		series, err = vec.GetMetricWith(labels)
+	default:
+		if len(labels) > 0 {
+			return 0, fmt.Errorf("labels given for %T which has no label dimensions", c)
+		}
+		series = c
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("cannot read value of %T: %v", c, p)
+		}
+	}()
+
+	return testutil.ToFloat64(series), nil
+}
+
+// AssertAllSeriesObserved checks that every metric named in expected exposes
+// at least the listed series, to catch metrics a test run never touched. A
+// series matches when its labels include all the given ones, so nil or empty
+// labels match any series. The metrics are gathered from the fields of
+// mtrcs, which must already be registered or built. All missing series are
+// reported, sorted by metric name.
+func AssertAllSeriesObserved(mtrcs interface{}, expected map[string][]prometheus.Labels) error {
+	gatherer, err := misery.NewGatherer(mtrcs)
+	if err != nil {
+		return err
+	}
+	families, err := gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("gather failed: %w", err)
+	}
+
+	exposed := make(map[string][]*dto.Metric, len(families))
+	for _, family := range families {
+		exposed[family.GetName()] = family.GetMetric()
+	}
+
+	names := make([]string, 0, len(expected))
+	for name := range expected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		series, ok := exposed[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("metric %s has no series", name))
+			continue
+		}
+		for _, labels := range expected[name] {
+			if !anySeriesHas(series, labels) {
+				errs = append(errs, fmt.Errorf("metric %s has no series with labels %v", name, labels))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func anySeriesHas(series []*dto.Metric, labels prometheus.Labels) bool {
+	for _, metric := range series {
+		matched := 0
+		for _, pair := range metric.GetLabel() {
+			if value, ok := labels[pair.GetName()]; ok && value == pair.GetValue() {
+				matched++
+			}
+		}
+		if matched == len(labels) {
+			return true
+		}
+	}
+
+	return false
+}
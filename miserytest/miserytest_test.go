@@ -0,0 +1,130 @@
+package miserytest_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/mxpaul/misery"
+	"github.com/mxpaul/misery/miserytest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type stat struct {
+	Requests *prometheus.CounterVec   `misery:"name=requests_total,labels=[code]"`
+	Inflight *prometheus.GaugeVec     `misery:"name=inflight,labels=[pool]"`
+	Uptime   prometheus.Gauge         `misery:"name=uptime_seconds"`
+	Latency  *prometheus.HistogramVec `misery:"name=latency_seconds,labels=[code]"`
+}
+
+func newStat(t *testing.T) *stat {
+	t.Helper()
+
+	s := &stat{}
+	if err := misery.RegisterMetrics(s, prometheus.NewRegistry()); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+
+	return s
+}
+
+func TestGetMetricValue(t *testing.T) {
+	s := newStat(t)
+	s.Requests.WithLabelValues("200").Add(3)
+	s.Inflight.WithLabelValues("db").Set(-2)
+	s.Uptime.Set(60)
+
+	tests := []struct {
+		name      string
+		collector prometheus.Collector
+		labels    prometheus.Labels
+		want      float64
+		wantErr   bool
+	}{
+		{name: "counter series", collector: s.Requests, labels: prometheus.Labels{"code": "200"}, want: 3},
+		{name: "untouched counter series", collector: s.Requests, labels: prometheus.Labels{"code": "500"}},
+		{name: "gauge series", collector: s.Inflight, labels: prometheus.Labels{"pool": "db"}, want: -2},
+		{name: "single gauge", collector: s.Uptime, want: 60},
+		{name: "labels on a single gauge", collector: s.Uptime, labels: prometheus.Labels{"code": "200"}, wantErr: true},
+		{name: "unknown label", collector: s.Requests, labels: prometheus.Labels{"method": "GET"}, wantErr: true},
+		{name: "histogram", collector: s.Latency, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := miserytest.GetMetricValue(tt.collector, tt.labels)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetMetricValue: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("value %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func ExampleGetMetricValue() {
+	s := &stat{}
+	if err := misery.RegisterMetrics(s, prometheus.NewRegistry()); err != nil {
+		panic(err)
+	}
+	s.Requests.WithLabelValues("200").Inc()
+
+	value, err := miserytest.GetMetricValue(s.Requests, prometheus.Labels{"code": "200"})
+	fmt.Println(value, err)
+	// Output: 1 <nil>
+}
+
+func ExampleGetMetricValue_toFloat64() {
+	s := &stat{}
+	if err := misery.RegisterMetrics(s, prometheus.NewRegistry()); err != nil {
+		panic(err)
+	}
+	s.Uptime.Set(42)
+
+	// testutil.ToFloat64 reads single series directly; GetMetricValue
+	// adds the label lookup for vecs
+	value, _ := miserytest.GetMetricValue(s.Uptime, nil)
+	fmt.Println(value, testutil.ToFloat64(s.Uptime))
+	// Output: 42 42
+}
+
+func TestAssertAllSeriesObserved(t *testing.T) {
+	s := newStat(t)
+	s.Requests.WithLabelValues("200").Inc()
+	s.Requests.WithLabelValues("500").Inc()
+	s.Uptime.Set(60)
+	s.Latency.WithLabelValues("200").Observe(0.1)
+
+	err := miserytest.AssertAllSeriesObserved(s, map[string][]prometheus.Labels{
+		"requests_total":  {{"code": "200"}, {"code": "500"}},
+		"uptime_seconds":  nil,
+		"latency_seconds": {{"code": "200"}, {}},
+	})
+	if err != nil {
+		t.Errorf("all series observed: %v", err)
+	}
+}
+
+func TestAssertAllSeriesObservedMissing(t *testing.T) {
+	s := newStat(t)
+	s.Requests.WithLabelValues("200").Inc()
+
+	err := miserytest.AssertAllSeriesObserved(s, map[string][]prometheus.Labels{
+		"requests_total": {{"code": "200"}, {"code": "503"}},
+		"inflight":       {{"pool": "db"}},
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	want := "metric inflight has no series\n" +
+		"metric requests_total has no series with labels map[code:503]"
+	if err.Error() != want {
+		t.Errorf("error %q, want %q", err, want)
+	}
+}
@@ -0,0 +1,63 @@
+package misery
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RegisterMetricsMulti builds the metrics of mtrcs once and registers every
+// collector into each of registries, so the struct fields hold a single
+// instance exported by all of them. On any failure nothing stays registered
+// in any registry. Calling it without registries fails with ErrNilRegistry.
+func RegisterMetricsMulti(mtrcs interface{}, registries ...prometheus.Registerer) error {
+	if len(registries) == 0 {
+		return fmt.Errorf("%w: no registries given", ErrNilRegistry)
+	}
+	for i, registry := range registries {
+		if err := checkRegistry(registry); err != nil {
+			return fmt.Errorf("registry %d: %w", i, err)
+		}
+	}
+
+	_, err := registerMetrics(context.Background(), mtrcs, multiRegisterer(registries), newConfig())
+	return err
+}
+
+// multiRegisterer fans registration out to several registerers. Register is
+// all or nothing: a collector rejected by one registerer is unregistered from
+// those that already accepted it.
+type multiRegisterer []prometheus.Registerer
+
+func (m multiRegisterer) Register(collector prometheus.Collector) error {
+	for i, registry := range m {
+		if err := registry.Register(collector); err != nil {
+			for _, done := range m[:i] {
+				done.Unregister(collector)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m multiRegisterer) MustRegister(collectors ...prometheus.Collector) {
+	for _, collector := range collectors {
+		if err := m.Register(collector); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (m multiRegisterer) Unregister(collector prometheus.Collector) bool {
+	unregistered := false
+	for _, registry := range m {
+		if registry.Unregister(collector) {
+			unregistered = true
+		}
+	}
+
+	return unregistered
+}
@@ -0,0 +1,89 @@
+package misery
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRegisterMetricsMulti(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,help=Requests.,labels=[code]"`
+		Uptime   prometheus.Gauge       `misery:"name=uptime_seconds,help=Uptime."`
+	}
+
+	public, internal := prometheus.NewRegistry(), prometheus.NewRegistry()
+	s := &stat{}
+	if err := RegisterMetricsMulti(s, public, internal); err != nil {
+		t.Fatalf("RegisterMetricsMulti: %v", err)
+	}
+	s.Requests.WithLabelValues("200").Add(2)
+	s.Uptime.Set(30)
+
+	want := `
+# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{code="200"} 2
+# HELP uptime_seconds Uptime.
+# TYPE uptime_seconds gauge
+uptime_seconds 30
+`
+	for name, registry := range map[string]*prometheus.Registry{"public": public, "internal": internal} {
+		if err := testutil.GatherAndCompare(registry, strings.NewReader(want)); err != nil {
+			t.Errorf("%s registry: %v", name, err)
+		}
+	}
+}
+
+func TestRegisterMetricsMultiRollback(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,labels=[code]"`
+		Uptime   prometheus.Gauge       `misery:"name=uptime_seconds"`
+	}
+
+	// the second registry already has uptime_seconds, so registering it
+	// there fails after requests_total went into both registries
+	public, internal := prometheus.NewRegistry(), prometheus.NewRegistry()
+	internal.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "uptime_seconds", Help: "Taken."}))
+
+	s := &stat{}
+	if err := RegisterMetricsMulti(s, public, internal); err == nil {
+		t.Fatal("expected an error")
+	}
+	if n := testutil.CollectAndCount(public); n != 0 {
+		t.Errorf("%d metrics left in the first registry", n)
+	}
+	if n := testutil.CollectAndCount(internal); n != 1 {
+		t.Errorf("%d metrics in the second registry, want only the one registered before", n)
+	}
+	if s.Requests != nil || s.Uptime != nil {
+		t.Error("fields left set after rollback")
+	}
+}
+
+func TestRegisterMetricsMultiNilRegistry(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total"`
+	}
+
+	if err := RegisterMetricsMulti(&stat{}, prometheus.NewRegistry(), nil); err == nil {
+		t.Fatal("expected an error for a nil registry")
+	}
+}
+
+func TestRegisterMetricsMultiNoRegistries(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total"`
+	}
+
+	var s stat
+	if err := RegisterMetricsMulti(&s); !errors.Is(err, ErrNilRegistry) {
+		t.Fatalf("got error %v, want ErrNilRegistry", err)
+	}
+	if s.Requests != nil {
+		t.Error("field set without registries")
+	}
+}
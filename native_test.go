@@ -0,0 +1,149 @@
+package misery
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestNativeHistogramAttributes(t *testing.T) {
+	tests := []struct {
+		name    string
+		tag     string
+		strict  bool
+		wantErr bool
+		warning bool
+	}{
+		{name: "factor", tag: "native_factor=1.1"},
+		{name: "factor with max buckets and reset duration", tag: "native_factor=1.1,native_max_buckets=100,native_min_reset_duration=1h"},
+		{name: "factor not above 1", tag: "native_factor=1", wantErr: true},
+		{name: "factor not a number", tag: "native_factor=big", wantErr: true},
+		{name: "max buckets not an integer", tag: "native_factor=1.1,native_max_buckets=1.5", wantErr: true},
+		{name: "max buckets not positive", tag: "native_factor=1.1,native_max_buckets=0", wantErr: true},
+		{name: "reset duration malformed", tag: "native_factor=1.1,native_min_reset_duration=soon", wantErr: true},
+		{name: "reset duration negative", tag: "native_factor=1.1,native_min_reset_duration=-1h", wantErr: true},
+		{name: "max buckets without factor", tag: "native_max_buckets=100", warning: true},
+		{name: "reset duration without factor", tag: "native_min_reset_duration=1h", warning: true},
+		{name: "max buckets without factor in strict mode", tag: "native_max_buckets=100", strict: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defs := parseTestTag(t, "name=latency_seconds,"+tt.tag)
+			logger := &recordLogger{}
+			cfg := newConfig(WithLogger(logger), WithStrict(tt.strict))
+			_, info, err := createPrometheusHistogram("Latency", defs, cfg)
+			if tt.wantErr {
+				if !errors.Is(err, ErrAttributeMalformed) {
+					t.Fatalf("got error %v, want ErrAttributeMalformed", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("createPrometheusHistogram: %v", err)
+			}
+			if tt.warning != strings.Contains(logger.String(), "require native_factor") {
+				t.Errorf("warning logged: %q", logger.String())
+			}
+			if !tt.warning && info.nativeFactor != 1.1 {
+				t.Errorf("native factor %v, want 1.1", info.nativeFactor)
+			}
+		})
+	}
+}
+
+func TestNativeHistogramMaxBuckets(t *testing.T) {
+	type stat struct {
+		Unlimited prometheus.Histogram `misery:"name=unlimited_seconds,native_factor=1.1"`
+		Limited   prometheus.Histogram `misery:"name=limited_seconds,native_factor=1.1,native_max_buckets=4"`
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	for v := 1.0; v < 1000; v *= 1.5 {
+		s.Unlimited.Observe(v)
+		s.Limited.Observe(v)
+	}
+
+	unlimited := gatherFamily(t, registry, "unlimited_seconds").GetMetric()[0].GetHistogram()
+	limited := gatherFamily(t, registry, "limited_seconds").GetMetric()[0].GetHistogram()
+	if unlimited.GetSchema() != 3 {
+		t.Errorf("schema %d for factor 1.1, want 3", unlimited.GetSchema())
+	}
+	if limited.GetSchema() >= unlimited.GetSchema() {
+		t.Errorf("schema %d was not reduced below %d by native_max_buckets", limited.GetSchema(), unlimited.GetSchema())
+	}
+}
+
+func TestNativeHistogramWithClassicBuckets(t *testing.T) {
+	type stat struct {
+		Latency prometheus.Histogram `misery:"name=latency_seconds,buckets=[0.1,1,10],native_factor=1.1"`
+	}
+
+	defs := parseTestTag(t, "name=latency_seconds,buckets=[0.1,1,10],native_factor=1.1")
+	_, info, err := createPrometheusHistogram("Latency", defs, newConfig())
+	if err != nil {
+		t.Fatalf("createPrometheusHistogram: %v", err)
+	}
+	if info.nativeFactor != 1.1 {
+		t.Errorf("native factor %v, want 1.1", info.nativeFactor)
+	}
+	if got := fmt.Sprint(info.buckets); got != "[0.1 1 10]" {
+		t.Errorf("buckets %s, want [0.1 1 10]", got)
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	s.Latency.Observe(0.5)
+
+	histogram := gatherFamily(t, registry, "latency_seconds").GetMetric()[0].GetHistogram()
+	if got := len(histogram.GetBucket()); got != 3 {
+		t.Errorf("got %d classic buckets, want 3", got)
+	}
+	if got := histogram.GetBucket()[1].GetCumulativeCount(); got != 1 {
+		t.Errorf("got %d observations up to 1, want 1", got)
+	}
+	if histogram.Schema == nil {
+		t.Error("got no native schema")
+	}
+	if got := histogram.GetPositiveDelta(); len(got) != 1 || got[0] != 1 {
+		t.Errorf("got native bucket deltas %v, want [1]", got)
+	}
+}
+
+func TestNativeHistogramVec(t *testing.T) {
+	type stat struct {
+		Latency *prometheus.HistogramVec `misery:"name=latency_seconds,labels=[code],native_factor=1.1,native_max_buckets=100,native_min_reset_duration=1h"`
+		Classic *prometheus.HistogramVec `misery:"name=classic_seconds,labels=[code]"`
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	for _, code := range []string{"200", "500"} {
+		s.Latency.WithLabelValues(code).Observe(0.5)
+		s.Classic.WithLabelValues(code).Observe(0.5)
+	}
+
+	for _, metric := range gatherFamily(t, registry, "latency_seconds").GetMetric() {
+		histogram := metric.GetHistogram()
+		if histogram.Schema == nil || histogram.GetSchema() != 3 {
+			t.Errorf("series %v: native schema %v, want 3", metric.GetLabel(), histogram.Schema)
+		}
+	}
+	for _, metric := range gatherFamily(t, registry, "classic_seconds").GetMetric() {
+		if metric.GetHistogram().Schema != nil {
+			t.Errorf("series %v of a classic histogram has a native schema", metric.GetLabel())
+		}
+	}
+}
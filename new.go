@@ -0,0 +1,24 @@
+package misery
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// New allocates a T, registers its metrics into
+// prometheus.DefaultRegisterer and returns it:
+//
+//	stat, err := misery.New[Stat]()
+//
+// T must be a struct type.
+func New[T any]() (*T, error) {
+	return NewWith[T](prometheus.DefaultRegisterer)
+}
+
+// NewWith is New registering into registry with opts, as
+// RegisterMetricsWithOptions does.
+func NewWith[T any](registry prometheus.Registerer, opts ...Option) (*T, error) {
+	mtrcs := new(T)
+	if err := RegisterMetricsWithOptions(mtrcs, registry, opts...); err != nil {
+		return nil, err
+	}
+
+	return mtrcs, nil
+}
@@ -0,0 +1,83 @@
+package misery
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type newStat struct {
+	Requests *prometheus.CounterVec `misery:"name=misery_new_test_requests_total,help=Requests.,labels=[code]"`
+	Uptime   prometheus.Gauge       `misery:"name=misery_new_test_uptime_seconds,help=Uptime."`
+}
+
+func TestNew(t *testing.T) {
+	s, err := New[newStat]()
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := UnregisterMetrics(s, prometheus.DefaultRegisterer); err != nil {
+			t.Errorf("UnregisterMetrics: %v", err)
+		}
+	})
+
+	if s.Requests == nil || s.Uptime == nil {
+		t.Fatal("fields not populated")
+	}
+	s.Requests.WithLabelValues("200").Inc()
+	s.Uptime.Set(60)
+
+	n, err := testutil.GatherAndCount(prometheus.DefaultGatherer,
+		"misery_new_test_requests_total", "misery_new_test_uptime_seconds")
+	if err != nil {
+		t.Fatalf("GatherAndCount: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("%d series in the default registry, want 2", n)
+	}
+
+	// the metrics are taken now
+	if _, err := New[newStat](); err == nil {
+		t.Error("second New: expected an error")
+	}
+}
+
+func TestNewWith(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	s, err := NewWith[newStat](registry, WithRegistererLabels(prometheus.Labels{"app": "api"}))
+	if err != nil {
+		t.Fatalf("NewWith: %v", err)
+	}
+	s.Uptime.Set(60)
+
+	want := `
+# HELP misery_new_test_uptime_seconds Uptime.
+# TYPE misery_new_test_uptime_seconds gauge
+misery_new_test_uptime_seconds{app="api"} 60
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want), "misery_new_test_uptime_seconds"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewWithErrors(t *testing.T) {
+	type broken struct {
+		Requests *prometheus.CounterVec `misery:"name=broken-name"`
+	}
+
+	s, err := NewWith[broken](prometheus.NewRegistry())
+	if !errors.Is(err, ErrAttributeMalformed) {
+		t.Errorf("malformed tag: got error %v, want %v", err, ErrAttributeMalformed)
+	}
+	if s != nil {
+		t.Error("malformed tag: got a struct along with the error")
+	}
+
+	if _, err := NewWith[int](prometheus.NewRegistry()); !errors.Is(err, ErrStructPointerRequired) {
+		t.Errorf("non-struct type: got error %v, want %v", err, ErrStructPointerRequired)
+	}
+}
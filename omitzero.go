@@ -0,0 +1,34 @@
+package misery
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// omitZeroCollector is registered in place of a histogram vec when
+// WithOmitZero is in effect. Series that have not seen an observation yet,
+// such as those created by label initialization, are left out of the
+// exposition, together with their buckets, _sum and _count.
+type omitZeroCollector struct {
+	prometheus.Collector
+}
+
+func (c omitZeroCollector) unwrap() prometheus.Collector {
+	return c.Collector
+}
+
+func (c omitZeroCollector) Collect(ch chan<- prometheus.Metric) {
+	inner := make(chan prometheus.Metric)
+	go func() {
+		c.Collector.Collect(inner)
+		close(inner)
+	}()
+
+	for m := range inner {
+		var pb dto.Metric
+		if err := m.Write(&pb); err == nil && pb.GetHistogram().GetSampleCount() == 0 {
+			continue
+		}
+		ch <- m
+	}
+}
@@ -0,0 +1,401 @@
+package misery
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Logger receives messages about non-fatal registration events.
+// *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Printf(string, ...interface{}) {}
+
+// Option tunes how metrics are built and registered.
+type Option func(*config)
+
+type config struct {
+	logger         Logger
+	maxCardinality int
+	register       bool
+	collectErrors  bool
+	autoHelp       bool
+	strict         bool
+	enabled        func(field string) bool
+	nameTrimPrefix string
+	tagKeys        []string
+
+	ignoreAlreadyRegistered bool
+	errorOnEmptyLabels      bool
+	clearFields             bool
+	bucketFunc              func(field string) []float64
+	selfMetrics             bool
+	lenient                 bool
+	labelFromContext        map[string]func(context.Context) string
+	helpResolver            func(key string) (string, bool)
+	requireHelp             bool
+	counterGuard            bool
+	replaceExisting         bool
+	registererLabels        prometheus.Labels
+	dedupLabels             bool
+	afterRegister           func(field string, c prometheus.Collector)
+	requireTag              bool
+	omitZero                bool
+	metricFilter            func(fieldName, metricName string) bool
+	shareIdentical          bool
+	maxBuckets              int
+	defaultBuckets          []float64
+	cardinalityMetrics      bool
+
+	bucketPresets    map[string][]float64
+	objectivePresets map[string]map[float64]float64
+
+	// unrecorded keeps the registration from being recorded for its
+	// instance, for registerers built anew for the call.
+	unrecorded bool
+}
+
+func newConfig(opts ...Option) *config {
+	cfg := &config{
+		logger:   nopLogger{},
+		register: true,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	return cfg
+}
+
+// WithLogger sets the logger used to report non-fatal events. Nil restores
+// the default, which discards everything.
+func WithLogger(logger Logger) Option {
+	return func(cfg *config) {
+		if logger == nil {
+			logger = nopLogger{}
+		}
+		cfg.logger = logger
+	}
+}
+
+// WithMaxCardinality caps every vec metric at n distinct series; zero or less
+// disables the cap. The cap is enforced when the vec is collected, not when
+// a series is created, so it bounds memory only between scrapes. See
+// cardinalityGuard for the trade-offs.
+func WithMaxCardinality(n int) Option {
+	return func(cfg *config) {
+		cfg.maxCardinality = n
+	}
+}
+
+// WithRegister controls whether built collectors are registered. With false
+// the struct fields are still populated, so code can use the collectors, but
+// nothing shows up in the registry until the struct is registered again.
+// That registration builds the vec fields anew; single series fields are
+// non-nil by then and kept as they are, like fakes, so they stay
+// unregistered.
+func WithRegister(register bool) Option {
+	return func(cfg *config) {
+		cfg.register = register
+	}
+}
+
+// WithCollectAllErrors makes registration go through every field and report
+// all problems at once, joined with errors.Join, instead of stopping at the
+// first one. Nothing stays registered when any error is reported.
+func WithCollectAllErrors(collect bool) Option {
+	return func(cfg *config) {
+		cfg.collectErrors = collect
+	}
+}
+
+// WithAutoHelp derives help text from the field name, SecondsFromStart
+// becoming "Seconds from start", for metrics that get help neither from
+// their tag nor from a sibling <Field>Help field. Off by default.
+func WithAutoHelp(auto bool) Option {
+	return func(cfg *config) {
+		cfg.autoHelp = auto
+	}
+}
+
+// WithStrict turns questionable but workable tag combinations, which are
+// otherwise only logged, into registration errors.
+func WithStrict(strict bool) Option {
+	return func(cfg *config) {
+		cfg.strict = strict
+	}
+}
+
+// WithEnabled lets runtime code switch metrics off by struct field name.
+// It is asked only about fields their tags leave enabled; see fieldEnabled.
+func WithEnabled(enabled func(field string) bool) Option {
+	return func(cfg *config) {
+		cfg.enabled = enabled
+	}
+}
+
+// WithNameTrimPrefix strips prefix from metric names derived from field
+// names, so LegacyHTTPRequests with prefix Legacy becomes http_requests. The
+// prefix is snake cased like the field name, so "Legacy" and "legacy_" are
+// equivalent. Names set explicitly with the name attribute are kept as is.
+func WithNameTrimPrefix(prefix string) Option {
+	return func(cfg *config) {
+		cfg.nameTrimPrefix = prefix
+	}
+}
+
+// WithTagKeys reads attributes from the primary struct tag key, "misery" by
+// default, and then from every continuation key, so a long tag can be split
+// like `misery:"name=foo" misery_labels:"labels=[a,b]"`. Definitions from all
+// keys are merged in the order the keys are given.
+func WithTagKeys(primary string, continuations ...string) Option {
+	return func(cfg *config) {
+		cfg.tagKeys = append([]string{primary}, continuations...)
+	}
+}
+
+// WithIgnoreAlreadyRegistered makes a field whose metric is already
+// registered, for example by another struct sharing it, use the registered
+// collector instead of failing. Rolling back never unregisters such shared
+// collectors.
+func WithIgnoreAlreadyRegistered(ignore bool) Option {
+	return func(cfg *config) {
+		cfg.ignoreAlreadyRegistered = ignore
+	}
+}
+
+// WithErrorOnEmptyLabels rejects vec fields that end up with no labels,
+// which are usually a mistake for a plain metric. Single series fields like
+// prometheus.Counter have no labels by design and are not affected. Off by
+// default.
+func WithErrorOnEmptyLabels(errorOnEmpty bool) Option {
+	return func(cfg *config) {
+		cfg.errorOnEmptyLabels = errorOnEmpty
+	}
+}
+
+// WithClearFields makes UnregisterMetrics reset the unregistered fields to
+// nil, so stale collectors cannot be used by mistake.
+func WithClearFields(clear bool) Option {
+	return func(cfg *config) {
+		cfg.clearFields = clear
+	}
+}
+
+// WithBucketFunc computes buckets for histogram fields whose tag has no
+// buckets attribute. It is called with the struct field name; returning nil
+// keeps the default buckets. The result must be strictly increasing.
+func WithBucketFunc(bucketFunc func(field string) []float64) Option {
+	return func(cfg *config) {
+		cfg.bucketFunc = bucketFunc
+	}
+}
+
+// WithSelfMetrics additionally exposes misery_registered_metrics, the number
+// of metrics registered per struct type, on the same registry.
+func WithSelfMetrics(self bool) Option {
+	return func(cfg *config) {
+		cfg.selfMetrics = self
+	}
+}
+
+// WithLenient makes a field that fails to build or register get logged
+// and skipped instead of failing the registration, which then succeeds
+// with the remaining fields. It takes precedence over WithCollectAllErrors.
+func WithLenient(lenient bool) Option {
+	return func(cfg *config) {
+		cfg.lenient = lenient
+	}
+}
+
+// WithLabelFromContext sets, per label name, the function Report.ObserveCtx
+// uses to take the label value from a context. Only histogram and summary
+// vecs registered with this option can be observed through ObserveCtx.
+func WithLabelFromContext(extractors map[string]func(context.Context) string) Option {
+	return func(cfg *config) {
+		cfg.labelFromContext = extractors
+	}
+}
+
+// WithHelpResolver sets the function resolving the help_key attribute to
+// help text, for example from a message catalog. A key it does not know
+// falls back to the help the field gets otherwise.
+func WithHelpResolver(resolve func(key string) (string, bool)) Option {
+	return func(cfg *config) {
+		cfg.helpResolver = resolve
+	}
+}
+
+// WithRequireHelp rejects metrics that end up without help text, whether
+// from the tag, help_key, a sibling <Field>Help field or WithAutoHelp.
+func WithRequireHelp(require bool) Option {
+	return func(cfg *config) {
+		cfg.requireHelp = require
+	}
+}
+
+// WithCounterGuard makes the counters returned by Report.Counter, and by
+// Report.BindLabels for counter vecs, log and ignore negative increments,
+// which would otherwise panic. Only those are guarded: calls made on the
+// counter or counter vec in the struct field itself still panic.
+func WithCounterGuard(guard bool) Option {
+	return func(cfg *config) {
+		cfg.counterGuard = guard
+	}
+}
+
+// WithReplaceExisting makes a field whose metric is already registered by
+// an earlier registration with WithReplaceExisting take its place, so a
+// reloaded struct starts over with fresh collectors, even when the new
+// definition changes help or labels. Every replacement is logged, and
+// rolling back a failed registration puts the replaced collectors back.
+// WithIgnoreAlreadyRegistered takes precedence.
+//
+// Collectors are registered through a wrapper describing placeholders made
+// of the metric names, which a registry created with
+// prometheus.NewPedanticRegistry rejects on Gather. Metrics registered
+// without the option cannot be replaced.
+func WithReplaceExisting(replace bool) Option {
+	return func(cfg *config) {
+		cfg.replaceExisting = replace
+	}
+}
+
+// WithRegistererLabels adds labels as constant labels to every metric
+// registered, by registering through prometheus.WrapRegistererWith, for
+// labels like instance or shard shared by a whole struct.
+func WithRegistererLabels(labels prometheus.Labels) Option {
+	return func(cfg *config) {
+		cfg.registererLabels = labels
+	}
+}
+
+// WithDedupLabels drops repeated label names, keeping the first occurrence,
+// instead of rejecting the field.
+func WithDedupLabels(dedup bool) Option {
+	return func(cfg *config) {
+		cfg.dedupLabels = dedup
+	}
+}
+
+// WithAfterRegister sets a hook called with the field name and collector of
+// every collector registered, once the whole registration has succeeded,
+// in registration order. Skipped fields, fields built with WithRegister
+// false and collectors reused through WithIgnoreAlreadyRegistered are not
+// passed to it. Nested fields are named like Inner.Field.
+func WithAfterRegister(hook func(field string, c prometheus.Collector)) Option {
+	return func(cfg *config) {
+		cfg.afterRegister = hook
+	}
+}
+
+// WithRequireTag stops metric fields without a misery tag from being built
+// with default names: they are skipped and logged, or rejected under
+// WithStrict. An empty tag, misery:"", opts a field in with the defaults.
+// Fields tagged with skip have a tag and are skipped as usual.
+func WithRequireTag(require bool) Option {
+	return func(cfg *config) {
+		cfg.requireTag = require
+	}
+}
+
+// WithOmitZero leaves histogram series that have no observations yet out of
+// the exposition, which keeps scrapes of sparse histograms with many
+// initialized label combinations small. The series still exist in the vec
+// and show up with their first observation.
+func WithOmitZero(omit bool) Option {
+	return func(cfg *config) {
+		cfg.omitZero = omit
+	}
+}
+
+// WithMetricFilter builds and registers only the metrics filter returns true
+// for. Unlike WithEnabled the filter sees the resolved metric name too, so it
+// is asked after the metric is built and can exclude metrics by name prefix,
+// say. Excluded fields are left as they are, nil unless set before.
+func WithMetricFilter(filter func(fieldName, metricName string) bool) Option {
+	return func(cfg *config) {
+		cfg.metricFilter = filter
+	}
+}
+
+// WithShareIdentical lets fields declaring the same metric, with the same
+// name, kind, help, labels and buckets or objectives, share the collector
+// built for the first of them instead of failing with
+// ErrDuplicateMetricName. It applies within one registration call, across
+// the nested structs of a struct or the structs of RegisterAllWithOptions.
+// Fields declaring the same name differently still fail.
+func WithShareIdentical(share bool) Option {
+	return func(cfg *config) {
+		cfg.shareIdentical = share
+	}
+}
+
+// WithMaxBuckets fails the registration of any histogram with more than n
+// buckets once presets, references and WithBucketFunc are resolved, to catch
+// runaway bucket generators. Zero or less, the default, means no limit.
+func WithMaxBuckets(n int) Option {
+	return func(cfg *config) {
+		cfg.maxBuckets = n
+	}
+}
+
+// WithDefaultBuckets replaces the buckets of histograms that neither set
+// buckets nor get them from WithBucketFunc. buckets must be strictly
+// increasing, which is checked when a histogram is built with them; nil
+// restores the package defaults.
+func WithDefaultBuckets(buckets []float64) Option {
+	buckets = append([]float64(nil), buckets...)
+	return func(cfg *config) {
+		cfg.defaultBuckets = buckets
+	}
+}
+
+// WithCardinalityMetrics additionally exposes misery_series_count, the
+// number of series each vec with labels holds, labeled with the metric name.
+// Series are counted on every scrape, which costs a collection of the vec.
+func WithCardinalityMetrics(cardinality bool) Option {
+	return func(cfg *config) {
+		cfg.cardinalityMetrics = cardinality
+	}
+}
+
+// WithBucketPresets makes named bucket lists available to histogram tags as
+// buckets=name or buckets=preset(name), next to the built-in def, latency
+// and sizes presets, which a preset of the same name replaces. Repeated
+// calls add to the presets already set.
+func WithBucketPresets(presets map[string][]float64) Option {
+	return func(cfg *config) {
+		if cfg.bucketPresets == nil {
+			cfg.bucketPresets = make(map[string][]float64, len(presets))
+		}
+		for name, buckets := range presets {
+			cfg.bucketPresets[name] = buckets
+		}
+	}
+}
+
+// WithObjectivePresets makes named quantile objectives available to summary
+// tags as objectives=preset(name). Repeated calls add to the presets already
+// set.
+func WithObjectivePresets(presets map[string]map[float64]float64) Option {
+	return func(cfg *config) {
+		if cfg.objectivePresets == nil {
+			cfg.objectivePresets = make(map[string]map[float64]float64, len(presets))
+		}
+		for name, objectives := range presets {
+			cfg.objectivePresets[name] = objectives
+		}
+	}
+}
+
+// RegisterMetricsWithOptions is RegisterMetrics with behaviour tuned by opts.
+func RegisterMetricsWithOptions(mtrcs interface{}, registry prometheus.Registerer, opts ...Option) error {
+	_, err := registerMetrics(context.Background(), mtrcs, registry, newConfig(opts...))
+	return err
+}
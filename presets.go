@@ -0,0 +1,333 @@
+package misery
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yuin/stagparser"
+)
+
+// presetName extracts name from a preset(name) expression.
+func presetName(expr string) (string, error) {
+	fn, args, err := parseCall(expr)
+	if err != nil {
+		return "", err
+	}
+	if fn != "preset" || len(args) != 1 || args[0] == "" {
+		return "", fmt.Errorf("%w: %q is not preset(name)", ErrAttributeMalformed, expr)
+	}
+
+	return args[0], nil
+}
+
+// builtinBucketPresets are the bucket presets available without
+// WithBucketPresets, which can replace them.
+var builtinBucketPresets = map[string][]float64{
+	// def is prometheus.DefBuckets, for network service latencies
+	"def": prometheus.DefBuckets,
+	// latency spans 1ms to 10s, finer than def below 100ms
+	"latency": {0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	// sizes spans 64 bytes to 16MiB in powers of 4
+	"sizes": prometheus.ExponentialBuckets(64, 4, 10),
+}
+
+// resolveBucketExpr resolves a buckets expression: a preset name, alone or
+// as preset(name), exp(start, factor, count), linear(start, width, count)
+// or env(VAR). found is false for an unset or empty variable, which is an
+// error only in strict mode.
+func resolveBucketExpr(expr string, cfg *config) (buckets []float64, found bool, err error) {
+	if name := strings.TrimSpace(expr); !strings.ContainsAny(name, "()") {
+		buckets, err := bucketPreset(name, cfg)
+		return buckets, err == nil, err
+	}
+	fn, args, err := parseCall(expr)
+	if err != nil {
+		return nil, false, err
+	}
+	if fn == "exp" {
+		buckets, err := exponentialBuckets(args)
+		return buckets, err == nil, err
+	}
+	if fn == "linear" {
+		buckets, err := linearBuckets(args)
+		return buckets, err == nil, err
+	}
+	if fn != "env" {
+		buckets, err := resolveBucketPreset(expr, cfg)
+		return buckets, err == nil, err
+	}
+	if len(args) != 1 || args[0] == "" {
+		return nil, false, fmt.Errorf("%w: %q is not env(VAR)", ErrAttributeMalformed, expr)
+	}
+
+	value := strings.TrimSpace(os.Getenv(args[0]))
+	if value == "" {
+		if cfg.strict {
+			return nil, false, fmt.Errorf("%w: environment variable %s is not set", ErrAttributeMalformed, args[0])
+		}
+		return nil, false, nil
+	}
+	for _, part := range strings.Split(value, ",") {
+		bucket, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, false, fmt.Errorf("%w: bucket %q in %s is not a number", ErrAttributeMalformed, part, args[0])
+		}
+		buckets = append(buckets, bucket)
+	}
+
+	return buckets, true, nil
+}
+
+// exponentialBuckets returns prometheus.ExponentialBuckets for the
+// arguments of exp(start, factor, count), checked so that it cannot panic.
+func exponentialBuckets(args []string) ([]float64, error) {
+	start, factor, count, err := bucketSeriesArgs("exp", args)
+	if err != nil {
+		return nil, err
+	}
+	if start <= 0 || factor <= 1 {
+		return nil, fmt.Errorf("%w: exp needs a start above 0 and a factor above 1", ErrAttributeMalformed)
+	}
+
+	return prometheus.ExponentialBuckets(start, factor, count), nil
+}
+
+// linearBuckets returns prometheus.LinearBuckets for the arguments of
+// linear(start, width, count), checked so that it cannot panic.
+func linearBuckets(args []string) ([]float64, error) {
+	start, width, count, err := bucketSeriesArgs("linear", args)
+	if err != nil {
+		return nil, err
+	}
+	if width <= 0 {
+		return nil, fmt.Errorf("%w: linear needs a width above 0", ErrAttributeMalformed)
+	}
+
+	return prometheus.LinearBuckets(start, width, count), nil
+}
+
+// maxBucketCount bounds the count of exp and linear bucket expressions, so
+// a typo in a tag cannot allocate a huge slice before WithMaxBuckets gets
+// to check the result.
+const maxBucketCount = 1000
+
+// bucketSeriesArgs parses the arguments of fn(start, step, count), where
+// count is a positive integer no larger than maxBucketCount.
+func bucketSeriesArgs(fn string, args []string) (start, step float64, count int, err error) {
+	if len(args) != 3 {
+		return 0, 0, 0, fmt.Errorf("%w: %s takes 3 arguments, got %d", ErrAttributeMalformed, fn, len(args))
+	}
+	if start, err = strconv.ParseFloat(args[0], 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("%w: %s start %q is not a number", ErrAttributeMalformed, fn, args[0])
+	}
+	if step, err = strconv.ParseFloat(args[1], 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("%w: %s step %q is not a number", ErrAttributeMalformed, fn, args[1])
+	}
+	if count, err = strconv.Atoi(args[2]); err != nil || count < 1 {
+		return 0, 0, 0, fmt.Errorf("%w: %s count %q is not a positive integer", ErrAttributeMalformed, fn, args[2])
+	}
+	if count > maxBucketCount {
+		return 0, 0, 0, fmt.Errorf("%w: %s count %d exceeds the limit of %d", ErrAttributeMalformed, fn, count, maxBucketCount)
+	}
+
+	return start, step, count, nil
+}
+
+func resolveBucketPreset(expr string, cfg *config) ([]float64, error) {
+	name, err := presetName(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	return bucketPreset(name, cfg)
+}
+
+// bucketPreset returns a copy of the buckets of the preset name, looked up
+// in WithBucketPresets first and in builtinBucketPresets then.
+func bucketPreset(name string, cfg *config) ([]float64, error) {
+	buckets, ok := cfg.bucketPresets[name]
+	if !ok {
+		buckets, ok = builtinBucketPresets[name]
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown bucket preset %s", ErrAttributeMalformed, name)
+	}
+
+	return append([]float64(nil), buckets...), nil
+}
+
+// resolveObjectives returns the objectives written as a map of quantiles to
+// their allowed errors, like {0.5:0.05, 0.99:0.001}, or named by a preset.
+func resolveObjectives(expr string, cfg *config) (map[float64]float64, error) {
+	if !strings.HasPrefix(strings.TrimSpace(expr), "{") {
+		return resolveObjectivePreset(expr, cfg)
+	}
+
+	entries, err := parseMap(expr)
+	if err != nil {
+		return nil, err
+	}
+	objectives := make(map[float64]float64, len(entries))
+	for _, entry := range entries {
+		quantile, err := strconv.ParseFloat(entry.key, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: objective quantile %s is not a number between 0 and 1", ErrAttributeMalformed, entry.key)
+		}
+		epsilon, err := strconv.ParseFloat(entry.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: objective error %s is not a number between 0 and 1", ErrAttributeMalformed, entry.value)
+		}
+		if _, ok := objectives[quantile]; ok {
+			return nil, fmt.Errorf("%w: objective quantile %s is repeated", ErrAttributeMalformed, entry.key)
+		}
+		objectives[quantile] = epsilon
+	}
+
+	return objectives, checkObjectives(objectives)
+}
+
+// checkObjectives fails unless every quantile and allowed error of
+// objectives is between 0 and 1.
+func checkObjectives(objectives map[float64]float64) error {
+	for quantile, epsilon := range objectives {
+		if quantile < 0 || quantile > 1 {
+			return fmt.Errorf("%w: objective quantile %v is not a number between 0 and 1", ErrAttributeMalformed, quantile)
+		}
+		if epsilon < 0 || epsilon > 1 {
+			return fmt.Errorf("%w: objective error %v is not a number between 0 and 1", ErrAttributeMalformed, epsilon)
+		}
+	}
+
+	return nil
+}
+
+func resolveObjectivePreset(expr string, cfg *config) (map[float64]float64, error) {
+	name, err := presetName(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	objectives, ok := cfg.objectivePresets[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown objective preset %s", ErrAttributeMalformed, name)
+	}
+
+	copied := make(map[float64]float64, len(objectives))
+	for quantile, epsilon := range objectives {
+		copied[quantile] = epsilon
+	}
+
+	return copied, nil
+}
+
+// resolveBucketReferences replaces every buckets=same_as(Field) in tags with
+// the buckets of Field, following chains of references. A referenced field
+// without a buckets attribute lends the buckets it would be built with; the
+// bucket_unit of the referenced field replaces that of the referencing one.
+func resolveBucketReferences(
+	structValue reflect.Value,
+	tags map[string][]stagparser.Definition,
+	cfg *config,
+) error {
+	resolved := map[string]bool{}
+	var resolve func(field string, path []string) error
+	resolve = func(field string, path []string) error {
+		if resolved[field] {
+			return nil
+		}
+		for i, seen := range path {
+			if seen == field {
+				return fmt.Errorf("%w: buckets reference cycle %s", ErrAttributeMalformed,
+					strings.Join(append(path[i:], field), " -> "))
+			}
+		}
+		path = append(path, field)
+
+		defs := tags[field]
+		for i, def := range defs {
+			if def.Name() != "buckets" {
+				continue
+			}
+			ref, ok, err := bucketReference(def.Attributes()["buckets"])
+			if err != nil {
+				return fmt.Errorf("%s: %w", field, err)
+			}
+			if !ok {
+				continue
+			}
+			if _, ok := structValue.Type().FieldByName(ref); !ok {
+				return fmt.Errorf("%s: %w: buckets reference unknown field %s", field, ErrAttributeMalformed, ref)
+			}
+			if err := resolve(ref, path); err != nil {
+				return err
+			}
+
+			replaced := make([]stagparser.Definition, 0, len(defs)+1)
+			for j, def := range defs {
+				switch {
+				case j == i:
+					replaced = append(replaced, referencedBuckets(ref, tags[ref], cfg))
+				case def.Name() != "bucket_unit":
+					replaced = append(replaced, def)
+				}
+			}
+			for _, def := range tags[ref] {
+				if def.Name() == "bucket_unit" && hasDefinition(tags[ref], "buckets") {
+					replaced = append(replaced, def)
+				}
+			}
+			tags[field] = replaced
+		}
+		resolved[field] = true
+
+		return nil
+	}
+
+	for i := 0; i < structValue.NumField(); i++ {
+		if err := resolve(structValue.Type().Field(i).Name, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// bucketReference extracts Field from a same_as(Field) buckets value. ok is
+// false for any other value.
+func bucketReference(value interface{}) (ref string, ok bool, err error) {
+	expr, isString := value.(string)
+	if !isString {
+		return "", false, nil
+	}
+	fn, args, err := parseCall(expr)
+	if err != nil || fn != "same_as" {
+		return "", false, nil
+	}
+	if len(args) != 1 || args[0] == "" {
+		return "", false, fmt.Errorf("%w: %q is not same_as(Field)", ErrAttributeMalformed, expr)
+	}
+
+	return args[0], true, nil
+}
+
+// referencedBuckets returns the buckets definition field is built with.
+func referencedBuckets(field string, defs []stagparser.Definition, cfg *config) stagparser.Definition {
+	for _, def := range defs {
+		if def.Name() == "buckets" {
+			return def
+		}
+	}
+
+	buckets := cfg.histogramBuckets()
+	if cfg.bucketFunc != nil {
+		if computed := cfg.bucketFunc(field); computed != nil {
+			buckets = computed
+		}
+	}
+
+	return newDefinition("buckets", floatList(buckets))
+}
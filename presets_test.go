@@ -0,0 +1,380 @@
+package misery
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestObjectivePresets(t *testing.T) {
+	presets := WithObjectivePresets(map[string]map[float64]float64{
+		"default": {0.5: 0.05, 0.99: 0.001},
+	})
+	bucketPresets := WithBucketPresets(map[string][]float64{"default": {0.1, 1, 10}})
+
+	type known struct {
+		Latency *prometheus.SummaryVec   `misery:"name=latency_seconds,objectives=preset(default)"`
+		Sizes   *prometheus.HistogramVec `misery:"name=sizes_bytes,buckets=preset(default)"`
+	}
+	type unknownObjectives struct {
+		Latency *prometheus.SummaryVec `misery:"name=latency_seconds,objectives=preset(missing)"`
+	}
+	type unknownBuckets struct {
+		Sizes *prometheus.HistogramVec `misery:"name=sizes_bytes,buckets=preset(missing)"`
+	}
+	type malformed struct {
+		Latency *prometheus.SummaryVec `misery:"name=latency_seconds,objectives=preset()"`
+	}
+
+	tests := []struct {
+		name    string
+		mtrcs   interface{}
+		wantErr error
+	}{
+		{name: "known presets", mtrcs: &known{}},
+		{name: "unknown objective preset", mtrcs: &unknownObjectives{}, wantErr: ErrAttributeMalformed},
+		{name: "unknown bucket preset", mtrcs: &unknownBuckets{}, wantErr: ErrAttributeMalformed},
+		{name: "preset without a name", mtrcs: &malformed{}, wantErr: ErrAttributeMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			err := RegisterMetricsWithOptions(tt.mtrcs, registry, presets, bucketPresets)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RegisterMetricsWithOptions: %v", err)
+			}
+
+			s := tt.mtrcs.(*known)
+			s.Latency.WithLabelValues().Observe(1)
+			s.Sizes.WithLabelValues().Observe(1)
+
+			var quantiles []float64
+			for _, q := range gatherFamily(t, registry, "latency_seconds").GetMetric()[0].GetSummary().GetQuantile() {
+				quantiles = append(quantiles, q.GetQuantile())
+			}
+			if want := []float64{0.5, 0.99}; !reflect.DeepEqual(quantiles, want) {
+				t.Errorf("quantiles %v, want %v", quantiles, want)
+			}
+			var buckets []float64
+			for _, b := range gatherFamily(t, registry, "sizes_bytes").GetMetric()[0].GetHistogram().GetBucket() {
+				buckets = append(buckets, b.GetUpperBound())
+			}
+			if want := []float64{0.1, 1, 10}; !reflect.DeepEqual(buckets, want) {
+				t.Errorf("buckets %v, want %v", buckets, want)
+			}
+		})
+	}
+}
+
+func TestBucketReferences(t *testing.T) {
+	type valid struct {
+		Read   *prometheus.HistogramVec `misery:"name=read_seconds,buckets=[0.1,1,10]"`
+		Write  *prometheus.HistogramVec `misery:"name=write_seconds,buckets=same_as(Read)"`
+		Delete *prometheus.HistogramVec `misery:"name=delete_seconds,buckets=same_as(Write)"`
+	}
+	type defaulted struct {
+		Read  *prometheus.HistogramVec `misery:"name=read_seconds"`
+		Write *prometheus.HistogramVec `misery:"name=write_seconds,buckets=same_as(Read)"`
+	}
+	type unknown struct {
+		Write *prometheus.HistogramVec `misery:"name=write_seconds,buckets=same_as(Read)"`
+	}
+	type cycle struct {
+		Read  *prometheus.HistogramVec `misery:"name=read_seconds,buckets=same_as(Write)"`
+		Write *prometheus.HistogramVec `misery:"name=write_seconds,buckets=same_as(Read)"`
+	}
+	type self struct {
+		Read *prometheus.HistogramVec `misery:"name=read_seconds,buckets=same_as(Read)"`
+	}
+
+	tests := []struct {
+		name    string
+		mtrcs   interface{}
+		want    map[string][]float64
+		wantErr string
+	}{
+		{
+			name:  "chained reference",
+			mtrcs: &valid{},
+			want: map[string][]float64{
+				"read_seconds":   {0.1, 1, 10},
+				"write_seconds":  {0.1, 1, 10},
+				"delete_seconds": {0.1, 1, 10},
+			},
+		},
+		{
+			name:  "reference to default buckets",
+			mtrcs: &defaulted{},
+			want: map[string][]float64{
+				"read_seconds":  defaultHistogramBuckets,
+				"write_seconds": defaultHistogramBuckets,
+			},
+		},
+		{name: "unknown field", mtrcs: &unknown{}, wantErr: "Read"},
+		{name: "cycle", mtrcs: &cycle{}, wantErr: "Read -> Write -> Read"},
+		{name: "self reference", mtrcs: &self{}, wantErr: "Read -> Read"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docs, err := DescribeMetrics(tt.mtrcs)
+			if tt.wantErr != "" {
+				if !errors.Is(err, ErrAttributeMalformed) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want ErrAttributeMalformed mentioning %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DescribeMetrics: %v", err)
+			}
+			for _, doc := range docs {
+				if !reflect.DeepEqual(doc.Buckets, tt.want[doc.Name]) {
+					t.Errorf("%s buckets %v, want %v", doc.Name, doc.Buckets, tt.want[doc.Name])
+				}
+			}
+		})
+	}
+}
+
+func TestResolveObjectives(t *testing.T) {
+	cfg := newConfig(WithObjectivePresets(map[string]map[float64]float64{"default": {0.5: 0.05}}))
+
+	tests := []struct {
+		name    string
+		expr    string
+		want    map[float64]float64
+		wantErr bool
+	}{
+		{name: "map", expr: "{0.5:0.05,0.9:0.01,0.99:0.001}", want: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}},
+		{name: "spaces", expr: " {0.5: 0.05, 0.99: 0.001}", want: map[float64]float64{0.5: 0.05, 0.99: 0.001}},
+		{name: "preset", expr: "preset(default)", want: map[float64]float64{0.5: 0.05}},
+		{name: "quantile above 1", expr: "{1.5:0.05}", wantErr: true},
+		{name: "negative error", expr: "{0.5:-0.05}", wantErr: true},
+		{name: "not a number", expr: "{median:0.05}", wantErr: true},
+		{name: "repeated quantile", expr: "{0.5:0.05,0.50:0.01}", wantErr: true},
+		{name: "unterminated", expr: "{0.5:0.05", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveObjectives(tt.expr, cfg)
+			if tt.wantErr {
+				if !errors.Is(err, ErrAttributeMalformed) {
+					t.Fatalf("got error %v, want ErrAttributeMalformed", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveObjectives: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("objectives %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSummaryObjectivesTag(t *testing.T) {
+	type stat struct {
+		Latency *prometheus.SummaryVec `misery:"name=latency_seconds,help=Latency.,labels=[code],objectives={0.5:0.05,0.9:0.01,0.99:0.001}"`
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	s.Latency.WithLabelValues("200").Observe(1)
+
+	var quantiles []float64
+	for _, q := range gatherFamily(t, registry, "latency_seconds").GetMetric()[0].GetSummary().GetQuantile() {
+		quantiles = append(quantiles, q.GetQuantile())
+	}
+	if want := []float64{0.5, 0.9, 0.99}; !reflect.DeepEqual(quantiles, want) {
+		t.Errorf("quantiles %v, want %v", quantiles, want)
+	}
+}
+
+func TestBucketPresetNames(t *testing.T) {
+	cfg := newConfig(WithBucketPresets(map[string][]float64{
+		"rpc": {0.01, 0.1},
+		// replaces the built-in preset of the same name
+		"sizes": {1024, 4096},
+	}))
+
+	tests := []struct {
+		name    string
+		expr    string
+		want    []float64
+		wantErr bool
+	}{
+		{name: "def", expr: "def", want: prometheus.DefBuckets},
+		{name: "latency", expr: "latency", want: []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}},
+		{name: "custom", expr: "rpc", want: []float64{0.01, 0.1}},
+		{name: "custom with preset()", expr: "preset(rpc)", want: []float64{0.01, 0.1}},
+		{name: "built-in replaced", expr: "sizes", want: []float64{1024, 4096}},
+		{name: "spaces", expr: " def ", want: prometheus.DefBuckets},
+		{name: "unknown", expr: "huge", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, found, err := resolveBucketExpr(tt.expr, cfg)
+			if tt.wantErr {
+				if !errors.Is(err, ErrAttributeMalformed) {
+					t.Fatalf("got error %v, want ErrAttributeMalformed", err)
+				}
+				return
+			}
+			if err != nil || !found {
+				t.Fatalf("resolveBucketExpr: %v, found %v", err, found)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buckets %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	builtin, _, err := resolveBucketExpr("sizes", newConfig())
+	if err != nil {
+		t.Fatalf("resolveBucketExpr: %v", err)
+	}
+	if want := prometheus.ExponentialBuckets(64, 4, 10); !reflect.DeepEqual(builtin, want) {
+		t.Errorf("sizes buckets %v, want %v", builtin, want)
+	}
+	// the presets are copied out
+	builtin[0] = -1
+	if again, _, _ := resolveBucketExpr("sizes", newConfig()); again[0] != 64 {
+		t.Error("changing resolved buckets changed the preset")
+	}
+}
+
+func TestBucketPresetTag(t *testing.T) {
+	type stat struct {
+		Latency *prometheus.HistogramVec `misery:"name=latency_seconds,buckets=latency"`
+		Sizes   prometheus.Histogram     `misery:"name=sizes_bytes,buckets=sizes"`
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	s.Latency.WithLabelValues().Observe(0.5)
+	s.Sizes.Observe(100)
+
+	if got := len(gatherFamily(t, registry, "latency_seconds").GetMetric()[0].GetHistogram().GetBucket()); got != 13 {
+		t.Errorf("%d latency buckets, want 13", got)
+	}
+	if got := len(gatherFamily(t, registry, "sizes_bytes").GetMetric()[0].GetHistogram().GetBucket()); got != 10 {
+		t.Errorf("%d size buckets, want 10", got)
+	}
+}
+
+func TestExpBuckets(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    string
+		want    []float64
+		wantErr bool
+	}{
+		{name: "exp", expr: "exp(0.001,2,15)", want: prometheus.ExponentialBuckets(0.001, 2, 15)},
+		{name: "spaces", expr: "exp(1, 10, 3)", want: []float64{1, 10, 100}},
+		{name: "one bucket", expr: "exp(5,2,1)", want: []float64{5}},
+		{name: "two arguments", expr: "exp(1,2)", wantErr: true},
+		{name: "start not a number", expr: "exp(a,2,3)", wantErr: true},
+		{name: "start zero", expr: "exp(0,2,3)", wantErr: true},
+		{name: "factor not above 1", expr: "exp(1,1,3)", wantErr: true},
+		{name: "count not an integer", expr: "exp(1,2,3.5)", wantErr: true},
+		{name: "count zero", expr: "exp(1,2,0)", wantErr: true},
+		{name: "count above the limit", expr: "exp(1,2,100000000)", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := resolveBucketExpr(tt.expr, newConfig())
+			if tt.wantErr {
+				if !errors.Is(err, ErrAttributeMalformed) {
+					t.Fatalf("got error %v, want ErrAttributeMalformed", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveBucketExpr: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buckets %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	type stat struct {
+		Latency *prometheus.HistogramVec `misery:"name=latency_seconds,buckets='exp(0.001,2,15)'"`
+	}
+	docs, err := DescribeMetrics(&stat{})
+	if err != nil {
+		t.Fatalf("DescribeMetrics: %v", err)
+	}
+	if want := prometheus.ExponentialBuckets(0.001, 2, 15); !reflect.DeepEqual(docs[0].Buckets, want) {
+		t.Errorf("tag buckets %v, want %v", docs[0].Buckets, want)
+	}
+}
+
+func TestLinearBuckets(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    string
+		want    []float64
+		wantErr bool
+	}{
+		{name: "linear", expr: "linear(0,5,20)", want: prometheus.LinearBuckets(0, 5, 20)},
+		{name: "negative start", expr: "linear(-10, 10, 3)", want: []float64{-10, 0, 10}},
+		{name: "one bucket", expr: "linear(5,1,1)", want: []float64{5}},
+		{name: "four arguments", expr: "linear(0,5,20,1)", wantErr: true},
+		{name: "width not a number", expr: "linear(0,w,20)", wantErr: true},
+		{name: "width zero", expr: "linear(0,0,20)", wantErr: true},
+		{name: "width negative", expr: "linear(0,-5,20)", wantErr: true},
+		{name: "count negative", expr: "linear(0,5,-1)", wantErr: true},
+		{name: "at the limit", expr: "linear(0,1,1000)", want: prometheus.LinearBuckets(0, 1, 1000)},
+		{name: "count above the limit", expr: "linear(0,1,1001)", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := resolveBucketExpr(tt.expr, newConfig())
+			if tt.wantErr {
+				if !errors.Is(err, ErrAttributeMalformed) {
+					t.Fatalf("got error %v, want ErrAttributeMalformed", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveBucketExpr: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buckets %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	type stat struct {
+		Batch prometheus.Histogram `misery:"name=batch_size,buckets='linear(0,5,20)'"`
+	}
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	s.Batch.Observe(12)
+	var buckets []float64
+	for _, b := range gatherFamily(t, registry, "batch_size").GetMetric()[0].GetHistogram().GetBucket() {
+		buckets = append(buckets, b.GetUpperBound())
+	}
+	if want := prometheus.LinearBuckets(0, 5, 20); !reflect.DeepEqual(buckets, want) {
+		t.Errorf("tag buckets %v, want %v", buckets, want)
+	}
+}
@@ -0,0 +1,177 @@
+package misery
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/yuin/stagparser"
+)
+
+// PushMetrics pushes the metrics of mtrcs to the Pushgateway at url under
+// jobName, replacing whatever was pushed before with the same grouping key.
+// Every grouping map adds labels to the grouping key.
+//
+// When mtrcs has not been registered yet its metrics are built into a copy
+// of it, leaving mtrcs alone, so the push carries fresh zero values.
+// Otherwise the collectors already in the struct are pushed together with
+// their current values.
+func PushMetrics(jobName, url string, mtrcs interface{}, grouping ...map[string]string) error {
+	registry, err := scratchRegistry(mtrcs)
+	if err != nil {
+		return err
+	}
+
+	pusher := push.New(url, jobName).Gatherer(registry)
+	for _, labels := range grouping {
+		names := make([]string, 0, len(labels))
+		for name := range labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			pusher = pusher.Grouping(name, labels[name])
+		}
+	}
+
+	if err := pusher.Push(); err != nil {
+		return fmt.Errorf("push to %s failed: %w", url, err)
+	}
+
+	return nil
+}
+
+// scratchRegistry returns a new registry holding the metrics of mtrcs. When
+// mtrcs has not been registered yet its metrics are built into a copy of
+// it; otherwise the collectors already in the struct are registered as they
+// are.
+func scratchRegistry(mtrcs interface{}) (*prometheus.Registry, error) {
+	val, err := unpackStruct(mtrcs)
+	if err != nil {
+		return nil, fmt.Errorf("struct unpack error: %w", err)
+	}
+	if !metricsBuilt(val) {
+		if _, val, err = dryRunCopy(mtrcs, newConfig()); err != nil {
+			return nil, err
+		}
+	}
+
+	registry := prometheus.NewRegistry()
+	for _, collector := range builtCollectors(val, newConfig()) {
+		if err := registry.Register(collector); err != nil {
+			return nil, fmt.Errorf("collector register failed: %w", err)
+		}
+	}
+
+	return registry, nil
+}
+
+// metricsBuilt reports whether any field of structValue, or of the structs
+// nested in it or pointed to from it, holds a metric misery builds.
+func metricsBuilt(structValue reflect.Value) bool {
+	return len(appendBuiltCollectors(nil, structValue, nil, map[reflect.Type]bool{structValue.Type(): true})) > 0
+}
+
+// builtCollectors returns the collectors registration would register for
+// structValue and the structs nested in it or pointed to from it, as far as
+// they are built: the non-nil metric fields, the collectors of fields
+// tagged with register and of func metric fields, and func metrics built
+// anew for fields tagged with as=gauge and func() float64 fields. Fields
+// whose tags registration would reject are left out.
+func builtCollectors(structValue reflect.Value, cfg *config) []prometheus.Collector {
+	return appendBuiltCollectors(nil, structValue, cfg, map[reflect.Type]bool{structValue.Type(): true})
+}
+
+// appendBuiltCollectors is builtCollectors stopping, like registration, at
+// pointers to the struct types in visiting. A nil cfg appends only the
+// metric fields misery builds.
+func appendBuiltCollectors(
+	collectors []prometheus.Collector,
+	structValue reflect.Value,
+	cfg *config,
+	visiting map[reflect.Type]bool,
+) []prometheus.Collector {
+	var tags map[string][]stagparser.Definition
+	if cfg != nil {
+		var err error
+		if tags, err = parseStructTags(structValue, cfg.tagKeys...); err != nil {
+			return collectors
+		}
+	}
+
+	for i := 0; i < structValue.NumField(); i++ {
+		field := structValue.Field(i)
+		typeField := structValue.Type().Field(i)
+		var defs []stagparser.Definition
+		if cfg != nil {
+			enabled, rest, err := fieldEnabled(typeField.Name, tags[typeField.Name], cfg)
+			if err != nil || !enabled {
+				continue
+			}
+			if defs, err = resolveDefinitions(structValue, typeField.Name, rest, cfg); err != nil {
+				continue
+			}
+		}
+		register := hasDefinition(defs, "register")
+
+		switch {
+		case isMetricType(field.Type()) && !register:
+			if !field.IsNil() {
+				collectors = append(collectors, field.Interface().(prometheus.Collector))
+			}
+		case isMetricSlice(field.Type()):
+			for j := 0; j < field.Len(); j++ {
+				if !field.Index(j).IsNil() {
+					collectors = append(collectors, field.Index(j).Interface().(prometheus.Collector))
+				}
+			}
+		case cfg == nil:
+			if isNestedStruct(field) {
+				collectors = appendBuiltCollectors(collectors, field, cfg, visiting)
+			} else if isNestedStructPtr(field, nil) {
+				collectors = appendBuiltStructPtr(collectors, field, cfg, visiting)
+			}
+		case isFuncMetricType(field.Type()) || register:
+			if collector, ok := field.Interface().(prometheus.Collector); ok && !field.IsZero() {
+				collectors = append(collectors, collector)
+			}
+		case field.Type() == callbackType && hasTag(typeField, cfg.tagKeys):
+			if field.IsNil() {
+				continue
+			}
+			if collector, _, err := createFuncMetric(typeField.Name, field.Interface().(func() float64), defs, cfg); err == nil {
+				collectors = append(collectors, collector)
+			}
+		case hasDefinition(defs, "as"):
+			if collector, _, err := createScalarGauge(typeField.Name, field, defs, cfg); err == nil {
+				collectors = append(collectors, collector)
+			}
+		case isNestedStruct(field):
+			collectors = appendBuiltCollectors(collectors, field, cfg, visiting)
+		case isNestedStructPtr(field, cfg.tagKeys):
+			collectors = appendBuiltStructPtr(collectors, field, cfg, visiting)
+		}
+	}
+
+	return collectors
+}
+
+// appendBuiltStructPtr is appendBuiltCollectors for the struct field points
+// to, if any.
+func appendBuiltStructPtr(
+	collectors []prometheus.Collector,
+	field reflect.Value,
+	cfg *config,
+	visiting map[reflect.Type]bool,
+) []prometheus.Collector {
+	structType := field.Type().Elem()
+	if field.IsNil() || visiting[structType] {
+		return collectors
+	}
+	visiting[structType] = true
+	defer delete(visiting, structType)
+
+	return appendBuiltCollectors(collectors, field.Elem(), cfg, visiting)
+}
@@ -0,0 +1,153 @@
+package misery
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// pushgateway emulates the push endpoint of a Pushgateway, keeping the path
+// and the metric families of the last push.
+type pushgateway struct {
+	mu       sync.Mutex
+	method   string
+	path     string
+	families map[string]*dto.MetricFamily
+}
+
+func (p *pushgateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.method, p.path = r.Method, r.URL.Path
+	p.families = map[string]*dto.MetricFamily{}
+	decoder := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+	for {
+		family := &dto.MetricFamily{}
+		err := decoder.Decode(family)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p.families[family.GetName()] = family
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// groupingKey returns the grouping labels of a push path, which come in no
+// particular order after /metrics.
+func groupingKey(t *testing.T, path string) map[string]string {
+	t.Helper()
+
+	parts := strings.Split(strings.TrimPrefix(path, "/metrics/"), "/")
+	if len(parts)%2 != 0 {
+		t.Fatalf("malformed push path %s", path)
+	}
+	labels := make(map[string]string, len(parts)/2)
+	for i := 0; i < len(parts); i += 2 {
+		labels[parts[i]] = parts[i+1]
+	}
+
+	return labels
+}
+
+func TestPushMetrics(t *testing.T) {
+	type stat struct {
+		Jobs     *prometheus.CounterVec `misery:"name=batch_jobs_total,labels=[status]"`
+		Duration prometheus.Gauge       `misery:"name=batch_duration_seconds"`
+	}
+
+	registered := &stat{}
+	if err := RegisterMetrics(registered, prometheus.NewRegistry()); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	registered.Jobs.WithLabelValues("ok").Add(3)
+	registered.Duration.Set(12)
+
+	tests := []struct {
+		name     string
+		mtrcs    *stat
+		grouping []map[string]string
+		labels   map[string]string
+		jobs     float64
+		duration float64
+	}{
+		{
+			name:     "registered struct with its values",
+			mtrcs:    registered,
+			labels:   map[string]string{"job": "batch"},
+			jobs:     3,
+			duration: 12,
+		},
+		{
+			name:     "unregistered struct with grouping",
+			mtrcs:    &stat{},
+			grouping: []map[string]string{{"instance": "host1"}, {"shard": "2"}},
+			labels:   map[string]string{"job": "batch", "instance": "host1", "shard": "2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gateway := &pushgateway{}
+			server := httptest.NewServer(gateway)
+			defer server.Close()
+
+			if err := PushMetrics("batch", server.URL, tt.mtrcs, tt.grouping...); err != nil {
+				t.Fatalf("PushMetrics: %v", err)
+			}
+			if tt.mtrcs != registered && (tt.mtrcs.Jobs != nil || tt.mtrcs.Duration != nil) {
+				t.Errorf("fields of an unregistered struct set by the push: %+v", tt.mtrcs)
+			}
+			if gateway.method != http.MethodPut {
+				t.Errorf("pushed with %s, want PUT", gateway.method)
+			}
+			if labels := groupingKey(t, gateway.path); !reflect.DeepEqual(labels, tt.labels) {
+				t.Errorf("grouping key %v, want %v", labels, tt.labels)
+			}
+			duration := gateway.families["batch_duration_seconds"]
+			if duration == nil {
+				t.Fatal("batch_duration_seconds not pushed")
+			}
+			if got := duration.GetMetric()[0].GetGauge().GetValue(); got != tt.duration {
+				t.Errorf("batch_duration_seconds = %v, want %v", got, tt.duration)
+			}
+			if tt.jobs == 0 {
+				return
+			}
+			jobs := gateway.families["batch_jobs_total"]
+			if jobs == nil {
+				t.Fatal("batch_jobs_total not pushed")
+			}
+			if got := jobs.GetMetric()[0].GetCounter().GetValue(); got != tt.jobs {
+				t.Errorf("batch_jobs_total = %v, want %v", got, tt.jobs)
+			}
+		})
+	}
+}
+
+func TestPushMetricsFailure(t *testing.T) {
+	type stat struct {
+		Jobs prometheus.Counter `misery:"name=batch_jobs_total"`
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	if err := PushMetrics("batch", server.URL, &stat{}); err == nil {
+		t.Fatal("expected an error from a failing Pushgateway")
+	}
+}
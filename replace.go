@@ -0,0 +1,104 @@
+package misery
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// replaceableHelp is the help of the descriptors replaceable collectors
+// describe. It must never change, or registries would refuse a replacement.
+const replaceableHelp = "Metric replaceable by misery."
+
+// replaceable is registered in place of a collector when WithReplaceExisting
+// is in effect. It describes placeholder descriptors made of the metric
+// names alone, so that a later registration of the same names collides with
+// it whatever help and labels the new definitions have, and then swaps the
+// collector inside instead of registering anew. A registry pins the help and
+// label names of a metric name to those of its first descriptor, so the
+// collector itself could never be replaced by one with other help.
+//
+// The collected metrics do not match the placeholders, which pedantic
+// registries reject on Gather.
+type replaceable struct {
+	descs []*prometheus.Desc
+
+	mu        sync.RWMutex
+	collector prometheus.Collector
+}
+
+func newReplaceable(collector prometheus.Collector) *replaceable {
+	names := describeNames(collector)
+	descs := make([]*prometheus.Desc, len(names))
+	for i, name := range names {
+		descs[i] = prometheus.NewDesc(name, replaceableHelp, nil, nil)
+	}
+
+	return &replaceable{descs: descs, collector: collector}
+}
+
+func (r *replaceable) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range r.descs {
+		ch <- desc
+	}
+}
+
+func (r *replaceable) Collect(ch chan<- prometheus.Metric) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	r.collector.Collect(ch)
+}
+
+func (r *replaceable) unwrap() prometheus.Collector {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.collector
+}
+
+// swap puts collector in place of the one collected so far and returns the
+// latter.
+func (r *replaceable) swap(collector prometheus.Collector) prometheus.Collector {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	previous := r.collector
+	r.collector = collector
+	return previous
+}
+
+// register registers collector for the field structFieldName and returns
+// what rollback needs to undo it. Under WithReplaceExisting the collector is
+// registered through a replaceable, or swapped into the replaceable
+// registered for the same metric names before. WithIgnoreAlreadyRegistered
+// takes precedence, so the existing collector can be reused instead.
+func (reg *registration) register(structFieldName string, collector prometheus.Collector) (registeredField, error) {
+	if !reg.cfg.replaceExisting || reg.cfg.ignoreAlreadyRegistered {
+		return registeredField{collector: collector}, reg.registry.Register(collector)
+	}
+
+	r := newReplaceable(collector)
+	err := reg.registry.Register(r)
+	if err == nil {
+		return registeredField{collector: r}, nil
+	}
+	var already prometheus.AlreadyRegisteredError
+	if !errors.As(err, &already) {
+		return registeredField{}, err
+	}
+	existing, ok := already.ExistingCollector.(*replaceable)
+	if !ok {
+		return registeredField{}, err
+	}
+	reg.cfg.logger.Printf("misery: %s: replaced the collector registered before", structFieldName)
+
+	return registeredField{replaced: existing, replacedCollector: existing.swap(collector)}, nil
+}
+
+// unregister removes collector from registry, whether it was registered
+// itself or through a replaceable.
+func unregister(registry prometheus.Registerer, collector prometheus.Collector) bool {
+	return registry.Unregister(collector) || registry.Unregister(newReplaceable(collector))
+}
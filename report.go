@@ -0,0 +1,307 @@
+package misery
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Report maps resolved metric names to the collectors built for them, so
+// generic code can reach a metric without knowing the struct it lives in.
+type Report map[string]prometheus.Collector
+
+// RegisterMetricsReport is RegisterMetricsWithOptions that also returns the
+// report of everything it built.
+func RegisterMetricsReport(mtrcs interface{}, registry prometheus.Registerer, opts ...Option) (Report, error) {
+	return registerMetrics(context.Background(), mtrcs, registry, newConfig(opts...))
+}
+
+func (r Report) lookup(name string) (prometheus.Collector, error) {
+	collector, ok := r[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrMetricNotFound, name)
+	}
+
+	return collector, nil
+}
+
+// Counter returns the series of the named counter vec selected by labels.
+// For vecs registered with WithCounterGuard the returned counter ignores
+// negative increments.
+func (r Report) Counter(field string, labels prometheus.Labels) (prometheus.Counter, error) {
+	collector, err := r.lookup(field)
+	if err != nil {
+		return nil, err
+	}
+
+	vec, ok := unwrapCollector(collector).(*prometheus.CounterVec)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is %T, not a counter", ErrTypeNotSupported, field, collector)
+	}
+
+	counter, err := vec.GetMetricWith(labels)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", field, err)
+	}
+	if guarded, ok := collector.(guardedCounterVec); ok {
+		return guardedCounter{Counter: counter, name: field, logger: guarded.logger}, nil
+	}
+
+	return counter, nil
+}
+
+// Gauge returns the series of the named gauge vec selected by labels. Unlike
+// counters, gauges go up and down: the series takes negative values and
+// deltas, and WithCounterGuard never applies to it.
+func (r Report) Gauge(field string, labels prometheus.Labels) (prometheus.Gauge, error) {
+	collector, err := r.lookup(field)
+	if err != nil {
+		return nil, err
+	}
+
+	vec, ok := collector.(*prometheus.GaugeVec)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is %T, not a gauge", ErrTypeNotSupported, field, collector)
+	}
+
+	gauge, err := vec.GetMetricWith(labels)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", field, err)
+	}
+
+	return gauge, nil
+}
+
+// Add adds v to the series of the named counter or gauge vec selected by
+// labels. A negative v decreases a gauge; for a counter it is an error, as
+// counters only go up.
+func (r Report) Add(field string, labels prometheus.Labels, v float64) error {
+	collector, err := r.lookup(field)
+	if err != nil {
+		return err
+	}
+
+	switch unwrapCollector(collector).(type) {
+	case *prometheus.CounterVec:
+		if v < 0 {
+			return fmt.Errorf("%s: counter cannot decrease by %v", field, v)
+		}
+		counter, err := r.Counter(field, labels)
+		if err != nil {
+			return err
+		}
+		counter.Add(v)
+	case *prometheus.GaugeVec:
+		gauge, err := r.Gauge(field, labels)
+		if err != nil {
+			return err
+		}
+		gauge.Add(v)
+	default:
+		return fmt.Errorf("%w: %s is %T, not a counter or gauge", ErrTypeNotSupported, field, collector)
+	}
+
+	return nil
+}
+
+// Set sets the series of the named gauge vec selected by labels to v, which
+// may be negative.
+func (r Report) Set(field string, labels prometheus.Labels, v float64) error {
+	gauge, err := r.Gauge(field, labels)
+	if err != nil {
+		return err
+	}
+	gauge.Set(v)
+
+	return nil
+}
+
+// Observer returns the series of the named histogram or summary vec selected
+// by labels.
+func (r Report) Observer(field string, labels prometheus.Labels) (prometheus.Observer, error) {
+	collector, err := r.lookup(field)
+	if err != nil {
+		return nil, err
+	}
+
+	vec, ok := collector.(prometheus.ObserverVec)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is %T, not an observer", ErrTypeNotSupported, field, collector)
+	}
+
+	observer, err := vec.GetMetricWith(labels)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", field, err)
+	}
+
+	return observer, nil
+}
+
+// BindLabels returns the series of the named counter, gauge, histogram or
+// summary vec selected by labels, to be type asserted to prometheus.Counter,
+// prometheus.Gauge or prometheus.Observer. Binding the series once and
+// reusing it in tight loops saves the labels map and the lookup that every
+// With call costs.
+func (r Report) BindLabels(field string, labels prometheus.Labels) (prometheus.Metric, error) {
+	collector, err := r.lookup(field)
+	if err != nil {
+		return nil, err
+	}
+
+	switch unwrapCollector(collector).(type) {
+	case *prometheus.CounterVec:
+		return r.Counter(field, labels)
+	case *prometheus.GaugeVec:
+		return r.Gauge(field, labels)
+	case prometheus.ObserverVec:
+		observer, err := r.Observer(field, labels)
+		if err != nil {
+			return nil, err
+		}
+		metric, ok := observer.(prometheus.Metric)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s series is %T, not a metric", ErrTypeNotSupported, field, observer)
+		}
+		return metric, nil
+	}
+
+	return nil, fmt.Errorf("%w: %s is %T, not a vec", ErrTypeNotSupported, field, collector)
+}
+
+// ObserveDurationValue observes d in seconds, the Prometheus base unit, on
+// the series of the named histogram or summary vec selected by labels.
+func (r Report) ObserveDurationValue(field string, labels prometheus.Labels, d time.Duration) error {
+	observer, err := r.Observer(field, labels)
+	if err != nil {
+		return err
+	}
+	observer.Observe(d.Seconds())
+
+	return nil
+}
+
+// ObserveWithExemplar observes value on the series of the named observer
+// vec selected by labels and attaches exemplar to the observation. Only
+// metrics whose observers implement prometheus.ExemplarObserver, such as
+// histograms, are supported.
+func (r Report) ObserveWithExemplar(field string, labels prometheus.Labels, value float64, exemplar prometheus.Labels) error {
+	observer, err := r.Observer(field, labels)
+	if err != nil {
+		return err
+	}
+
+	exemplarObserver, ok := observer.(prometheus.ExemplarObserver)
+	if !ok {
+		return fmt.Errorf("%w: %s does not support exemplars", ErrTypeNotSupported, field)
+	}
+
+	return observeWithExemplar(exemplarObserver, value, exemplar)
+}
+
+// observeWithExemplar turns the panic client_golang raises for an invalid
+// exemplar into an error.
+func observeWithExemplar(o prometheus.ExemplarObserver, value float64, exemplar prometheus.Labels) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("invalid exemplar %v: %v", exemplar, p)
+		}
+	}()
+	o.ObserveWithExemplar(value, exemplar)
+
+	return nil
+}
+
+// RegisterAll registers the metrics of every struct in structs into registry.
+// Either all of them are registered or, on the first error, none are.
+func RegisterAll(registry prometheus.Registerer, structs ...interface{}) error {
+	_, err := RegisterAllReport(registry, structs...)
+	return err
+}
+
+// RegisterAllReport is RegisterAll returning a single report covering every
+// struct. A metric name declared by more than one struct fails with
+// ErrDuplicateMetricName and rolls back everything registered so far.
+func RegisterAllReport(registry prometheus.Registerer, structs ...interface{}) (Report, error) {
+	return registerAll(registry, structs, newConfig())
+}
+
+// RegisterAllWithOptions is RegisterAll with options applied to every
+// struct.
+func RegisterAllWithOptions(registry prometheus.Registerer, structs []interface{}, opts ...Option) error {
+	_, err := registerAll(registry, structs, newConfig(opts...))
+	return err
+}
+
+func registerAll(registry prometheus.Registerer, structs []interface{}, cfg *config) (Report, error) {
+	if err := checkRegistry(registry); err != nil {
+		return nil, err
+	}
+
+	defer lockInstances(structs)()
+	reg := newRegistration(registry, cfg)
+	for i, mtrcs := range structs {
+		if err := reg.add(context.Background(), mtrcs); err != nil {
+			reg.rollback()
+			return nil, fmt.Errorf("struct %d (%T): %w", i, mtrcs, err)
+		}
+	}
+	if err := reg.finish(); err != nil {
+		reg.rollback()
+		return nil, err
+	}
+	reg.record(registry)
+
+	return reg.report, nil
+}
+
+// wrappedCollector is implemented by collectors misery registers in place
+// of the collector stored in the struct field.
+type wrappedCollector interface {
+	unwrap() prometheus.Collector
+}
+
+// unwrapCollector returns the collector as stored in the struct field.
+func unwrapCollector(collector prometheus.Collector) prometheus.Collector {
+	for {
+		wrapped, ok := collector.(wrappedCollector)
+		if !ok {
+			return collector
+		}
+		collector = wrapped.unwrap()
+	}
+}
+
+var descNameRe = regexp.MustCompile(`^Desc\{fqName: ("(?:[^"\\]|\\.)*")`)
+
+// describeNames returns the distinct fully-qualified metric names collector
+// describes. prometheus.Desc exposes them only through its String method.
+func describeNames(collector prometheus.Collector) []string {
+	ch := make(chan *prometheus.Desc)
+	go func() {
+		collector.Describe(ch)
+		close(ch)
+	}()
+
+	var names []string
+	seen := map[string]struct{}{}
+	for desc := range ch {
+		match := descNameRe.FindStringSubmatch(desc.String())
+		if match == nil {
+			continue
+		}
+		name, err := strconv.Unquote(match[1])
+		if err != nil || name == "" {
+			continue
+		}
+		if _, ok := seen[name]; !ok {
+			seen[name] = struct{}{}
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
@@ -0,0 +1,484 @@
+package misery
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReportObserveWithExemplar(t *testing.T) {
+	type stat struct {
+		Latency *prometheus.HistogramVec `misery:"name=latency_seconds,labels=[path],buckets=[0.1,1]"`
+		Sizes   *prometheus.SummaryVec   `misery:"name=sizes_bytes,labels=[path]"`
+		Hits    *prometheus.CounterVec   `misery:"name=hits_total,labels=[path]"`
+	}
+
+	registry := prometheus.NewRegistry()
+	report, err := RegisterMetricsReport(&stat{}, registry)
+	if err != nil {
+		t.Fatalf("RegisterMetricsReport: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		field    string
+		labels   prometheus.Labels
+		exemplar prometheus.Labels
+		ok       bool
+		wantErr  error
+	}{
+		{name: "histogram", field: "latency_seconds", labels: prometheus.Labels{"path": "/"}, exemplar: prometheus.Labels{"trace_id": "abc"}, ok: true},
+		{name: "summary", field: "sizes_bytes", labels: prometheus.Labels{"path": "/"}, exemplar: prometheus.Labels{"trace_id": "abc"}, wantErr: ErrTypeNotSupported},
+		{name: "counter", field: "hits_total", labels: prometheus.Labels{"path": "/"}, exemplar: prometheus.Labels{"trace_id": "abc"}, wantErr: ErrTypeNotSupported},
+		{name: "unknown metric", field: "missing", wantErr: ErrMetricNotFound},
+		{name: "label mismatch", field: "latency_seconds", labels: prometheus.Labels{"code": "200"}, exemplar: prometheus.Labels{"trace_id": "abc"}},
+		{name: "invalid exemplar", field: "latency_seconds", labels: prometheus.Labels{"path": "/"}, exemplar: prometheus.Labels{"trace_id": strings.Repeat("x", 200)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := report.ObserveWithExemplar(tt.field, tt.labels, 0.5, tt.exemplar)
+			switch {
+			case tt.ok:
+				if err != nil {
+					t.Fatalf("ObserveWithExemplar: %v", err)
+				}
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+			default:
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+			}
+		})
+	}
+
+	family := gatherFamily(t, registry, "latency_seconds")
+	if family == nil {
+		t.Fatal("latency_seconds not scraped")
+	}
+	var traceIDs []string
+	for _, bucket := range family.GetMetric()[0].GetHistogram().GetBucket() {
+		for _, pair := range bucket.GetExemplar().GetLabel() {
+			traceIDs = append(traceIDs, pair.GetName()+"="+pair.GetValue())
+		}
+	}
+	if len(traceIDs) != 1 || traceIDs[0] != "trace_id=abc" {
+		t.Fatalf("exemplars %v, want [trace_id=abc]", traceIDs)
+	}
+}
+
+func TestRegisterAllReport(t *testing.T) {
+	type http struct {
+		Requests *prometheus.CounterVec `misery:"name=http_requests_total,labels=[code]"`
+	}
+	type grpc struct {
+		Requests *prometheus.CounterVec `misery:"name=grpc_requests_total,labels=[code]"`
+	}
+	type clashing struct {
+		Requests *prometheus.CounterVec `misery:"name=http_requests_total,labels=[method]"`
+	}
+
+	tests := []struct {
+		name    string
+		structs []interface{}
+		want    []string
+		wantErr error
+	}{
+		{
+			name:    "distinct names",
+			structs: []interface{}{&http{}, &grpc{}},
+			want:    []string{"grpc_requests_total", "http_requests_total"},
+		},
+		{
+			name:    "name collision across structs",
+			structs: []interface{}{&http{}, &grpc{}, &clashing{}},
+			wantErr: ErrDuplicateMetricName,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			report, err := RegisterAllReport(registry, tt.structs...)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				if !strings.Contains(err.Error(), "http_requests_total") {
+					t.Errorf("error %q does not name the metric", err)
+				}
+				if families, _ := registry.Gather(); len(families) != 0 {
+					t.Errorf("%d metrics left registered", len(families))
+				}
+				for _, s := range tt.structs[:2] {
+					if v := reflect.ValueOf(s).Elem().Field(0); !v.IsNil() {
+						t.Errorf("%T field left set after rollback", s)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RegisterAllReport: %v", err)
+			}
+			var names []string
+			for name := range report {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("report names %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestReportAccessors(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec   `misery:"name=requests_total,labels=[code]"`
+		Inflight *prometheus.GaugeVec     `misery:"name=inflight,labels=[pool]"`
+		Latency  *prometheus.HistogramVec `misery:"name=latency_seconds,labels=[code]"`
+	}
+
+	report, err := RegisterMetricsReport(&stat{}, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("RegisterMetricsReport: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		get     func() (prometheus.Metric, error)
+		wantErr error
+	}{
+		{
+			name: "counter",
+			get: func() (prometheus.Metric, error) {
+				return report.Counter("requests_total", prometheus.Labels{"code": "200"})
+			},
+		},
+		{
+			name: "gauge",
+			get: func() (prometheus.Metric, error) {
+				return report.Gauge("inflight", prometheus.Labels{"pool": "db"})
+			},
+		},
+		{
+			name: "counter of a gauge",
+			get: func() (prometheus.Metric, error) {
+				return report.Counter("inflight", prometheus.Labels{"pool": "db"})
+			},
+			wantErr: ErrTypeNotSupported,
+		},
+		{
+			name: "gauge of a histogram",
+			get: func() (prometheus.Metric, error) {
+				return report.Gauge("latency_seconds", prometheus.Labels{"code": "200"})
+			},
+			wantErr: ErrTypeNotSupported,
+		},
+		{
+			name: "unknown metric",
+			get: func() (prometheus.Metric, error) {
+				return report.Counter("missing_total", nil)
+			},
+			wantErr: ErrMetricNotFound,
+		},
+		{
+			name: "label mismatch",
+			get: func() (prometheus.Metric, error) {
+				return report.Counter("requests_total", prometheus.Labels{"method": "GET"})
+			},
+			wantErr: errAny,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metric, err := tt.get()
+			switch {
+			case tt.wantErr == errAny:
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case metric == nil:
+				t.Fatal("nil metric")
+			}
+		})
+	}
+
+	if err := report.Add("requests_total", prometheus.Labels{"code": "200"}, 2); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := report.Add("inflight", prometheus.Labels{"pool": "db"}, 3); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	counter, _ := report.Counter("requests_total", prometheus.Labels{"code": "200"})
+	gauge, _ := report.Gauge("inflight", prometheus.Labels{"pool": "db"})
+	if got := testutil.ToFloat64(counter); got != 2 {
+		t.Errorf("counter = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(gauge); got != 3 {
+		t.Errorf("gauge = %v, want 3", got)
+	}
+}
+
+func TestReportNegativeGauge(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,help=Requests.,labels=[code]"`
+		Balance  *prometheus.GaugeVec   `misery:"name=balance_delta,help='Balance delta.',labels=[account]"`
+	}
+
+	registry := prometheus.NewRegistry()
+	report, err := RegisterMetricsReport(&stat{}, registry)
+	if err != nil {
+		t.Fatalf("RegisterMetricsReport: %v", err)
+	}
+
+	if err := report.Set("balance_delta", prometheus.Labels{"account": "a"}, -5); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := report.Add("balance_delta", prometheus.Labels{"account": "b"}, -1.5); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := report.Add("balance_delta", prometheus.Labels{"account": "b"}, -1); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	gauge, err := report.Gauge("balance_delta", prometheus.Labels{"account": "c"})
+	if err != nil {
+		t.Fatalf("Gauge: %v", err)
+	}
+	gauge.Sub(7)
+
+	if err := report.Add("requests_total", prometheus.Labels{"code": "200"}, -1); err == nil {
+		t.Error("Add of a negative value to a counter: expected an error")
+	}
+	if err := report.Set("requests_total", prometheus.Labels{"code": "200"}, -1); !errors.Is(err, ErrTypeNotSupported) {
+		t.Errorf("Set of a counter: got error %v, want %v", err, ErrTypeNotSupported)
+	}
+
+	want := `
+# HELP balance_delta Balance delta.
+# TYPE balance_delta gauge
+balance_delta{account="a"} -5
+balance_delta{account="b"} -2.5
+balance_delta{account="c"} -7
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want), "balance_delta", "requests_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestObserveDurationValue(t *testing.T) {
+	type stat struct {
+		Latency *prometheus.HistogramVec `misery:"name=latency_seconds,labels=[path],buckets=[0.01,0.1,1]"`
+		Hits    *prometheus.CounterVec   `misery:"name=hits_total,labels=[path]"`
+	}
+
+	tests := []struct {
+		name    string
+		field   string
+		labels  prometheus.Labels
+		d       time.Duration
+		buckets []uint64
+		wantErr error
+	}{
+		{name: "milliseconds", field: "latency_seconds", labels: prometheus.Labels{"path": "/"}, d: 50 * time.Millisecond, buckets: []uint64{0, 1, 1}},
+		{name: "microseconds", field: "latency_seconds", labels: prometheus.Labels{"path": "/"}, d: 500 * time.Microsecond, buckets: []uint64{1, 1, 1}},
+		{name: "seconds", field: "latency_seconds", labels: prometheus.Labels{"path": "/"}, d: 2 * time.Second, buckets: []uint64{0, 0, 0}},
+		{name: "counter", field: "hits_total", labels: prometheus.Labels{"path": "/"}, d: time.Second, wantErr: ErrTypeNotSupported},
+		{name: "unknown metric", field: "missing_seconds", d: time.Second, wantErr: ErrMetricNotFound},
+		{name: "label mismatch", field: "latency_seconds", labels: prometheus.Labels{"code": "200"}, d: time.Second, wantErr: errAny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			report, err := RegisterMetricsReport(&stat{}, registry)
+			if err != nil {
+				t.Fatalf("RegisterMetricsReport: %v", err)
+			}
+			err = report.ObserveDurationValue(tt.field, tt.labels, tt.d)
+			switch {
+			case tt.wantErr == errAny:
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			case err != nil:
+				t.Fatalf("ObserveDurationValue: %v", err)
+			}
+
+			histogram := gatherFamily(t, registry, "latency_seconds").GetMetric()[0].GetHistogram()
+			var counts []uint64
+			for _, bucket := range histogram.GetBucket() {
+				counts = append(counts, bucket.GetCumulativeCount())
+			}
+			if !reflect.DeepEqual(counts, tt.buckets) {
+				t.Errorf("cumulative bucket counts %v, want %v", counts, tt.buckets)
+			}
+			if histogram.GetSampleSum() != tt.d.Seconds() {
+				t.Errorf("sum %v, want %v", histogram.GetSampleSum(), tt.d.Seconds())
+			}
+		})
+	}
+}
+
+func TestBindLabels(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec   `misery:"name=requests_total,labels=[code]"`
+		Inflight *prometheus.GaugeVec     `misery:"name=inflight,labels=[pool]"`
+		Latency  *prometheus.HistogramVec `misery:"name=latency_seconds,labels=[code],buckets=[1]"`
+		Sizes    *prometheus.SummaryVec   `misery:"name=sizes_bytes,labels=[code]"`
+		Limit    int                      `misery:"name=limit,as=gauge"`
+	}
+
+	registry := prometheus.NewRegistry()
+	report, err := RegisterMetricsReport(&stat{}, registry)
+	if err != nil {
+		t.Fatalf("RegisterMetricsReport: %v", err)
+	}
+
+	counter, err := report.BindLabels("requests_total", prometheus.Labels{"code": "200"})
+	if err != nil {
+		t.Fatalf("BindLabels counter: %v", err)
+	}
+	counter.(prometheus.Counter).Add(2)
+	gauge, err := report.BindLabels("inflight", prometheus.Labels{"pool": "db"})
+	if err != nil {
+		t.Fatalf("BindLabels gauge: %v", err)
+	}
+	gauge.(prometheus.Gauge).Set(3)
+	for _, name := range []string{"latency_seconds", "sizes_bytes"} {
+		observer, err := report.BindLabels(name, prometheus.Labels{"code": "200"})
+		if err != nil {
+			t.Fatalf("BindLabels %s: %v", name, err)
+		}
+		observer.(prometheus.Observer).Observe(0.5)
+	}
+
+	if got := testutil.ToFloat64(counter.(prometheus.Collector)); got != 2 {
+		t.Errorf("counter = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(gauge.(prometheus.Collector)); got != 3 {
+		t.Errorf("gauge = %v, want 3", got)
+	}
+	if got := gatherSampleCount(t, registry, "latency_seconds", "200"); got != 1 {
+		t.Errorf("histogram sample count = %d, want 1", got)
+	}
+	if got := gatherFamily(t, registry, "sizes_bytes").GetMetric()[0].GetSummary().GetSampleCount(); got != 1 {
+		t.Errorf("summary sample count = %d, want 1", got)
+	}
+
+	if _, err := report.BindLabels("limit", nil); !errors.Is(err, ErrTypeNotSupported) {
+		t.Errorf("BindLabels of a gauge func: got error %v, want ErrTypeNotSupported", err)
+	}
+	if _, err := report.BindLabels("missing_total", nil); !errors.Is(err, ErrMetricNotFound) {
+		t.Errorf("BindLabels of an unknown metric: got error %v, want ErrMetricNotFound", err)
+	}
+	if _, err := report.BindLabels("requests_total", prometheus.Labels{"method": "GET"}); err == nil {
+		t.Error("BindLabels with mismatched labels: got no error")
+	}
+}
+
+func BenchmarkObserve(b *testing.B) {
+	type stat struct {
+		Latency *prometheus.HistogramVec `misery:"name=latency_seconds,labels=[code,method]"`
+	}
+
+	report, err := RegisterMetricsReport(&stat{}, prometheus.NewRegistry())
+	if err != nil {
+		b.Fatalf("RegisterMetricsReport: %v", err)
+	}
+	vec := report["latency_seconds"].(*prometheus.HistogramVec)
+
+	b.Run("per call", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			vec.With(prometheus.Labels{"code": "200", "method": "GET"}).Observe(0.5)
+		}
+	})
+	b.Run("bound", func(b *testing.B) {
+		bound, err := report.BindLabels("latency_seconds", prometheus.Labels{"code": "200", "method": "GET"})
+		if err != nil {
+			b.Fatalf("BindLabels: %v", err)
+		}
+		observer := bound.(prometheus.Observer)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			observer.Observe(0.5)
+		}
+	})
+}
+
+func TestWithShareIdentical(t *testing.T) {
+	type api struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,help=Requests.,labels=[code]"`
+	}
+	type worker struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,help=Requests.,labels=[code]"`
+		Jobs     *prometheus.CounterVec `misery:"name=jobs_total"`
+	}
+	type other struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,help='Other requests.',labels=[code]"`
+	}
+	type full struct {
+		Latency prometheus.ObserverVec `misery:"name=latency_seconds,help=Latency.,buckets=[1]"`
+	}
+	type sampled struct {
+		Latency prometheus.ObserverVec `misery:"name=latency_seconds,help=Latency.,buckets=[1],sample=0.1"`
+	}
+
+	registry := prometheus.NewRegistry()
+	a, w := &api{}, &worker{}
+	if err := RegisterAllWithOptions(registry, []interface{}{a, w}, WithShareIdentical(true)); err != nil {
+		t.Fatalf("RegisterAllWithOptions: %v", err)
+	}
+	if a.Requests != w.Requests {
+		t.Fatal("identical declarations got distinct collectors")
+	}
+	a.Requests.WithLabelValues("200").Inc()
+	w.Requests.WithLabelValues("200").Inc()
+
+	want := `
+# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{code="200"} 2
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want), "requests_total"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		structs []interface{}
+		opts    []Option
+	}{
+		{name: "sharing off", structs: []interface{}{&api{}, &worker{}}},
+		{name: "other help", structs: []interface{}{&api{}, &other{}}, opts: []Option{WithShareIdentical(true)}},
+		{name: "other sample rate", structs: []interface{}{&full{}, &sampled{}}, opts: []Option{WithShareIdentical(true)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := RegisterAllWithOptions(prometheus.NewRegistry(), tt.structs, tt.opts...)
+			if !errors.Is(err, ErrDuplicateMetricName) {
+				t.Fatalf("got error %v, want ErrDuplicateMetricName", err)
+			}
+		})
+	}
+}
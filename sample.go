@@ -0,0 +1,142 @@
+package misery
+
+import (
+	"fmt"
+	"math/rand/v2"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/yuin/stagparser"
+)
+
+// sampleAttr returns the sample attribute of a histogram or summary, one
+// when it is not set.
+func sampleAttr(defs []stagparser.Definition) (float64, error) {
+	rate, ok, err := FloatAttr(defs, "sample")
+	if !ok {
+		return 1, nil
+	}
+	if err != nil || rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("%w: sample must be a number between 0 and 1", ErrAttributeMalformed)
+	}
+
+	return rate, nil
+}
+
+// sampledObserverVec records every observation on the series of the
+// wrapped vec with probability rate and drops the rest. Histograms and
+// summaries have no way to weight an observation, so the exposed _count and
+// bucket counts are about rate times the true ones, while quantiles, bucket
+// ratios and the average stay unbiased; divide counts and _sum by rate to
+// estimate the totals.
+type sampledObserverVec struct {
+	prometheus.ObserverVec
+	rate float64
+}
+
+// sampleObservers wraps vec so its series sample observations at rate. A
+// rate of one leaves vec as it is.
+func sampleObservers(vec prometheus.ObserverVec, rate float64) prometheus.ObserverVec {
+	if rate == 1 {
+		return vec
+	}
+
+	return sampledObserverVec{ObserverVec: vec, rate: rate}
+}
+
+func (v sampledObserverVec) GetMetricWith(labels prometheus.Labels) (prometheus.Observer, error) {
+	o, err := v.ObserverVec.GetMetricWith(labels)
+	if err != nil {
+		return nil, err
+	}
+
+	return sampledObserver{Observer: o, rate: v.rate}, nil
+}
+
+func (v sampledObserverVec) GetMetricWithLabelValues(lvs ...string) (prometheus.Observer, error) {
+	o, err := v.ObserverVec.GetMetricWithLabelValues(lvs...)
+	if err != nil {
+		return nil, err
+	}
+
+	return sampledObserver{Observer: o, rate: v.rate}, nil
+}
+
+func (v sampledObserverVec) With(labels prometheus.Labels) prometheus.Observer {
+	return sampledObserver{Observer: v.ObserverVec.With(labels), rate: v.rate}
+}
+
+func (v sampledObserverVec) WithLabelValues(lvs ...string) prometheus.Observer {
+	return sampledObserver{Observer: v.ObserverVec.WithLabelValues(lvs...), rate: v.rate}
+}
+
+func (v sampledObserverVec) CurryWith(labels prometheus.Labels) (prometheus.ObserverVec, error) {
+	curried, err := v.ObserverVec.CurryWith(labels)
+	if err != nil {
+		return nil, err
+	}
+
+	return sampledObserverVec{ObserverVec: curried, rate: v.rate}, nil
+}
+
+func (v sampledObserverVec) MustCurryWith(labels prometheus.Labels) prometheus.ObserverVec {
+	return sampledObserverVec{ObserverVec: v.ObserverVec.MustCurryWith(labels), rate: v.rate}
+}
+
+// sampledObserver is a series of a sampledObserverVec.
+type sampledObserver struct {
+	prometheus.Observer
+	rate float64
+}
+
+func (o sampledObserver) Observe(value float64) {
+	if rand.Float64() < o.rate {
+		o.Observer.Observe(value)
+	}
+}
+
+// ObserveWithExemplar samples like Observe, keeping the exemplar when the
+// wrapped series supports exemplars.
+func (o sampledObserver) ObserveWithExemplar(value float64, exemplar prometheus.Labels) {
+	if rand.Float64() >= o.rate {
+		return
+	}
+	if eo, ok := o.Observer.(prometheus.ExemplarObserver); ok {
+		eo.ObserveWithExemplar(value, exemplar)
+		return
+	}
+	o.Observer.Observe(value)
+}
+
+// Describe, Collect, Desc and Write delegate to the wrapped series, a
+// histogram or summary, so a sampled series field is unregistered and bound
+// like the series itself.
+
+func (o sampledObserver) Describe(ch chan<- *prometheus.Desc) {
+	if c, ok := o.Observer.(prometheus.Collector); ok {
+		c.Describe(ch)
+	}
+}
+
+func (o sampledObserver) Collect(ch chan<- prometheus.Metric) {
+	if c, ok := o.Observer.(prometheus.Collector); ok {
+		c.Collect(ch)
+	}
+}
+
+func (o sampledObserver) Desc() *prometheus.Desc {
+	if m, ok := o.Observer.(prometheus.Metric); ok {
+		return m.Desc()
+	}
+
+	return nil
+}
+
+func (o sampledObserver) Write(out *dto.Metric) error {
+	m, ok := o.Observer.(prometheus.Metric)
+	if !ok {
+		return fmt.Errorf("%T is not a metric", o.Observer)
+	}
+
+	return m.Write(out)
+}
@@ -0,0 +1,104 @@
+package misery
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSample(t *testing.T) {
+	type stat struct {
+		Never  prometheus.Observer `misery:"name=never_seconds,sample=0"`
+		Some   prometheus.Observer `misery:"name=some_seconds,sample=0.25"`
+		Always prometheus.Observer `misery:"name=always_seconds,sample=1"`
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+
+	const observations = 20000
+	for i := 0; i < observations; i++ {
+		s.Never.Observe(1)
+		s.Some.Observe(1)
+		s.Always.Observe(1)
+	}
+
+	count := func(name string) uint64 {
+		return gatherFamily(t, registry, name).GetMetric()[0].GetHistogram().GetSampleCount()
+	}
+	if got := count("never_seconds"); got != 0 {
+		t.Errorf("sample=0 recorded %d observations", got)
+	}
+	if got := count("always_seconds"); got != observations {
+		t.Errorf("sample=1 recorded %d observations, want %d", got, observations)
+	}
+
+	// The count is binomial; six standard deviations make a false failure
+	// practically impossible.
+	mean := observations * 0.25
+	tolerance := 6 * math.Sqrt(observations*0.25*0.75)
+	if got := float64(count("some_seconds")); math.Abs(got-mean) > tolerance {
+		t.Errorf("sample=0.25 recorded %v observations, want %v±%.0f", got, mean, tolerance)
+	}
+}
+
+func TestSampleMalformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		mtrcs   interface{}
+		wantErr error
+	}{
+		{name: "above one", mtrcs: &struct {
+			Latency prometheus.ObserverVec `misery:"name=latency_seconds,sample=1.5"`
+		}{}, wantErr: ErrAttributeMalformed},
+		{name: "negative", mtrcs: &struct {
+			Latency prometheus.ObserverVec `misery:"name=latency_seconds,sample=-0.1"`
+		}{}, wantErr: ErrAttributeMalformed},
+		{name: "not a number", mtrcs: &struct {
+			Latency prometheus.ObserverVec `misery:"name=latency_seconds,sample=half"`
+		}{}, wantErr: ErrAttributeMalformed},
+		{name: "histogram vec field", mtrcs: &struct {
+			Latency *prometheus.HistogramVec `misery:"name=latency_seconds,sample=0.5"`
+		}{}, wantErr: ErrTypeNotSupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := RegisterMetrics(tt.mtrcs, prometheus.NewRegistry()); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func BenchmarkSample(b *testing.B) {
+	type stat struct {
+		Full    prometheus.ObserverVec `misery:"name=full_seconds,labels=[path]"`
+		Sampled prometheus.ObserverVec `misery:"name=sampled_seconds,labels=[path],sample=0.01"`
+	}
+
+	s := &stat{}
+	if err := RegisterMetrics(s, prometheus.NewRegistry()); err != nil {
+		b.Fatalf("RegisterMetrics: %v", err)
+	}
+
+	for _, bb := range []struct {
+		name     string
+		observer prometheus.Observer
+	}{
+		{name: "full", observer: s.Full.WithLabelValues("/")},
+		{name: "sampled", observer: s.Sampled.WithLabelValues("/")},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					bb.observer.Observe(0.5)
+				}
+			})
+		})
+	}
+}
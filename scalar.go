@@ -0,0 +1,122 @@
+package misery
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yuin/stagparser"
+)
+
+// addScalar registers a numeric field tagged with as=gauge as a gauge that
+// reads the current value of the field on every scrape. The field itself is
+// never modified.
+func (reg *registration) addScalar(
+	structValue reflect.Value,
+	typeField reflect.StructField,
+	field reflect.Value,
+	defs []stagparser.Definition,
+	path string,
+) error {
+	collector, info, err := createScalarGauge(typeField.Name, field, defs, reg.cfg)
+	if err != nil {
+		return err
+	}
+
+	return reg.addCallback(structValue, typeField, collector, info, path)
+}
+
+// addCallback registers collector, which reads its value from a callback on
+// every scrape, for the field typeField of structValue.
+func (reg *registration) addCallback(
+	structValue reflect.Value,
+	typeField reflect.StructField,
+	collector prometheus.Collector,
+	info metricInfo,
+	path string,
+) error {
+	if !reg.included(typeField.Name, info.name) {
+		return nil
+	}
+	if err := validateMetricInfo(info, false, reg.cfg); err != nil {
+		return err
+	}
+
+	info.field = path + typeField.Name
+	if err := reg.claim(structValue.Type().Name()+"."+typeField.Name, collector); err != nil {
+		return err
+	}
+	reg.infos = append(reg.infos, info)
+	reg.report[info.name] = collector
+	if !reg.cfg.register {
+		return nil
+	}
+	registered, err := reg.register(typeField.Name, collector)
+	if err != nil {
+		delete(reg.report, info.name)
+		reg.infos = reg.infos[:len(reg.infos)-1]
+		return fmt.Errorf("collector register failed for %s: %w", typeField.Name, err)
+	}
+	registered.name = info.field
+	reg.registered = append(reg.registered, registered)
+
+	return nil
+}
+
+// createScalarGauge builds the gauge func of a numeric field tagged with
+// as=gauge. field must be addressable so the gauge sees later changes.
+func createScalarGauge(
+	structFieldName string,
+	field reflect.Value,
+	defs []stagparser.Definition,
+	cfg *config,
+) (prometheus.GaugeFunc, metricInfo, error) {
+	read, ok := scalarReader(field)
+	if !ok {
+		return nil, metricInfo{}, fmt.Errorf("%w: as=gauge requires a numeric field, not %v", ErrTypeNotSupported, field.Type())
+	}
+
+	if err := checkAttributes("scalar gauge", defs); err != nil {
+		return nil, metricInfo{}, err
+	}
+
+	name, err := qualifiedName(defaultMetricName(structFieldName, cfg), defs)
+	if err != nil {
+		return nil, metricInfo{}, err
+	}
+	constLabels, err := constLabelsAttr(defs, nil, cfg)
+	if err != nil {
+		return nil, metricInfo{}, err
+	}
+	opt := prometheus.GaugeOpts{Name: name, ConstLabels: constLabels}
+	help, _, err := StringAttr(defs, "help")
+	if err != nil {
+		return nil, metricInfo{}, err
+	}
+	opt.Help = help
+	if as, ok, err := StringAttr(defs, "as"); ok && (err != nil || as != "gauge") {
+		return nil, metricInfo{}, fmt.Errorf("%w: as must be gauge", ErrAttributeMalformed)
+	}
+
+	unit, err := unitAttr(defs)
+	if err != nil {
+		return nil, metricInfo{}, err
+	}
+	info := metricInfo{name: opt.Name, kind: "gauge", help: opt.Help, constLabels: constLabels, unit: unit}
+	return prometheus.NewGaugeFunc(opt, read), info, nil
+}
+
+// scalarReader returns a function reading the current value of a numeric
+// field as float64.
+func scalarReader(field reflect.Value) (func() float64, bool) {
+	switch field.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return func() float64 { return float64(field.Int()) }, true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return func() float64 { return float64(field.Uint()) }, true
+	case reflect.Float32, reflect.Float64:
+		return field.Float, true
+	}
+
+	return nil, false
+}
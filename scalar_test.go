@@ -0,0 +1,95 @@
+package misery
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestScalarGauge(t *testing.T) {
+	type config struct {
+		MaxConnections int     `misery:"name=max_connections,help='Connection limit.',as=gauge"`
+		Ratio          float64 `misery:"name=ratio,help='Sampling ratio.',as=gauge"`
+		Workers        uint16  `misery:"name=workers,help='Worker count.',as=gauge"`
+	}
+
+	registry := prometheus.NewRegistry()
+	cfg := &config{MaxConnections: 10, Ratio: 0.5, Workers: 4}
+	if err := RegisterMetrics(cfg, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+
+	want := `
+# HELP max_connections Connection limit.
+# TYPE max_connections gauge
+max_connections 10
+# HELP ratio Sampling ratio.
+# TYPE ratio gauge
+ratio 0.5
+# HELP workers Worker count.
+# TYPE workers gauge
+workers 4
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.MaxConnections = 25
+	cfg.Ratio = 0.125
+	cfg.Workers = 8
+	want = `
+# HELP max_connections Connection limit.
+# TYPE max_connections gauge
+max_connections 25
+# HELP ratio Sampling ratio.
+# TYPE ratio gauge
+ratio 0.125
+# HELP workers Worker count.
+# TYPE workers gauge
+workers 8
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScalarGaugeErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		mtrcs   interface{}
+		wantErr error
+	}{
+		{
+			name: "string field",
+			mtrcs: &struct {
+				Mode string `misery:"name=mode,as=gauge"`
+			}{},
+			wantErr: ErrTypeNotSupported,
+		},
+		{
+			name: "bool field",
+			mtrcs: &struct {
+				Enabled bool `misery:"name=enabled,as=gauge"`
+			}{},
+			wantErr: ErrTypeNotSupported,
+		},
+		{
+			name: "as other than gauge",
+			mtrcs: &struct {
+				Limit int `misery:"name=limit,as=counter"`
+			}{},
+			wantErr: ErrAttributeMalformed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := RegisterMetrics(tt.mtrcs, prometheus.NewRegistry())
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
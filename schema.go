@@ -0,0 +1,180 @@
+package misery
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yuin/stagparser"
+)
+
+// valueKind is the kind of value an attribute takes.
+type valueKind int
+
+const (
+	stringValue valueKind = iota
+	numberValue
+	integerValue
+	// listValue is a list or an expression string, like labels={a=b} or
+	// buckets=preset(default).
+	listValue
+)
+
+func (k valueKind) String() string {
+	switch k {
+	case stringValue:
+		return "a string"
+	case numberValue:
+		return "a number"
+	case integerValue:
+		return "an integer"
+	case listValue:
+		return "a list"
+	}
+
+	return "unknown"
+}
+
+// accepts reports whether value, as stagparser returns it, is of kind k.
+func (k valueKind) accepts(value interface{}) bool {
+	switch value.(type) {
+	case string:
+		return k == stringValue || k == listValue
+	case []interface{}, prometheus.Labels, map[float64]float64:
+		return k == listValue
+	case int64:
+		return k == numberValue || k == integerValue
+	case float64:
+		return k == numberValue
+	}
+
+	return false
+}
+
+// attributeSchema lists, per metric kind, the attributes its tag may carry
+// and the kind of their values. Builders still check the values themselves;
+// the schema gives every kind the same messages for misplaced attributes.
+var attributeSchema = map[string]map[string]valueKind{
+	"counter": {
+		"name":             stringValue,
+		"help":             stringValue,
+		"namespace":        stringValue,
+		"subsystem":        stringValue,
+		"unit":             stringValue,
+		"constlabels":      listValue,
+		"constlabels_env":  listValue,
+		"labels":           listValue,
+		"const_label_from": listValue,
+		"init_value":       numberValue,
+	},
+	"gauge": {
+		"name":             stringValue,
+		"help":             stringValue,
+		"namespace":        stringValue,
+		"subsystem":        stringValue,
+		"unit":             stringValue,
+		"constlabels":      listValue,
+		"constlabels_env":  listValue,
+		"labels":           listValue,
+		"const_label_from": listValue,
+	},
+	"histogram": {
+		"name":                      stringValue,
+		"help":                      stringValue,
+		"namespace":                 stringValue,
+		"subsystem":                 stringValue,
+		"unit":                      stringValue,
+		"constlabels":               listValue,
+		"constlabels_env":           listValue,
+		"labels":                    listValue,
+		"buckets":                   listValue,
+		"bucket_unit":               stringValue,
+		"native_factor":             numberValue,
+		"native_max_buckets":        integerValue,
+		"native_min_reset_duration": stringValue,
+		"sample":                    numberValue,
+		"const_label_from":          listValue,
+	},
+	"summary": {
+		"name":             stringValue,
+		"help":             stringValue,
+		"namespace":        stringValue,
+		"subsystem":        stringValue,
+		"unit":             stringValue,
+		"constlabels":      listValue,
+		"constlabels_env":  listValue,
+		"labels":           listValue,
+		"objectives":       listValue,
+		"const_label_from": listValue,
+		"sample":           numberValue,
+	},
+	"scalar gauge": {
+		"name":             stringValue,
+		"help":             stringValue,
+		"namespace":        stringValue,
+		"subsystem":        stringValue,
+		"unit":             stringValue,
+		"constlabels":      listValue,
+		"constlabels_env":  listValue,
+		"const_label_from": listValue,
+		"as":               stringValue,
+	},
+	"gauge func": {
+		"name":             stringValue,
+		"help":             stringValue,
+		"namespace":        stringValue,
+		"subsystem":        stringValue,
+		"unit":             stringValue,
+		"constlabels":      listValue,
+		"constlabels_env":  listValue,
+		"const_label_from": listValue,
+	},
+	"counter func": {
+		"name":             stringValue,
+		"help":             stringValue,
+		"namespace":        stringValue,
+		"subsystem":        stringValue,
+		"unit":             stringValue,
+		"constlabels":      listValue,
+		"constlabels_env":  listValue,
+		"const_label_from": listValue,
+	},
+	"untyped func": {
+		"name":             stringValue,
+		"help":             stringValue,
+		"namespace":        stringValue,
+		"subsystem":        stringValue,
+		"unit":             stringValue,
+		"constlabels":      listValue,
+		"constlabels_env":  listValue,
+		"const_label_from": listValue,
+	},
+}
+
+// checkAttributes validates defs against the schema of kind.
+func checkAttributes(kind string, defs []stagparser.Definition) error {
+	schema := attributeSchema[kind]
+	for _, def := range defs {
+		want, ok := schema[def.Name()]
+		if !ok {
+			return fmt.Errorf("%w: unsupported attribute %s for a %s, use one of %s",
+				ErrAttributeMalformed, def.Name(), kind, allowedAttributes(schema))
+		}
+		if value := def.Attributes()[def.Name()]; !want.accepts(value) {
+			return fmt.Errorf("%w: %s of a %s must be %s", ErrAttributeMalformed, def.Name(), kind, want)
+		}
+	}
+
+	return nil
+}
+
+func allowedAttributes(schema map[string]valueKind) string {
+	names := make([]string, 0, len(schema))
+	for name := range schema {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ", ")
+}
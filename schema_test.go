@@ -0,0 +1,63 @@
+package misery
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCheckAttributes(t *testing.T) {
+	tests := []struct {
+		name    string
+		kind    string
+		tag     string
+		wantMsg string
+	}{
+		{name: "counter", kind: "counter", tag: "name=requests_total,labels=[code],init_value=1"},
+		{name: "histogram", kind: "histogram", tag: "name=latency_seconds,buckets=[1,2],native_max_buckets=10"},
+		{name: "buckets on a counter", kind: "counter", tag: "name=requests_total,buckets=[1,2]",
+			wantMsg: "unsupported attribute buckets for a counter, use one of const_label_from, constlabels, constlabels_env, help, init_value, labels, name, namespace, subsystem, unit"},
+		{name: "objectives on a histogram", kind: "histogram", tag: "name=latency_seconds,objectives={0.5:0.05}",
+			wantMsg: "unsupported attribute objectives for a histogram"},
+		{name: "labels on a gauge func", kind: "gauge func", tag: "name=temperature,labels=[room]",
+			wantMsg: "unsupported attribute labels for a gauge func"},
+		{name: "init value on a gauge", kind: "gauge", tag: "name=queue_depth,init_value=1",
+			wantMsg: "unsupported attribute init_value for a gauge"},
+		{name: "list name", kind: "gauge", tag: "name=[a,b]", wantMsg: "name of a gauge must be a string"},
+		{name: "string init value", kind: "counter", tag: "init_value=one", wantMsg: "init_value of a counter must be a number"},
+		{name: "fractional max buckets", kind: "histogram", tag: "native_max_buckets=1.5",
+			wantMsg: "native_max_buckets of a histogram must be an integer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkAttributes(tt.kind, parseTestTag(t, tt.tag))
+			if tt.wantMsg == "" {
+				if err != nil {
+					t.Fatalf("checkAttributes: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrAttributeMalformed) {
+				t.Fatalf("got error %v, want ErrAttributeMalformed", err)
+			}
+			if !strings.Contains(err.Error(), tt.wantMsg) {
+				t.Errorf("got error %q, want it to contain %q", err, tt.wantMsg)
+			}
+		})
+	}
+}
+
+func TestAttributeOnWrongType(t *testing.T) {
+	s := &struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,buckets=[1,2]"`
+	}{}
+	err := RegisterMetrics(s, prometheus.NewRegistry())
+	if !errors.Is(err, ErrAttributeMalformed) {
+		t.Fatalf("got error %v, want ErrAttributeMalformed", err)
+	}
+	if !strings.Contains(err.Error(), "buckets for a counter") {
+		t.Errorf("got error %q, want it to name buckets and counter", err)
+	}
+}
@@ -0,0 +1,133 @@
+package misery
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// registerSelfMetrics sets misery_registered_metrics for every struct in
+// reg.counts. The gauge vec is shared by all registrations into one
+// registry; rollback removes the series set here again, and the vec too
+// when this registration registered it.
+func (reg *registration) registerSelfMetrics() error {
+	gauge, created, err := selfMetricsGauge(reg.registry)
+	if err != nil {
+		return err
+	}
+	reg.selfGauge, reg.selfGaugeCreated = gauge, created
+
+	for _, c := range reg.counts {
+		gauge.WithLabelValues(c.name).Set(float64(c.count))
+	}
+
+	return nil
+}
+
+// rollbackSelfMetrics undoes registerSelfMetrics.
+func (reg *registration) rollbackSelfMetrics() {
+	if reg.selfGauge == nil {
+		return
+	}
+	for _, c := range reg.counts {
+		reg.selfGauge.DeleteLabelValues(c.name)
+	}
+	if reg.selfGaugeCreated {
+		reg.registry.Unregister(reg.selfGauge)
+	}
+	reg.selfGauge, reg.selfGaugeCreated = nil, false
+}
+
+// selfMetricsGauge returns the misery_registered_metrics gauge vec of
+// registry, registering it unless an earlier registration did; created
+// tells which.
+func selfMetricsGauge(registry prometheus.Registerer) (gauge *prometheus.GaugeVec, created bool, err error) {
+	gauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "misery_registered_metrics",
+		Help: "Number of metrics registered by misery per struct type.",
+	}, []string{"struct"})
+
+	if err := registry.Register(gauge); err != nil {
+		var already prometheus.AlreadyRegisteredError
+		if !errors.As(err, &already) {
+			return nil, false, fmt.Errorf("self metrics register failed: %w", err)
+		}
+		existing, ok := already.ExistingCollector.(*prometheus.GaugeVec)
+		if !ok {
+			return nil, false, fmt.Errorf("self metrics register failed: %w", err)
+		}
+		return existing, false, nil
+	}
+
+	return gauge, true, nil
+}
+
+// seriesCounter exposes, under WithCardinalityMetrics, the number of series
+// a vec holds as misery_series_count{metric="<name>"}. Every vec gets its own
+// collector, told apart by the metric label, so registrations into one
+// registry do not clash.
+type seriesCounter struct {
+	desc *prometheus.Desc
+	vec  prometheus.Collector
+}
+
+func newSeriesCounter(name string, vec prometheus.Collector) seriesCounter {
+	return seriesCounter{
+		desc: prometheus.NewDesc(
+			"misery_series_count",
+			"Number of series a metric vec built by misery holds.",
+			nil, prometheus.Labels{"metric": name},
+		),
+		vec: vec,
+	}
+}
+
+func (c seriesCounter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c seriesCounter) Collect(ch chan<- prometheus.Metric) {
+	inner := make(chan prometheus.Metric)
+	go func() {
+		c.vec.Collect(inner)
+		close(inner)
+	}()
+
+	count := 0
+	for range inner {
+		count++
+	}
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(count))
+}
+
+// registerSeriesCounters registers a seriesCounter for every vec built.
+// Vecs without labels, which single series fields are built from too, hold
+// one series at most and are left out.
+func (reg *registration) registerSeriesCounters() error {
+	unlabeled := map[string]bool{}
+	for _, info := range reg.infos {
+		if len(info.labels) == 0 {
+			unlabeled[info.name] = true
+		}
+	}
+
+	for name, collector := range reg.report {
+		switch collector.(type) {
+		case *prometheus.CounterVec, *prometheus.GaugeVec, prometheus.ObserverVec:
+		default:
+			continue
+		}
+		if unlabeled[name] {
+			continue
+		}
+
+		counter := newSeriesCounter(name, collector)
+		if err := reg.registry.Register(counter); err != nil {
+			return fmt.Errorf("series count register failed for %s: %w", name, err)
+		}
+		reg.registered = append(reg.registered, registeredField{name: name, collector: counter})
+	}
+
+	return nil
+}
@@ -0,0 +1,160 @@
+package misery
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSelfMetrics(t *testing.T) {
+	type inner struct {
+		Depth prometheus.Gauge `misery:"name=queue_depth"`
+	}
+	type httpStat struct {
+		Requests *prometheus.CounterVec   `misery:"name=http_requests_total"`
+		Latency  *prometheus.HistogramVec `misery:"name=http_latency_seconds"`
+		Inner    inner
+		Skipped  *prometheus.CounterVec `misery:"skip"`
+	}
+	type dbStat struct {
+		Queries *prometheus.CounterVec `misery:"name=db_queries_total"`
+	}
+
+	registry := prometheus.NewRegistry()
+	if err := RegisterMetricsWithOptions(&httpStat{}, registry, WithSelfMetrics(true)); err != nil {
+		t.Fatalf("registering httpStat: %v", err)
+	}
+	// a second struct shares the gauge vec
+	if err := RegisterMetricsWithOptions(&dbStat{}, registry, WithSelfMetrics(true)); err != nil {
+		t.Fatalf("registering dbStat: %v", err)
+	}
+	// without the option nothing is recorded
+	type quiet struct {
+		Events *prometheus.CounterVec `misery:"name=events_total"`
+	}
+	if err := RegisterMetrics(&quiet{}, registry); err != nil {
+		t.Fatalf("registering quiet: %v", err)
+	}
+
+	want := `
+# HELP misery_registered_metrics Number of metrics registered by misery per struct type.
+# TYPE misery_registered_metrics gauge
+misery_registered_metrics{struct="dbStat"} 1
+misery_registered_metrics{struct="httpStat"} 3
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want), "misery_registered_metrics"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSelfMetricsRemoved(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,help=Requests.,labels=[code]"`
+	}
+	type other struct {
+		Queries *prometheus.CounterVec `misery:"name=queries_total,help=Queries."`
+	}
+
+	registry := prometheus.NewRegistry()
+	if err := RegisterMetricsWithOptions(&other{}, registry, WithSelfMetrics(true)); err != nil {
+		t.Fatalf("registering other: %v", err)
+	}
+	s := &stat{}
+	if err := RegisterMetricsWithOptions(s, registry, WithSelfMetrics(true)); err != nil {
+		t.Fatalf("registering stat: %v", err)
+	}
+	if err := UnregisterMetrics(s, registry, WithSelfMetrics(true)); err != nil {
+		t.Fatalf("UnregisterMetrics: %v", err)
+	}
+
+	want := `
+# HELP misery_registered_metrics Number of metrics registered by misery per struct type.
+# TYPE misery_registered_metrics gauge
+misery_registered_metrics{struct="other"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want), "misery_registered_metrics"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a series count taken by a foreign collector fails the registration
+	// after the self metrics are set
+	registry = prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        "misery_series_count",
+		Help:        "Foreign.",
+		ConstLabels: prometheus.Labels{"metric": "requests_total"},
+	}))
+	if err := RegisterMetricsWithOptions(&stat{}, registry, WithSelfMetrics(true), WithCardinalityMetrics(true)); err == nil {
+		t.Fatal("registered over a foreign series count")
+	}
+	if n, err := testutil.GatherAndCount(registry, "misery_registered_metrics"); err != nil || n != 0 {
+		t.Fatalf("%d self metric series left after rollback, error %v", n, err)
+	}
+}
+
+func TestCardinalityMetrics(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec   `misery:"name=requests_total,help=Requests.,labels=[path]"`
+		Latency  *prometheus.HistogramVec `misery:"name=latency_seconds,help=Latency.,labels=[path]"`
+		Uptime   prometheus.Gauge         `misery:"name=uptime_seconds,help=Uptime."`
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	if err := RegisterMetricsWithOptions(s, registry, WithCardinalityMetrics(true)); err != nil {
+		t.Fatalf("RegisterMetricsWithOptions: %v", err)
+	}
+	for _, path := range []string{"/a", "/b", "/c"} {
+		s.Requests.WithLabelValues(path).Inc()
+	}
+	s.Latency.WithLabelValues("/a").Observe(0.1)
+
+	want := `
+# HELP misery_series_count Number of series a metric vec built by misery holds.
+# TYPE misery_series_count gauge
+misery_series_count{metric="latency_seconds"} 1
+misery_series_count{metric="requests_total"} 3
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want), "misery_series_count"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the count follows the vec
+	s.Requests.DeleteLabelValues("/b")
+	s.Latency.WithLabelValues("/b").Observe(0.2)
+	want = `
+# HELP misery_series_count Number of series a metric vec built by misery holds.
+# TYPE misery_series_count gauge
+misery_series_count{metric="latency_seconds"} 2
+misery_series_count{metric="requests_total"} 2
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want), "misery_series_count"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UnregisterMetrics(s, registry); err != nil {
+		t.Fatalf("UnregisterMetrics: %v", err)
+	}
+	if n, err := testutil.GatherAndCount(registry); err != nil || n != 0 {
+		t.Errorf("after UnregisterMetrics: %d series gathered, error %v", n, err)
+	}
+}
+
+func TestCardinalityMetricsDisabled(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,help=Requests.,labels=[path]"`
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	s.Requests.WithLabelValues("/a").Inc()
+
+	if n, err := testutil.GatherAndCount(registry, "misery_series_count"); err != nil || n != 0 {
+		t.Errorf("misery_series_count: %d series gathered, error %v", n, err)
+	}
+}
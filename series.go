@@ -0,0 +1,116 @@
+package misery
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yuin/stagparser"
+)
+
+// isSeriesType reports whether t is one of the single series interfaces,
+// prometheus.Counter, prometheus.Gauge, prometheus.Observer,
+// prometheus.Histogram and prometheus.Summary. misery
+// fills a nil field of such a type with the only series of a vec built
+// without labels and registers the vec.
+func isSeriesType(t reflect.Type) bool {
+	switch t {
+	case prometheusCounterSeriesType, prometheusGaugeSeriesType, prometheusObserverSeriesType,
+		prometheusHistogramSeriesType, prometheusSummarySeriesType:
+		return true
+	}
+
+	return false
+}
+
+// seriesKinds lists the type attribute values each single series type
+// accepts, the first being the default.
+var seriesKinds = map[reflect.Type][]string{
+	prometheusCounterSeriesType:   {"counter"},
+	prometheusGaugeSeriesType:     {"gauge"},
+	prometheusObserverSeriesType:  {"histogram", "summary"},
+	prometheusHistogramSeriesType: {"histogram"},
+	prometheusSummarySeriesType:   {"summary"},
+}
+
+// buildSeriesMetric builds the vec behind a single series field from the
+// type attribute and the remaining attributes.
+func buildSeriesMetric(
+	fieldType reflect.Type,
+	structFieldName string,
+	defs []stagparser.Definition,
+	cfg *config,
+) (prometheus.Collector, metricInfo, error) {
+	kinds := seriesKinds[fieldType]
+	kind, defs, err := takeType(defs, kinds[0])
+	if err != nil {
+		return nil, metricInfo{}, err
+	}
+
+	supported := false
+	for _, k := range kinds {
+		supported = supported || k == kind
+	}
+	if !supported {
+		if _, known := attributeSchema[kind]; known {
+			return nil, metricInfo{}, fmt.Errorf("%w: type %s on a %v field", ErrTypeNotSupported, kind, fieldType)
+		}
+		return nil, metricInfo{}, fmt.Errorf("%w: unknown type %s", ErrAttributeMalformed, kind)
+	}
+
+	var vecType reflect.Type
+	switch kind {
+	case "counter":
+		vecType = prometheusCounterType
+	case "gauge":
+		vecType = prometheusGaugeType
+	case "histogram", "summary":
+		// built as an observer vec, which also applies sample
+		vecType = prometheusObserverVecType
+		defs = append(defs[:len(defs):len(defs)], newDefinition("type", kind))
+	}
+	collector, info, err := buildMetric(vecType, structFieldName, defs, cfg)
+	if err != nil {
+		return nil, metricInfo{}, err
+	}
+	if len(info.labels) > 0 {
+		return nil, metricInfo{}, fmt.Errorf("%w: labels require a vec field, not %v", ErrAttributeMalformed, fieldType)
+	}
+	if (fieldType == prometheusHistogramSeriesType || fieldType == prometheusSummarySeriesType) && info.sample != 1 {
+		// a sampled series is an Observer only
+		return nil, metricInfo{}, fmt.Errorf("%w: sample on a %v field", ErrTypeNotSupported, fieldType)
+	}
+
+	return collector, info, nil
+}
+
+// fieldValue returns what a field of fieldType holds for collector: the
+// collector itself, its only series for single series fields, or a Timer
+// on it for timer fields. ok is false when that does not fit the field.
+func fieldValue(fieldType reflect.Type, collector prometheus.Collector) (value reflect.Value, ok bool) {
+	var held interface{} = collector
+	if fieldType == timerType {
+		vec, ok := collector.(prometheus.ObserverVec)
+		if !ok {
+			return reflect.Value{}, false
+		}
+		held = &Timer{vec: vec}
+	}
+	if isSeriesType(fieldType) {
+		switch vec := collector.(type) {
+		case *prometheus.CounterVec:
+			held = vec.WithLabelValues()
+		case *prometheus.GaugeVec:
+			held = vec.WithLabelValues()
+		case prometheus.ObserverVec:
+			held = vec.WithLabelValues()
+		default:
+			return reflect.Value{}, false
+		}
+	}
+	if held == nil || !reflect.TypeOf(held).AssignableTo(fieldType) {
+		return reflect.Value{}, false
+	}
+
+	return reflect.ValueOf(held), true
+}
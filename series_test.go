@@ -0,0 +1,196 @@
+package misery
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSeriesFields(t *testing.T) {
+	type stat struct {
+		Requests prometheus.Counter   `misery:"name=requests_total,help=Requests."`
+		Queue    prometheus.Gauge     `misery:"name=queue_depth,help='Queue depth.'"`
+		Latency  prometheus.Observer  `misery:"name=latency_seconds,help=Latency.,buckets=[1]"`
+		Sizes    prometheus.Observer  `misery:"name=sizes_bytes,help=Sizes.,type=summary"`
+		Duration prometheus.Histogram `misery:"name=duration_seconds,help=Duration.,buckets=[1]"`
+		Payload  prometheus.Summary   `misery:"name=payload_bytes,help=Payload."`
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	s.Requests.Inc()
+	s.Queue.Set(2)
+	s.Latency.Observe(0.5)
+	s.Sizes.Observe(10)
+	s.Duration.Observe(2)
+	s.Payload.Observe(20)
+
+	want := `
+# HELP duration_seconds Duration.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{le="1"} 0
+duration_seconds_bucket{le="+Inf"} 1
+duration_seconds_sum 2
+duration_seconds_count 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="1"} 1
+latency_seconds_bucket{le="+Inf"} 1
+latency_seconds_sum 0.5
+latency_seconds_count 1
+# HELP payload_bytes Payload.
+# TYPE payload_bytes summary
+payload_bytes_sum 20
+payload_bytes_count 1
+# HELP queue_depth Queue depth.
+# TYPE queue_depth gauge
+queue_depth 2
+# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total 1
+# HELP sizes_bytes Sizes.
+# TYPE sizes_bytes summary
+sizes_bytes_sum 10
+sizes_bytes_count 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countingCounter is a fake prometheus.Counter a test injects before
+// registration. It describes itself through the embedded counter.
+type countingCounter struct {
+	prometheus.Counter
+	n float64
+}
+
+func (c *countingCounter) Inc()          { c.n++ }
+func (c *countingCounter) Add(v float64) { c.n += v }
+
+func TestSeriesFieldFake(t *testing.T) {
+	type stat struct {
+		Requests prometheus.Counter `misery:"name=requests_total"`
+		Errors   prometheus.Counter `misery:"name=errors_total"`
+	}
+
+	registry := prometheus.NewRegistry()
+	fake := &countingCounter{Counter: prometheus.NewCounter(prometheus.CounterOpts{Name: "fake_total"})}
+	s := &stat{Requests: fake}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	if s.Requests != fake {
+		t.Fatalf("fake replaced by %T", s.Requests)
+	}
+	if s.Errors == nil {
+		t.Fatal("nil field not built")
+	}
+	s.Requests.Add(3)
+	if fake.n != 3 {
+		t.Errorf("fake counted %v, want 3", fake.n)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	if len(families) != 1 || families[0].GetName() != "errors_total" {
+		t.Errorf("got %d metrics, want errors_total only", len(families))
+	}
+}
+
+func TestSeriesFieldErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		mtrcs   interface{}
+		wantErr error
+	}{
+		{
+			name: "histogram on a counter",
+			mtrcs: &struct {
+				Requests prometheus.Counter `misery:"name=requests_total,type=histogram"`
+			}{},
+			wantErr: ErrTypeNotSupported,
+		},
+		{
+			name: "gauge on an observer",
+			mtrcs: &struct {
+				Latency prometheus.Observer `misery:"name=latency_seconds,type=gauge"`
+			}{},
+			wantErr: ErrTypeNotSupported,
+		},
+		{
+			name: "summary on a histogram",
+			mtrcs: &struct {
+				Latency prometheus.Histogram `misery:"name=latency_seconds,type=summary"`
+			}{},
+			wantErr: ErrTypeNotSupported,
+		},
+		{
+			name: "unknown type",
+			mtrcs: &struct {
+				Requests prometheus.Counter `misery:"name=requests_total,type=meter"`
+			}{},
+			wantErr: ErrAttributeMalformed,
+		},
+		{
+			name: "labels",
+			mtrcs: &struct {
+				Requests prometheus.Counter `misery:"name=requests_total,labels=[code]"`
+			}{},
+			wantErr: ErrAttributeMalformed,
+		},
+		{
+			name: "sample on a histogram",
+			mtrcs: &struct {
+				Latency prometheus.Histogram `misery:"name=latency_seconds,sample=0.5"`
+			}{},
+			wantErr: ErrTypeNotSupported,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := RegisterMetrics(tt.mtrcs, prometheus.NewRegistry())
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHistogramSummaryFields(t *testing.T) {
+	type stat struct {
+		Latency prometheus.Histogram `misery:"name=latency_seconds,help=Latency.,type=histogram"`
+		Payload prometheus.Summary   `misery:"name=payload_bytes,help=Payload.,objectives={0.5:0.05}"`
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	s.Latency.Observe(0.05)
+	s.Payload.Observe(20)
+
+	histogram := gatherFamily(t, registry, "latency_seconds").GetMetric()[0].GetHistogram()
+	if got, want := len(histogram.GetBucket()), len(defaultHistogramBuckets); got != want {
+		t.Errorf("%d buckets, want the %d default ones", got, want)
+	}
+	summary := gatherFamily(t, registry, "payload_bytes").GetMetric()[0].GetSummary()
+	if quantiles := summary.GetQuantile(); len(quantiles) != 1 || quantiles[0].GetQuantile() != 0.5 || quantiles[0].GetValue() != 20 {
+		t.Errorf("quantiles %v, want the median 20", quantiles)
+	}
+
+	sampled := &struct {
+		Payload prometheus.Summary `misery:"name=payload_bytes,sample=0.5"`
+	}{}
+	if err := RegisterMetrics(sampled, prometheus.NewRegistry()); !errors.Is(err, ErrTypeNotSupported) {
+		t.Errorf("sample on a summary: got error %v, want ErrTypeNotSupported", err)
+	}
+}
@@ -0,0 +1,54 @@
+package misery
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sharedMetric is a collector WithShareIdentical hands out to every field
+// declaring the same metric.
+type sharedMetric struct {
+	identity  string
+	collector prometheus.Collector
+}
+
+// identity describes everything that makes two declarations of info.name
+// the same metric.
+func (info metricInfo) identity() string {
+	return fmt.Sprintf("%s|%q|%q|%v|%v|%v|%v|%v|%v|%v|%s",
+		info.kind, info.help, info.labels, info.initLabels, info.allowed, info.constLabels,
+		info.buckets, info.nativeFactor, info.objectives, info.sample, info.unit)
+}
+
+// share sets field to the collector built before for a declaration
+// identical to info, when WithShareIdentical is in effect, and reports
+// whether it did. Anything else goes on to be built and claimed, which
+// fails for a name declared before.
+func (reg *registration) share(field reflect.Value, info metricInfo) bool {
+	if !reg.cfg.shareIdentical {
+		return false
+	}
+	shared, ok := reg.shared[info.name]
+	if !ok || shared.identity != info.identity() {
+		return false
+	}
+	value, ok := fieldValue(field.Type(), shared.collector)
+	if !ok {
+		return false
+	}
+
+	previous := snapshot(field)
+	field.Set(value)
+	reg.registered = append(reg.registered, registeredField{name: info.name, field: field, previous: previous})
+
+	return true
+}
+
+// keepShared records collector as built for info under WithShareIdentical.
+func (reg *registration) keepShared(info metricInfo, collector prometheus.Collector) {
+	if reg.cfg.shareIdentical {
+		reg.shared[info.name] = sharedMetric{identity: info.identity(), collector: collector}
+	}
+}
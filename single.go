@@ -0,0 +1,104 @@
+package misery
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yuin/stagparser"
+)
+
+// RegisterCounter builds and registers a single counter vec outside of any
+// struct, validating name and labels like a tagged field.
+func RegisterCounter(name, help string, labels []string, registry prometheus.Registerer) (*prometheus.CounterVec, error) {
+	cfg := newConfig()
+	vec, info, err := createPrometheusCounter(name, singleDefinitions(name, help, labels), cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := registerSingle(vec, info, registry, cfg); err != nil {
+		return nil, err
+	}
+
+	return vec, nil
+}
+
+// RegisterGauge is RegisterCounter for a gauge vec.
+func RegisterGauge(name, help string, labels []string, registry prometheus.Registerer) (*prometheus.GaugeVec, error) {
+	cfg := newConfig()
+	vec, info, err := createPrometheusGauge(name, singleDefinitions(name, help, labels), cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := registerSingle(vec, info, registry, cfg); err != nil {
+		return nil, err
+	}
+
+	return vec, nil
+}
+
+// RegisterHistogram is RegisterCounter for a histogram vec. Nil buckets
+// select the default ones.
+func RegisterHistogram(
+	name, help string,
+	labels []string,
+	buckets []float64,
+	registry prometheus.Registerer,
+) (*prometheus.HistogramVec, error) {
+	cfg := newConfig()
+	defs := singleDefinitions(name, help, labels)
+	if buckets != nil {
+		defs = append(defs, newDefinition("buckets", floatList(buckets)))
+	}
+
+	vec, info, err := createPrometheusHistogram(name, defs, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := registerSingle(vec, info, registry, cfg); err != nil {
+		return nil, err
+	}
+
+	return vec, nil
+}
+
+func singleDefinitions(name, help string, labels []string) []stagparser.Definition {
+	return []stagparser.Definition{
+		newDefinition("name", name),
+		newDefinition("help", help),
+		newDefinition("labels", stringList(labels)),
+	}
+}
+
+// stringList returns strs as the list value of a definition.
+func stringList(strs []string) []interface{} {
+	list := make([]interface{}, 0, len(strs))
+	for _, s := range strs {
+		list = append(list, s)
+	}
+
+	return list
+}
+
+// floatList returns floats as the list value of a definition.
+func floatList(floats []float64) []interface{} {
+	list := make([]interface{}, 0, len(floats))
+	for _, f := range floats {
+		list = append(list, f)
+	}
+
+	return list
+}
+
+func registerSingle(collector prometheus.Collector, info metricInfo, registry prometheus.Registerer, cfg *config) error {
+	if err := checkRegistry(registry); err != nil {
+		return err
+	}
+	if err := validateMetricInfo(info, true, cfg); err != nil {
+		return err
+	}
+	if err := registry.Register(collector); err != nil {
+		return fmt.Errorf("collector register failed for %s: %w", info.name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package misery
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRegisterSingle(t *testing.T) {
+	register := map[string]func(name string, labels []string, registry prometheus.Registerer) (prometheus.Collector, error){
+		"counter": func(name string, labels []string, registry prometheus.Registerer) (prometheus.Collector, error) {
+			return RegisterCounter(name, "Help.", labels, registry)
+		},
+		"gauge": func(name string, labels []string, registry prometheus.Registerer) (prometheus.Collector, error) {
+			return RegisterGauge(name, "Help.", labels, registry)
+		},
+		"histogram": func(name string, labels []string, registry prometheus.Registerer) (prometheus.Collector, error) {
+			return RegisterHistogram(name, "Help.", labels, []float64{0.1, 1}, registry)
+		},
+	}
+
+	tests := []struct {
+		name    string
+		metric  string
+		labels  []string
+		wantErr error
+	}{
+		{name: "valid", metric: "requests", labels: []string{"code"}},
+		{name: "no labels", metric: "requests"},
+		{name: "dash in name", metric: "broken-name", wantErr: ErrAttributeMalformed},
+		{name: "leading digit", metric: "1requests", wantErr: ErrAttributeMalformed},
+		{name: "empty name", metric: "", wantErr: ErrAttributeMalformed},
+		{name: "invalid label", metric: "requests", labels: []string{"status-code"}, wantErr: ErrAttributeMalformed},
+		{name: "reserved label", metric: "requests", labels: []string{"__code"}, wantErr: ErrAttributeMalformed},
+		{name: "repeated label", metric: "requests", labels: []string{"code", "code"}, wantErr: ErrAttributeMalformed},
+	}
+	for kind, fn := range register {
+		for _, tt := range tests {
+			t.Run(kind+"/"+tt.name, func(t *testing.T) {
+				registry := prometheus.NewRegistry()
+				collector, err := fn(tt.metric, tt.labels, registry)
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				if err != nil {
+					if n, _ := testutil.GatherAndCount(registry); n != 0 {
+						t.Errorf("got %d series registered after an error", n)
+					}
+					return
+				}
+				if collector == nil {
+					t.Fatal("nil collector")
+				}
+				if _, err := fn(tt.metric, tt.labels, registry); err == nil {
+					t.Error("registering the same metric twice: got no error")
+				}
+			})
+		}
+	}
+}
+
+func TestRegisterHistogramBuckets(t *testing.T) {
+	tests := []struct {
+		name    string
+		buckets []float64
+		want    []float64
+		wantErr error
+	}{
+		{name: "explicit", buckets: []float64{0.5, 5}, want: []float64{0.5, 5}},
+		{name: "default", want: defaultHistogramBuckets},
+		{name: "not increasing", buckets: []float64{5, 0.5}, wantErr: ErrAttributeMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			vec, err := RegisterHistogram("latency_seconds", "Latency.", nil, tt.buckets, registry)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			vec.WithLabelValues().Observe(1)
+			histogram := gatherFamily(t, registry, "latency_seconds").GetMetric()[0].GetHistogram()
+			var got []float64
+			for _, bucket := range histogram.GetBucket() {
+				got = append(got, bucket.GetUpperBound())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got buckets %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
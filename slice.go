@@ -0,0 +1,67 @@
+package misery
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/yuin/stagparser"
+)
+
+// isMetricSlice reports whether t is a slice of a metric type.
+func isMetricSlice(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && isMetricType(t.Elem())
+}
+
+// addSlice builds one metric per name of the names attribute into the
+// elements of a slice field, the other attributes being shared by all of
+// them. A nil slice is allocated; otherwise its length must match names.
+// Dry runs fill a copy of a non-nil slice, as the struct copy they work on
+// shares its backing array with the caller's.
+func (reg *registration) addSlice(
+	structValue reflect.Value,
+	structFieldName string,
+	field reflect.Value,
+	defs []stagparser.Definition,
+	path string,
+) error {
+	names, _, err := StringListAttr(defs, "names")
+	if err != nil {
+		return err
+	}
+	rest := make([]stagparser.Definition, 0, len(defs))
+	for _, def := range defs {
+		switch def.Name() {
+		case "names":
+			// turned into a name per element below
+		case "name":
+			return fmt.Errorf("%w: name cannot be combined with names", ErrAttributeMalformed)
+		default:
+			rest = append(rest, def)
+		}
+	}
+
+	if field.IsNil() || reg.copyPointers {
+		previous := snapshot(field)
+		length := len(names)
+		if !field.IsNil() {
+			length = field.Len()
+		}
+		elems := reflect.MakeSlice(field.Type(), length, length)
+		reflect.Copy(elems, field)
+		field.Set(elems)
+		reg.registered = append(reg.registered, registeredField{name: path + structFieldName, field: field, previous: previous})
+	}
+	if field.Len() != len(names) {
+		return fmt.Errorf("%w: %d names for %d slice elements", ErrAttributeMalformed, len(names), field.Len())
+	}
+
+	for i, name := range names {
+		elemDefs := append(rest[:len(rest):len(rest)], newDefinition("name", name))
+		elemName := fmt.Sprintf("%s[%d]", structFieldName, i)
+		if err := reg.addMetric(structValue, elemName, field.Index(i), elemDefs, path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
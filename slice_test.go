@@ -0,0 +1,85 @@
+package misery
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSliceField(t *testing.T) {
+	type stat struct {
+		Requests []*prometheus.CounterVec `misery:"names=[api_requests_total,db_requests_total,cache_requests_total],help=Requests.,labels=[code]"`
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	if len(s.Requests) != 3 {
+		t.Fatalf("got %d elements, want 3", len(s.Requests))
+	}
+	for i, vec := range s.Requests {
+		vec.WithLabelValues("200").Add(float64(i + 1))
+	}
+
+	want := `
+# HELP api_requests_total Requests.
+# TYPE api_requests_total counter
+api_requests_total{code="200"} 1
+# HELP cache_requests_total Requests.
+# TYPE cache_requests_total counter
+cache_requests_total{code="200"} 3
+# HELP db_requests_total Requests.
+# TYPE db_requests_total counter
+db_requests_total{code="200"} 2
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSliceFieldPreallocated(t *testing.T) {
+	type stat struct {
+		Requests []*prometheus.CounterVec `misery:"names=[a_total,b_total,c_total],labels=[code]"`
+	}
+
+	tests := []struct {
+		name    string
+		length  int
+		wantErr error
+	}{
+		{name: "matching length", length: 3},
+		{name: "too short", length: 2, wantErr: ErrAttributeMalformed},
+		{name: "too long", length: 4, wantErr: ErrAttributeMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &stat{Requests: make([]*prometheus.CounterVec, tt.length)}
+			err := RegisterMetrics(s, prometheus.NewRegistry())
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			for i, vec := range s.Requests {
+				if vec == nil {
+					t.Errorf("element %d is nil", i)
+				}
+			}
+		})
+	}
+}
+
+func TestSliceFieldNameAttribute(t *testing.T) {
+	s := &struct {
+		Requests []*prometheus.CounterVec `misery:"names=[a_total,b_total],name=requests_total"`
+	}{}
+	if err := RegisterMetrics(s, prometheus.NewRegistry()); !errors.Is(err, ErrAttributeMalformed) {
+		t.Fatalf("got error %v, want ErrAttributeMalformed", err)
+	}
+}
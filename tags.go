@@ -0,0 +1,261 @@
+package misery
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// quoteExpressions rewrites attribute values that stagparser cannot parse,
+// such as preset(default) or {a:b}, into quoted strings so the builders can
+// interpret them. Blanks outside quotes are dropped; everything else is
+// passed through unchanged.
+func quoteExpressions(tag string) string {
+	var out strings.Builder
+	valueStart, depth := false, 0
+	for i := 0; i < len(tag); {
+		c := tag[i]
+		switch c {
+		case '\'':
+			end := skipQuoted(tag, i)
+			out.WriteString(tag[i:end])
+			i = end
+			valueStart = false
+			continue
+		case '=':
+			valueStart = true
+		case '[':
+			depth++
+			valueStart = true
+		case ']':
+			depth--
+			valueStart = false
+		case ',':
+			valueStart = depth > 0
+		case ')':
+			valueStart = false
+		case ' ', '\t':
+			// stagparser chokes on blanks around quoted values
+			i++
+			continue
+		default:
+			if !valueStart {
+				break
+			}
+			end := i
+			for end < len(tag) && !strings.ContainsRune(",[]()'{} \t=", rune(tag[end])) {
+				end++
+			}
+			if end < len(tag) && (tag[end] == '(' || tag[end] == '{') {
+				if closing := matchClosing(tag, end); closing > 0 {
+					end = closing
+					out.WriteString(quoteString(tag[i:end]))
+					i = end
+					valueStart = false
+					continue
+				}
+			}
+			out.WriteString(quoteLiteral(tag[i:end]))
+			i = end
+			valueStart = false
+			continue
+		}
+		out.WriteByte(c)
+		i++
+	}
+
+	return out.String()
+}
+
+// skipQuoted returns the index right after the '-quoted string starting at
+// start, honouring backslash escapes.
+func skipQuoted(s string, start int) int {
+	for i := start + 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '\'':
+			return i + 1
+		}
+	}
+
+	return len(s)
+}
+
+// matchClosing returns the index right after the bracket matching the one at
+// open, or -1 when it is unbalanced.
+func matchClosing(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '\'':
+			i = skipQuoted(s, i) - 1
+		case '(', '{', '[':
+			depth++
+		case ')', '}', ']':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+
+	return -1
+}
+
+// quoteLiteral quotes tokens that look like numbers but are not, such as 5m
+// or 1_000, and words that are not plain identifiers, such as http.requests,
+// which stagparser would otherwise reject.
+func quoteLiteral(token string) string {
+	if token == "" {
+		return token
+	}
+	if !strings.ContainsRune("0123456789+-.", rune(token[0])) {
+		if strings.IndexFunc(token, func(r rune) bool {
+			return r != '_' && !('a' <= r && r <= 'z') && !('A' <= r && r <= 'Z') && !('0' <= r && r <= '9')
+		}) >= 0 {
+			return quoteString(token)
+		}
+		return token
+	}
+	if _, err := strconv.ParseInt(token, 10, 64); err == nil {
+		return token
+	}
+	if _, err := strconv.ParseFloat(token, 64); err == nil && !strings.Contains(token, "_") {
+		return token
+	}
+
+	return quoteString(token)
+}
+
+func quoteString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// parseCall splits an expression like preset(default) into the function
+// name and its top level arguments.
+func parseCall(expr string) (fn string, args []string, err error) {
+	expr = strings.TrimSpace(expr)
+	open := strings.IndexByte(expr, '(')
+	if open <= 0 || !strings.HasSuffix(expr, ")") {
+		return "", nil, fmt.Errorf("%w: %q is not a function call", ErrAttributeMalformed, expr)
+	}
+
+	fn = strings.TrimSpace(expr[:open])
+	body := strings.TrimSpace(expr[open+1 : len(expr)-1])
+	if body == "" {
+		return fn, nil, nil
+	}
+
+	return fn, splitTopLevel(body, ','), nil
+}
+
+// splitTopLevel splits s on sep, ignoring separators nested in brackets or
+// quotes, and trims spaces around every part.
+func splitTopLevel(s string, sep byte) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\'':
+			i = skipQuoted(s, i) - 1
+		case '(', '{', '[':
+			depth++
+		case ')', '}', ']':
+			depth--
+		case sep:
+			if depth == 0 {
+				parts = append(parts, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+
+	return append(parts, strings.TrimSpace(s[start:]))
+}
+
+// toFloat converts a numeric attribute value to float64.
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	}
+
+	return 0, false
+}
+
+// toBool converts a boolean attribute value, written as true or false.
+func toBool(value interface{}) (bool, error) {
+	boolString, ok := value.(string)
+	if !ok {
+		return false, fmt.Errorf("%v is not a boolean", value)
+	}
+
+	b, err := strconv.ParseBool(boolString)
+	if err != nil {
+		return false, fmt.Errorf("%q is not a boolean", boolString)
+	}
+
+	return b, nil
+}
+
+type mapEntry struct {
+	key, value string
+}
+
+// parseMap parses a {key=value, key: 'value'} expression into its entries in
+// source order. Keys and values may be quoted with '.
+func parseMap(expr string) ([]mapEntry, error) {
+	expr = strings.TrimSpace(expr)
+	if !strings.HasPrefix(expr, "{") || !strings.HasSuffix(expr, "}") {
+		return nil, fmt.Errorf("%w: %q is not a {key=value} map", ErrAttributeMalformed, expr)
+	}
+
+	body := strings.TrimSpace(expr[1 : len(expr)-1])
+	if body == "" {
+		return nil, nil
+	}
+
+	parts := splitTopLevel(body, ',')
+	entries := make([]mapEntry, 0, len(parts))
+	for _, part := range parts {
+		sep := strings.IndexAny(part, "=:")
+		if sep <= 0 {
+			return nil, fmt.Errorf("%w: %q is not a key=value pair", ErrAttributeMalformed, part)
+		}
+		key, err := unquote(part[:sep])
+		if err != nil {
+			return nil, err
+		}
+		value, err := unquote(part[sep+1:])
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			return nil, fmt.Errorf("%w: %q has an empty key", ErrAttributeMalformed, part)
+		}
+		entries = append(entries, mapEntry{key: key, value: value})
+	}
+
+	return entries, nil
+}
+
+// unquote trims s and removes the ' quotes around it, if any.
+func unquote(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "'") {
+		if strings.ContainsAny(s, "'{}[]()=:") {
+			return "", fmt.Errorf("%w: unexpected character in %q", ErrAttributeMalformed, s)
+		}
+		return s, nil
+	}
+	if len(s) < 2 || skipQuoted(s, 0) != len(s) {
+		return "", fmt.Errorf("%w: unterminated string %q", ErrAttributeMalformed, s)
+	}
+
+	return strings.NewReplacer(`\`, `\`, `'`, `'`).Replace(s[1 : len(s)-1]), nil
+}
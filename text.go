@@ -0,0 +1,35 @@
+package misery
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// GatherText renders the metrics of mtrcs in the Prometheus text exposition
+// format, for golden file tests of metric names, labels and help. Metrics
+// are gathered from a throwaway registry like PushMetrics pushes them, so
+// the output is sorted by metric name and label values and is stable across
+// runs. Vecs without series are not exposed; initialize labels in the tag
+// or observe values first to see them.
+func GatherText(mtrcs interface{}) (string, error) {
+	registry, err := scratchRegistry(mtrcs)
+	if err != nil {
+		return "", err
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		return "", fmt.Errorf("gather failed: %w", err)
+	}
+
+	var out strings.Builder
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(&out, family); err != nil {
+			return "", fmt.Errorf("%s: %w", family.GetName(), err)
+		}
+	}
+
+	return out.String(), nil
+}
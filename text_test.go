@@ -0,0 +1,32 @@
+package misery
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestGatherText(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec   `misery:"name=requests_total,help='Requests served.',labels={code=200,method=GET}"`
+		Queue    prometheus.Gauge         `misery:"name=queue_depth,help='Queue depth.',constlabels={pool:db}"`
+		Latency  *prometheus.HistogramVec `misery:"name=latency_seconds,help='Request latency.',labels={path=/},buckets=[0.1,1]"`
+		Idle     *prometheus.CounterVec   `misery:"name=idle_total,help='Never touched.',labels=[code]"`
+	}
+
+	want, err := os.ReadFile(filepath.Join("testdata", "gather_text.golden"))
+	if err != nil {
+		t.Fatalf("read golden file: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		got, err := GatherText(&stat{})
+		if err != nil {
+			t.Fatalf("GatherText: %v", err)
+		}
+		if got != string(want) {
+			t.Fatalf("run %d: got\n%s\nwant\n%s", i, got, want)
+		}
+	}
+}
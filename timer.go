@@ -0,0 +1,116 @@
+package misery
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ContextTimer is a prometheus.Timer aware of the context of the work it
+// times, so that work abandoned because of a deadline or cancellation can be
+// counted apart from work that completed.
+type ContextTimer struct {
+	ctx      context.Context
+	observer prometheus.Observer
+	canceled prometheus.Counter
+	begin    time.Time
+}
+
+// NewContextTimer starts timing the work bound to ctx. The elapsed time is
+// observed on o, typically a series obtained from Report.Observer.
+func NewContextTimer(ctx context.Context, o prometheus.Observer) *ContextTimer {
+	return &ContextTimer{
+		ctx:      ctx,
+		observer: o,
+		begin:    time.Now(),
+	}
+}
+
+// WithCanceledCounter makes ObserveDuration increment c when the context is
+// done by the time the work finishes.
+func (t *ContextTimer) WithCanceledCounter(c prometheus.Counter) *ContextTimer {
+	t.canceled = c
+	return t
+}
+
+// ObserveDuration observes the time elapsed since NewContextTimer in seconds
+// and returns it. Durations are observed whether or not the context is done;
+// the canceled counter, if set, is what tells the two apart.
+func (t *ContextTimer) ObserveDuration() time.Duration {
+	d := time.Since(t.begin)
+	if t.observer != nil {
+		t.observer.Observe(d.Seconds())
+	}
+	if t.canceled != nil && t.ctx.Err() != nil {
+		t.canceled.Inc()
+	}
+
+	return d
+}
+
+// Timed starts timing and returns a function observing the elapsed seconds
+// on the series of the named histogram or summary vec selected by labels,
+// meant for timing a whole function:
+//
+//	defer misery.Timed(report, "request_duration", labels)()
+//
+// When the series cannot be resolved the returned function does nothing;
+// StartTimer reports the error instead.
+func Timed(report Report, field string, labels prometheus.Labels) func() {
+	stop, err := StartTimer(report, field, labels)
+	if err != nil {
+		return func() {}
+	}
+
+	return stop
+}
+
+// StartTimer is Timed returning an error, and no function, when field is not
+// an observer vec of report or labels do not select one of its series.
+func StartTimer(report Report, field string, labels prometheus.Labels) (func(), error) {
+	observer, err := report.Observer(field, labels)
+	if err != nil {
+		return nil, err
+	}
+
+	begin := time.Now()
+	return func() {
+		observer.Observe(time.Since(begin).Seconds())
+	}, nil
+}
+
+// Timer is a field type for timing work with two calls. RegisterMetrics
+// builds it from the tag exactly like a prometheus.ObserverVec field, a
+// histogram vec unless the type attribute says summary:
+//
+//	type Metrics struct {
+//		RequestDuration *misery.Timer `misery:"labels=[method],buckets=[0.01, 0.1, 1]"`
+//	}
+//
+//	defer m.RequestDuration.Start("GET").ObserveDuration()
+//
+// A Timer is a prometheus.Collector of the vec it times on.
+type Timer struct {
+	vec prometheus.ObserverVec
+}
+
+// Start starts timing on the series selected by labelValues, given in the
+// order of the labels attribute. Like WithLabelValues it panics when they
+// do not match the labels.
+func (t *Timer) Start(labelValues ...string) *prometheus.Timer {
+	return prometheus.NewTimer(t.vec.WithLabelValues(labelValues...))
+}
+
+// ObserverVec returns the vec t times on.
+func (t *Timer) ObserverVec() prometheus.ObserverVec {
+	return t.vec
+}
+
+func (t *Timer) Describe(ch chan<- *prometheus.Desc) {
+	t.vec.Describe(ch)
+}
+
+func (t *Timer) Collect(ch chan<- prometheus.Metric) {
+	t.vec.Collect(ch)
+}
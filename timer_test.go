@@ -0,0 +1,192 @@
+package misery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestContextTimer(t *testing.T) {
+	type stat struct {
+		Latency  *prometheus.HistogramVec `misery:"name=latency_seconds,labels=[path]"`
+		Canceled *prometheus.CounterVec   `misery:"name=canceled_total,labels=[path]"`
+	}
+
+	tests := []struct {
+		name     string
+		cancel   bool
+		canceled float64
+	}{
+		{name: "completed"},
+		{name: "canceled", cancel: true, canceled: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			s := &stat{}
+			report, err := RegisterMetricsReport(s, registry)
+			if err != nil {
+				t.Fatalf("RegisterMetricsReport: %v", err)
+			}
+			observer, err := report.Observer("latency_seconds", prometheus.Labels{"path": "/"})
+			if err != nil {
+				t.Fatalf("Observer: %v", err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			timer := NewContextTimer(ctx, observer).WithCanceledCounter(s.Canceled.WithLabelValues("/"))
+			time.Sleep(time.Millisecond)
+			if tt.cancel {
+				cancel()
+			}
+			d := timer.ObserveDuration()
+			if d < time.Millisecond {
+				t.Errorf("duration %v, want at least 1ms", d)
+			}
+
+			histogram := gatherFamily(t, registry, "latency_seconds").GetMetric()[0].GetHistogram()
+			if histogram.GetSampleCount() != 1 || histogram.GetSampleSum() != d.Seconds() {
+				t.Errorf("observed %d samples summing to %v, want 1 of %v",
+					histogram.GetSampleCount(), histogram.GetSampleSum(), d.Seconds())
+			}
+			if got := testutil.ToFloat64(s.Canceled.WithLabelValues("/")); got != tt.canceled {
+				t.Errorf("canceled_total = %v, want %v", got, tt.canceled)
+			}
+		})
+	}
+}
+
+func TestContextTimerWithoutCounter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	registry := prometheus.NewRegistry()
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "latency_seconds"})
+	registry.MustRegister(histogram)
+	NewContextTimer(ctx, histogram).ObserveDuration()
+	if n := gatherFamily(t, registry, "latency_seconds").GetMetric()[0].GetHistogram().GetSampleCount(); n != 1 {
+		t.Fatalf("%d samples observed, want 1", n)
+	}
+}
+
+func TestTimed(t *testing.T) {
+	type stat struct {
+		Latency  *prometheus.HistogramVec `misery:"name=latency_seconds,labels=[path],buckets=[10]"`
+		Requests *prometheus.CounterVec   `misery:"name=requests_total,labels=[path]"`
+	}
+
+	registry := prometheus.NewRegistry()
+	report, err := RegisterMetricsReport(&stat{}, registry)
+	if err != nil {
+		t.Fatalf("RegisterMetricsReport: %v", err)
+	}
+
+	func() {
+		defer Timed(report, "latency_seconds", prometheus.Labels{"path": "/"})()
+		time.Sleep(10 * time.Millisecond)
+	}()
+
+	histogram := gatherFamily(t, registry, "latency_seconds").GetMetric()[0].GetHistogram()
+	if got := histogram.GetSampleCount(); got != 1 {
+		t.Fatalf("got %d observations, want 1", got)
+	}
+	if got := histogram.GetSampleSum(); got < 0.01 || got >= 10 {
+		t.Errorf("observed %vs, want at least 0.01s", got)
+	}
+
+	unresolved := []struct {
+		name   string
+		field  string
+		labels prometheus.Labels
+	}{
+		{name: "unknown field", field: "missing_seconds", labels: prometheus.Labels{"path": "/"}},
+		{name: "not an observer", field: "requests_total", labels: prometheus.Labels{"path": "/"}},
+		{name: "wrong labels", field: "latency_seconds", labels: prometheus.Labels{"method": "GET"}},
+	}
+	for _, tt := range unresolved {
+		t.Run(tt.name, func(t *testing.T) {
+			stop := Timed(report, tt.field, tt.labels)
+			if stop == nil {
+				t.Fatal("Timed returned nil")
+			}
+			stop()
+			if _, err := StartTimer(report, tt.field, tt.labels); err == nil {
+				t.Error("StartTimer: got no error")
+			}
+		})
+	}
+	if got := testutil.CollectAndCount(report["latency_seconds"]); got != 1 {
+		t.Errorf("got %d latency series, want 1", got)
+	}
+	if got := gatherFamily(t, registry, "latency_seconds").GetMetric()[0].GetHistogram().GetSampleCount(); got != 1 {
+		t.Errorf("got %d observations after unresolved timers, want 1", got)
+	}
+}
+
+func TestTimerField(t *testing.T) {
+	type stat struct {
+		Request *Timer `misery:"name=request_duration_seconds,labels=[method],buckets=[1,10]"`
+		Query   *Timer `misery:"name=query_duration_seconds,type=summary"`
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	if _, ok := s.Request.ObserverVec().(*prometheus.HistogramVec); !ok {
+		t.Errorf("Request times on %T, want a histogram vec", s.Request.ObserverVec())
+	}
+	if _, ok := s.Query.ObserverVec().(*prometheus.SummaryVec); !ok {
+		t.Errorf("Query times on %T, want a summary vec", s.Query.ObserverVec())
+	}
+
+	func() {
+		defer s.Request.Start("GET").ObserveDuration()
+	}()
+	if d := s.Query.Start().ObserveDuration(); d < 0 {
+		t.Errorf("negative duration %v", d)
+	}
+
+	request := gatherFamily(t, registry, "request_duration_seconds").GetMetric()[0]
+	if got := request.GetLabel()[0].GetValue(); got != "GET" {
+		t.Errorf("method %q, want GET", got)
+	}
+	if got := request.GetHistogram().GetBucket()[0].GetCumulativeCount(); got != 1 {
+		t.Errorf("%d observations up to 1s, want 1", got)
+	}
+	if got := gatherFamily(t, registry, "query_duration_seconds").GetMetric()[0].GetSummary().GetSampleCount(); got != 1 {
+		t.Errorf("%d query observations, want 1", got)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Start with the wrong number of label values did not panic")
+		}
+	}()
+	s.Request.Start()
+}
+
+func TestTimerFieldUnregister(t *testing.T) {
+	type stat struct {
+		Request *Timer `misery:"name=request_duration_seconds,labels=[method]"`
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	s.Request.Start("GET").ObserveDuration()
+
+	if err := UnregisterMetrics(s, registry); err != nil {
+		t.Fatalf("UnregisterMetrics: %v", err)
+	}
+	if n := testutil.CollectAndCount(registry); n != 0 {
+		t.Errorf("%d metrics left registered", n)
+	}
+}
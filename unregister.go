@@ -0,0 +1,238 @@
+package misery
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yuin/stagparser"
+)
+
+// UnregisterMetrics removes the collectors held by the fields of mtrcs, the
+// collectors of fields tagged with register and the gauges of fields tagged
+// with as=gauge from registry.
+//
+// The lifecycle of a struct is register, unregister, register: every
+// RegisterMetrics call builds fresh collectors and overwrites the fields, so
+// values collected before UnregisterMetrics do not carry over. By default
+// the fields keep pointing to the unregistered collectors, which still work
+// but are no longer exposed; WithClearFields resets them to nil instead.
+// Fields tagged with register are never cleared. Registration keeps
+// non-nil single series fields, like prometheus.Gauge, as it would keep a
+// fake, so a struct with such fields needs WithClearFields to be registered
+// again in full.
+//
+// The collectors registration calls on mtrcs registered into registry are
+// unregistered as recorded, whatever the fields hold by now. Without such a
+// record, as after RegisterMetricsMulti or RegisterMetricsPrefixed, they
+// are looked up from the fields. Pass the options the struct was registered
+// with: WithRegistererLabels and WithTagKeys decide where its collectors
+// are found then, and WithSelfMetrics removes the
+// misery_registered_metrics series of the struct type. A metric field
+// holding a collector registry does not know fails with ErrMetricNotFound;
+// the other fields are unregistered nevertheless.
+func UnregisterMetrics(mtrcs interface{}, registry prometheus.Registerer, opts ...Option) error {
+	if err := checkRegistry(registry); err != nil {
+		return err
+	}
+
+	defer lockInstance(mtrcs)()
+
+	cfg := newConfig(opts...)
+	val, err := unpackStruct(mtrcs)
+	if err != nil {
+		return fmt.Errorf("struct unpack error: %w", err)
+	}
+
+	recorded := takeRegistration(mtrcs, registry)
+	registry = wrapRegisterer(registry, cfg)
+	if recorded != nil {
+		err = recorded.unregister(cfg)
+	} else {
+		u := &unregistration{visiting: map[reflect.Type]bool{val.Type(): true}, done: map[string]bool{}}
+		err = u.unregisterStruct(val, registry, cfg)
+	}
+	if cfg.selfMetrics {
+		if gauge, _, selfErr := selfMetricsGauge(registry); selfErr == nil {
+			gauge.DeleteLabelValues(val.Type().Name())
+		}
+	}
+
+	return err
+}
+
+// unregistration tracks one UnregisterMetrics call.
+type unregistration struct {
+	// visiting holds the struct types behind the pointers being recursed
+	// into, to stop at self-referencing types like registration does.
+	visiting map[reflect.Type]bool
+	// done holds the metrics unregistered so far, so a collector shared by
+	// several fields is unregistered once.
+	done map[string]bool
+}
+
+// unregisterStruct unregisters the fields of val.
+func (u *unregistration) unregisterStruct(val reflect.Value, registry prometheus.Registerer, cfg *config) error {
+	tags, err := parseStructTags(val, cfg.tagKeys...)
+	if err != nil {
+		return fmt.Errorf("struct tag parse error: %w", err)
+	}
+
+	var errs []error
+	for i := 0; i < val.NumField(); i++ {
+		field := val.Field(i)
+		typeField := val.Type().Field(i)
+		enabled, rest, err := fieldEnabled(typeField.Name, tags[typeField.Name], cfg)
+		if err != nil || !enabled {
+			continue
+		}
+		if hasDefinition(rest, "as") || (field.Type() == callbackType && hasTag(typeField, cfg.tagKeys)) {
+			defs, err := resolveDefinitions(val, typeField.Name, rest, cfg)
+			if err != nil {
+				continue
+			}
+			if hasDefinition(defs, "as") {
+				unregisterScalar(typeField.Name, field, defs, registry, cfg)
+			} else {
+				unregisterCallback(typeField.Name, field, defs, registry, cfg)
+			}
+			continue
+		}
+		if isNestedStruct(field) && !hasDefinition(tags[typeField.Name], "register") {
+			if err := u.unregisterStruct(field, registry, cfg); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", typeField.Name, err))
+			}
+			continue
+		}
+		if isNestedStructPtr(field, cfg.tagKeys) && !hasDefinition(tags[typeField.Name], "register") {
+			structType := field.Type().Elem()
+			if field.IsNil() || u.visiting[structType] {
+				continue
+			}
+			u.visiting[structType] = true
+			err := u.unregisterStruct(field.Elem(), registry, cfg)
+			delete(u.visiting, structType)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", typeField.Name, err))
+			}
+			continue
+		}
+		if isMetricSlice(field.Type()) {
+			for j := 0; j < field.Len(); j++ {
+				if err := u.unregisterField(fmt.Sprintf("%s[%d]", typeField.Name, j), field.Index(j), true, registry, cfg); err != nil {
+					errs = append(errs, err)
+				}
+			}
+			continue
+		}
+		managed := isMetricType(field.Type()) && !hasDefinition(tags[typeField.Name], "register")
+		if !managed && !isFuncMetricType(field.Type()) && !hasDefinition(tags[typeField.Name], "register") {
+			continue
+		}
+		if err := u.unregisterField(typeField.Name, field, managed, registry, cfg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// unregisterField unregisters the collector field holds, if any, and clears
+// a managed field under WithClearFields. A managed collector the registry
+// does not know is an error; any other is only logged.
+func (u *unregistration) unregisterField(
+	structFieldName string,
+	field reflect.Value,
+	managed bool,
+	registry prometheus.Registerer,
+	cfg *config,
+) error {
+	if field.IsZero() {
+		return nil
+	}
+	collector, ok := field.Interface().(prometheus.Collector)
+	if !ok {
+		return nil
+	}
+	key := descKey(collector)
+	if u.done[key] {
+		return nil
+	}
+	u.done[key] = true
+
+	var err error
+	if !unregister(registry, collector) {
+		if managed {
+			err = fmt.Errorf("%w: %s was not registered", ErrMetricNotFound, structFieldName)
+		} else {
+			cfg.logger.Printf("misery: %s was not registered", structFieldName)
+		}
+	}
+	if managed {
+		// the series count of WithCardinalityMetrics, if registered
+		for _, name := range describeNames(collector) {
+			registry.Unregister(newSeriesCounter(name, nil))
+		}
+	}
+	if managed && cfg.clearFields {
+		field.Set(reflect.Zero(field.Type()))
+	}
+
+	return err
+}
+
+// unregisterScalar unregisters the gauge registered for a field tagged with
+// as=gauge. Registries match collectors by name, so a gauge built anew from
+// the name attribute finds it.
+func unregisterScalar(
+	structFieldName string,
+	field reflect.Value,
+	defs []stagparser.Definition,
+	registry prometheus.Registerer,
+	cfg *config,
+) {
+	probe, _, err := createScalarGauge(structFieldName, field, probeDefinitions(defs), cfg)
+	if err != nil {
+		return
+	}
+	if !unregister(registry, probe) {
+		cfg.logger.Printf("misery: %s was not registered", structFieldName)
+	}
+}
+
+// unregisterCallback unregisters the func metric registered for a func()
+// float64 field, found by name as unregisterScalar finds scalar gauges.
+func unregisterCallback(
+	structFieldName string,
+	field reflect.Value,
+	defs []stagparser.Definition,
+	registry prometheus.Registerer,
+	cfg *config,
+) {
+	if field.IsNil() {
+		return
+	}
+	probe, _, err := createFuncMetric(structFieldName, field.Interface().(func() float64), probeDefinitions(defs), cfg)
+	if err != nil {
+		return
+	}
+	if !unregister(registry, probe) {
+		cfg.logger.Printf("misery: %s was not registered", structFieldName)
+	}
+}
+
+// probeDefinitions returns the attributes of defs, resolved by
+// resolveDefinitions, that make up the name and const labels a registry
+// knows a collector by.
+func probeDefinitions(defs []stagparser.Definition) []stagparser.Definition {
+	var probeDefs []stagparser.Definition
+	for _, def := range defs {
+		switch def.Name() {
+		case "name", "namespace", "subsystem", "unit", "constlabels", "constlabels_env", "const_label_from":
+			probeDefs = append(probeDefs, def)
+		}
+	}
+
+	return probeDefs
+}
@@ -0,0 +1,148 @@
+package misery
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRegisterUnregisterRegister(t *testing.T) {
+	type inner struct {
+		Depth prometheus.Gauge `misery:"name=queue_depth"`
+	}
+	type stat struct {
+		Requests *prometheus.CounterVec   `misery:"name=requests_total,labels=[code]"`
+		Latency  prometheus.ObserverVec   `misery:"name=latency_seconds"`
+		Sizes    []*prometheus.CounterVec `misery:"names=[small_total,large_total]"`
+		Inner    inner
+		Custom   *staticCollector `misery:"register"`
+	}
+
+	tests := []struct {
+		name  string
+		clear bool
+	}{
+		{name: "fields kept"},
+		{name: "fields cleared", clear: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			custom := newStaticCollector("custom", 1)
+			s := &stat{Custom: custom}
+			if err := RegisterMetrics(s, registry); err != nil {
+				t.Fatalf("RegisterMetrics: %v", err)
+			}
+			s.Requests.WithLabelValues("200").Inc()
+			first := s.Requests
+
+			if err := UnregisterMetrics(s, registry, WithClearFields(tt.clear)); err != nil {
+				t.Fatalf("UnregisterMetrics: %v", err)
+			}
+			if n := testutil.CollectAndCount(registry); n != 0 {
+				t.Fatalf("%d metrics left registered", n)
+			}
+			if cleared := s.Requests == nil && s.Latency == nil && s.Inner.Depth == nil; cleared != tt.clear {
+				t.Errorf("fields cleared: %v, want %v", cleared, tt.clear)
+			}
+			if s.Custom != custom {
+				t.Error("the register field was modified")
+			}
+
+			if err := RegisterMetrics(s, registry); err != nil {
+				t.Fatalf("registering again: %v", err)
+			}
+			if s.Requests == first {
+				t.Error("registering again reused the unregistered vec")
+			}
+			if got := testutil.ToFloat64(s.Requests.WithLabelValues("200")); got != 0 {
+				t.Errorf("requests_total = %v after registering again, want 0", got)
+			}
+			s.Latency.WithLabelValues().Observe(1)
+			s.Sizes[0].WithLabelValues().Inc()
+			s.Sizes[1].WithLabelValues().Inc()
+			// a kept single series is not registered again
+			want := 5
+			if tt.clear {
+				want = 6
+			}
+			if n := testutil.CollectAndCount(registry); n != want {
+				t.Errorf("%d metrics registered again, want %d", n, want)
+			}
+		})
+	}
+}
+
+func TestUnregisterMetricsNotFound(t *testing.T) {
+	type stat struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total"`
+		Errors   *prometheus.CounterVec `misery:"name=errors_total"`
+	}
+
+	registry := prometheus.NewRegistry()
+	s := &stat{}
+	if err := RegisterMetrics(s, registry); err != nil {
+		t.Fatalf("RegisterMetrics: %v", err)
+	}
+	registry.Unregister(s.Requests)
+
+	if err := UnregisterMetrics(s, registry); !errors.Is(err, ErrMetricNotFound) {
+		t.Fatalf("got error %v, want ErrMetricNotFound", err)
+	}
+	if n := testutil.CollectAndCount(registry); n != 0 {
+		t.Errorf("%d metrics left registered", n)
+	}
+}
+
+func TestUnregisterConstLabelFrom(t *testing.T) {
+	type stat struct {
+		Region  string
+		Ready   func() float64 `misery:"name=ready,help=Ready.,const_label_from=[region:Region]"`
+		Workers int            `misery:"name=workers,help=Workers.,as=gauge,const_label_from=[region:Region]"`
+	}
+
+	tests := []struct {
+		name       string
+		register   func(s *stat, registry prometheus.Registerer) error
+		unregister func(s *stat, registry prometheus.Registerer) error
+	}{
+		{
+			name: "recorded",
+			register: func(s *stat, registry prometheus.Registerer) error {
+				return RegisterMetrics(s, registry)
+			},
+			unregister: func(s *stat, registry prometheus.Registerer) error {
+				return UnregisterMetrics(s, registry)
+			},
+		},
+		{
+			name: "found from the fields",
+			register: func(s *stat, registry prometheus.Registerer) error {
+				return RegisterMetricsPrefixed(s, registry, "app")
+			},
+			unregister: func(s *stat, registry prometheus.Registerer) error {
+				return UnregisterMetrics(s, prometheus.WrapRegistererWithPrefix("app_", registry))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			s := &stat{Region: "eu", Ready: func() float64 { return 1 }, Workers: 4}
+			if err := tt.register(s, registry); err != nil {
+				t.Fatalf("registering: %v", err)
+			}
+			if n := testutil.CollectAndCount(registry); n != 2 {
+				t.Fatalf("%d metrics registered, want 2", n)
+			}
+			if err := tt.unregister(s, registry); err != nil {
+				t.Fatalf("unregistering: %v", err)
+			}
+			if n := testutil.CollectAndCount(registry); n != 0 {
+				t.Fatalf("%d metrics left registered", n)
+			}
+		})
+	}
+}
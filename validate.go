@@ -0,0 +1,109 @@
+package misery
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// Validate checks the misery tags of mtrcs the way RegisterMetrics would,
+// including metric name, label name and bucket validation, without touching
+// mtrcs or any registry. Every problem found is reported, joined with
+// errors.Join.
+func Validate(mtrcs interface{}, opts ...Option) error {
+	cfg := newConfig(opts...)
+	cfg.collectErrors = true
+	cfg.lenient = false
+	_, err := dryRun(mtrcs, cfg)
+
+	return err
+}
+
+// dryRun builds the metrics of a copy of mtrcs without registering them and
+// returns the registration state for inspection.
+func dryRun(mtrcs interface{}, cfg *config) (*registration, error) {
+	reg, _, err := dryRunCopy(mtrcs, cfg)
+	return reg, err
+}
+
+// dryRunCopy is dryRun also returning the copy of the struct the metrics
+// were built into.
+func dryRunCopy(mtrcs interface{}, cfg *config) (*registration, reflect.Value, error) {
+	val, err := unpackStruct(mtrcs)
+	if err != nil {
+		return nil, reflect.Value{}, fmt.Errorf("struct unpack error: %w", err)
+	}
+
+	scratch := reflect.New(val.Type())
+	scratch.Elem().Set(val)
+
+	cfg.register = false
+	reg := newRegistration(nil, cfg)
+	reg.copyPointers = true
+	if err := reg.add(context.Background(), scratch.Interface()); err != nil {
+		return nil, reflect.Value{}, err
+	}
+
+	return reg, scratch.Elem(), nil
+}
+
+// validateMetricInfo checks the metric described by info; vec tells whether
+// its field holds a vec rather than a single series or a callback.
+func validateMetricInfo(info metricInfo, vec bool, cfg *config) error {
+	if !model.IsValidLegacyMetricName(info.name) {
+		return fmt.Errorf("%w: %q is not a valid metric name", ErrAttributeMalformed, info.name)
+	}
+	for _, label := range info.labels {
+		if !model.LabelName(label).IsValidLegacy() {
+			return fmt.Errorf("%w: %q is not a valid label name", ErrAttributeMalformed, label)
+		}
+		if strings.HasPrefix(label, model.ReservedLabelPrefix) {
+			return fmt.Errorf("%w: label %q uses the reserved prefix %s", ErrAttributeMalformed, label, model.ReservedLabelPrefix)
+		}
+	}
+	if cfg.requireHelp && info.help == "" {
+		return fmt.Errorf("%w: %s has no help", ErrAttributeMalformed, info.name)
+	}
+	if cfg.errorOnEmptyLabels && len(info.labels) == 0 && vec {
+		return fmt.Errorf("%w: %s is a vec without labels", ErrAttributeMalformed, info.name)
+	}
+
+	return nil
+}
+
+func isVec(collector prometheus.Collector) bool {
+	switch collector.(type) {
+	case *prometheus.CounterVec, *prometheus.GaugeVec, *prometheus.HistogramVec, *prometheus.SummaryVec:
+		return true
+	}
+
+	return false
+}
+
+// rejectLabel fails when labels contain reserved, a label prometheus adds to
+// the series of the metric type itself, like le for histograms.
+func rejectLabel(labels []string, reserved string) error {
+	for _, label := range labels {
+		if label == reserved {
+			return fmt.Errorf("%w: label %q is reserved for this metric type", ErrAttributeMalformed, label)
+		}
+	}
+
+	return nil
+}
+
+// validateBuckets requires bucket upper bounds to be strictly increasing.
+func validateBuckets(buckets []float64) error {
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			return fmt.Errorf("%w: buckets must be strictly increasing, got %v after %v",
+				ErrAttributeMalformed, buckets[i], buckets[i-1])
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package misery
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestValidate(t *testing.T) {
+	type valid struct {
+		Requests *prometheus.CounterVec   `misery:"name=requests_total,labels=[code]"`
+		Latency  *prometheus.HistogramVec `misery:"name=latency_seconds,buckets=[0.1,1]"`
+	}
+	type invalid struct {
+		BadName    *prometheus.CounterVec   `misery:"name=bad-name"`
+		BadLabel   *prometheus.CounterVec   `misery:"name=bad_label_total,labels=[__reserved]"`
+		BadBuckets *prometheus.HistogramVec `misery:"name=bad_buckets_seconds,buckets=[1,0.5]"`
+		Fine       *prometheus.CounterVec   `misery:"name=fine_total"`
+		Duplicate  *prometheus.CounterVec   `misery:"name=fine_total"`
+	}
+
+	tests := []struct {
+		name  string
+		mtrcs interface{}
+		want  []string
+	}{
+		{name: "valid", mtrcs: &valid{}},
+		{
+			name:  "every problem reported",
+			mtrcs: &invalid{},
+			want:  []string{"BadName", "BadLabel", "BadBuckets", "Duplicate"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate(tt.mtrcs)
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("Validate: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			for _, field := range tt.want {
+				if !strings.Contains(err.Error(), field) {
+					t.Errorf("error does not report %s: %v", field, err)
+				}
+			}
+			if !errors.Is(err, ErrDuplicateMetricName) {
+				t.Errorf("error does not wrap ErrDuplicateMetricName: %v", err)
+			}
+		})
+	}
+
+	s := &invalid{}
+	_ = Validate(s)
+	if s.Fine != nil {
+		t.Error("Validate set a field of the struct")
+	}
+}
+
+func TestReservedLabels(t *testing.T) {
+	type histogramLe struct {
+		Latency *prometheus.HistogramVec `misery:"name=latency_seconds,labels=[le]"`
+	}
+	type summaryQuantile struct {
+		Latency *prometheus.SummaryVec `misery:"name=latency_seconds,labels=[quantile]"`
+	}
+	type observerLe struct {
+		Latency prometheus.ObserverVec `misery:"name=latency_seconds,type=histogram,labels=[path,le]"`
+	}
+	type observerQuantile struct {
+		Latency prometheus.ObserverVec `misery:"name=latency_seconds,type=summary,labels=[quantile]"`
+	}
+	type reservedPrefix struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,labels=[__name]"`
+	}
+	type counterLe struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,labels=[le,quantile]"`
+	}
+	type summaryLe struct {
+		Latency *prometheus.SummaryVec `misery:"name=latency_seconds,labels=[le]"`
+	}
+
+	tests := []struct {
+		name    string
+		mtrcs   interface{}
+		wantErr bool
+	}{
+		{name: "le on a histogram", mtrcs: &histogramLe{}, wantErr: true},
+		{name: "quantile on a summary", mtrcs: &summaryQuantile{}, wantErr: true},
+		{name: "le on a histogram observer vec", mtrcs: &observerLe{}, wantErr: true},
+		{name: "quantile on a summary observer vec", mtrcs: &observerQuantile{}, wantErr: true},
+		{name: "reserved prefix", mtrcs: &reservedPrefix{}, wantErr: true},
+		{name: "le and quantile on a counter", mtrcs: &counterLe{}},
+		{name: "le on a summary", mtrcs: &summaryLe{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := RegisterMetrics(tt.mtrcs, prometheus.NewRegistry())
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("RegisterMetrics: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrAttributeMalformed) {
+				t.Fatalf("got error %v, want ErrAttributeMalformed", err)
+			}
+		})
+	}
+}
+
+func TestErrorOnEmptyLabels(t *testing.T) {
+	type emptyVec struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total"`
+	}
+	type labeledVec struct {
+		Requests *prometheus.CounterVec `misery:"name=requests_total,labels=[code]"`
+	}
+	type series struct {
+		Requests prometheus.Counter `misery:"name=requests_total"`
+		Depth    func() float64     `misery:"name=queue_depth"`
+	}
+
+	tests := []struct {
+		name    string
+		mtrcs   interface{}
+		enabled bool
+		wantErr bool
+	}{
+		{name: "vec without labels", mtrcs: &emptyVec{}, enabled: true, wantErr: true},
+		{name: "vec without labels by default", mtrcs: &emptyVec{}},
+		{name: "vec with labels", mtrcs: &labeledVec{}, enabled: true},
+		{name: "single series and callbacks", mtrcs: &series{Depth: func() float64 { return 1 }}, enabled: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := RegisterMetricsWithOptions(tt.mtrcs, prometheus.NewRegistry(), WithErrorOnEmptyLabels(tt.enabled))
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("RegisterMetricsWithOptions: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrAttributeMalformed) || !strings.Contains(err.Error(), "requests_total") {
+				t.Fatalf("got error %v, want ErrAttributeMalformed naming requests_total", err)
+			}
+		})
+	}
+}